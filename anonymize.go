@@ -0,0 +1,626 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Anonymization strategies.
+const (
+	anonymizeEmail    = "email"    // a fake address, the same for equal inputs
+	anonymizeHash     = "hash"     // a keyed SHA-256 of the value, or a number for numbers
+	anonymizeNull     = "null"     // NULL
+	anonymizeFixed    = "fixed"    // Value
+	anonymizeTruncate = "truncate" // drop every row of the table
+)
+
+const insertPrefix = "INSERT INTO "
+
+// AnonymizeRule rewrites a column, or empties a table, while a dump is
+// pulled into a local database.
+type AnonymizeRule struct {
+	Table    string `json:"table"`            // name or glob pattern
+	Column   string `json:"column,omitempty"` // not used by truncate
+	Strategy string `json:"strategy"`
+	// Value is the replacement for fixed, the domain of the fake addresses
+	// for email (example.com by default) and the number of hex digits hash
+	// keeps (64 by default).
+	Value string `json:"value,omitempty"`
+}
+
+func (r AnonymizeRule) validate() error {
+	if r.Table == "" {
+		return errors.New("anonymize rule without a table")
+	}
+	if _, err := path.Match(r.Table, ""); err != nil {
+		return fmt.Errorf("invalid table pattern '%s': %w", r.Table, err)
+	}
+	switch r.Strategy {
+	case anonymizeTruncate:
+		return nil
+	case anonymizeEmail, anonymizeHash, anonymizeNull, anonymizeFixed:
+		if r.Column == "" {
+			return fmt.Errorf("anonymize rule for '%s' needs a column for strategy '%s'", r.Table, r.Strategy)
+		}
+		if r.Strategy == anonymizeHash && r.Value != "" {
+			if n, err := strconv.Atoi(r.Value); err != nil || n < 1 || n > 2*sha256.Size {
+				return fmt.Errorf("anonymize rule %s: hash value '%s' must be a length from 1 to 64", r, r.Value)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown anonymize strategy '%s' for '%s' (use email, hash, null, fixed or truncate)", r.Strategy, r.Table)
+}
+
+func (r AnonymizeRule) String() string {
+	if r.Column == "" {
+		return r.Table
+	}
+	return r.Table + "." + r.Column
+}
+
+// Anonymizer rewrites the INSERT statements of a mysqldump stream, or the
+// COPY blocks of a pg_dump one, according to AnonymizeRules. Column
+// positions are taken from the CREATE TABLE statement preceding the data,
+// or from the INSERT's or COPY's own column list.
+type Anonymizer struct {
+	rules []AnonymizeRule
+	// key makes hashes and fake emails consistent within one run, so equal
+	// values still match across tables, without them being reversible by
+	// hashing a list of known addresses.
+	key []byte
+
+	columns  map[string][]string // column order per table
+	types    map[string]string   // "table.column" -> type, from CREATE TABLE
+	creating string              // table whose CREATE TABLE is being read
+	copying  *copyRules          // rules for the COPY block being read
+	stats    AnonymizeStats
+
+	// copyHeaders is set for dumps that list the columns in the header of
+	// every COPY block (PostgreSQL), whose CREATE TABLE statements are not
+	// read.
+	copyHeaders bool
+}
+
+// copyRules are the rules applying to the rows of a COPY block.
+type copyRules struct {
+	table    string
+	byColumn map[int][]int // column index -> rule indexes
+	truncate int           // rule dropping the rows, or -1
+}
+
+// AnonymizeStats reports what each rule changed.
+type AnonymizeStats struct {
+	Rules []AnonymizeRuleStats
+}
+
+type AnonymizeRuleStats struct {
+	Rule AnonymizeRule
+	// Tables counts rewritten values (removed rows for truncate) per
+	// matching table found in the dump.
+	Tables map[string]int
+}
+
+// Unmatched returns the rules whose table was not found in the dump.
+func (s AnonymizeStats) Unmatched() []AnonymizeRule {
+	var rules []AnonymizeRule
+	for _, r := range s.Rules {
+		if len(r.Tables) == 0 {
+			rules = append(rules, r.Rule)
+		}
+	}
+	return rules
+}
+
+// Total returns the number of values a rule rewrote.
+func (r AnonymizeRuleStats) Total() int {
+	total := 0
+	for _, n := range r.Tables {
+		total += n
+	}
+	return total
+}
+
+// TableNames returns the tables the rule matched, sorted.
+func (r AnonymizeRuleStats) TableNames() []string {
+	var names []string
+	for name := range r.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewAnonymizer checks rules and returns an Anonymizer applying them.
+func NewAnonymizer(rules []AnonymizeRule) (*Anonymizer, error) {
+	a := &Anonymizer{rules: rules, key: make([]byte, 32), columns: map[string][]string{}, types: map[string]string{}}
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		a.stats.Rules = append(a.stats.Rules, AnonymizeRuleStats{Rule: rule, Tables: map[string]int{}})
+	}
+	if _, err := rand.Read(a.key); err != nil {
+		return nil, fmt.Errorf("failed to generate anonymization key: %w", err)
+	}
+	return a, nil
+}
+
+// anonymizer returns the Anonymizer for the configured rules, or nil if
+// there are none.
+func (c *Config) anonymizer() (*Anonymizer, error) {
+	if len(c.Anonymize) == 0 {
+		return nil, nil
+	}
+	return NewAnonymizer(c.Anonymize)
+}
+
+// useDialect sets how dumps made by driver describe the columns of a table.
+func (a *Anonymizer) useDialect(driver string) {
+	a.copyHeaders = driver == driverPostgres
+}
+
+// Stats returns what has been anonymized so far.
+func (a *Anonymizer) Stats() AnonymizeStats {
+	return a.stats
+}
+
+// matching returns the indexes of the rules that apply to table.
+func (a *Anonymizer) matching(table string) []int {
+	var rules []int
+	for i, rule := range a.rules {
+		if ok, _ := path.Match(rule.Table, table); ok {
+			rules = append(rules, i)
+		}
+	}
+	return rules
+}
+
+// Rewrite anonymizes a chunk of SQL made of complete lines, as handed out by
+// streamStatements.
+func (a *Anonymizer) Rewrite(sql string) (string, error) {
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	for sql != "" {
+		if a.copying != nil {
+			line := sql[:lineEnd(sql)]
+			sql = sql[len(line):]
+			if isCopyEnd(line) {
+				a.copying = nil
+				b.WriteString(line)
+			} else {
+				b.WriteString(a.rewriteCopyRow(line))
+			}
+			continue
+		}
+
+		if strings.HasPrefix(sql, insertPrefix) {
+			end := statementEnd(sql)
+			out, err := a.rewriteInsert(sql[:end])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(out)
+			sql = sql[end:]
+			continue
+		}
+
+		line := sql
+		if i := strings.IndexByte(sql, '\n'); i >= 0 {
+			line = sql[:i+1]
+		}
+		if table, columns, ok := parseCopyHeader(line); ok {
+			if err := a.startCopy(table, columns); err != nil {
+				return "", err
+			}
+		} else if err := a.readSchema(line); err != nil {
+			return "", err
+		}
+		b.WriteString(line)
+		sql = sql[len(line):]
+	}
+	return b.String(), nil
+}
+
+// readSchema follows the CREATE TABLE statements of tables with rules,
+// one line at a time, to learn their column order.
+func (a *Anonymizer) readSchema(line string) error {
+	if a.copyHeaders {
+		// Schema qualified names and unquoted columns; the COPY headers
+		// have what is needed
+		return nil
+	}
+	if strings.HasPrefix(line, "CREATE TABLE ") {
+		name := strings.TrimPrefix(line[len("CREATE TABLE "):], "IF NOT EXISTS ")
+		table := parseTableName(name)
+		a.creating = ""
+		if rules := a.matching(table); len(rules) > 0 {
+			a.creating = table
+			a.columns[table] = nil
+			// Recorded as found even if the table has no rows
+			for _, i := range rules {
+				a.stats.Rules[i].Tables[table] += 0
+			}
+		}
+		return nil
+	}
+	if a.creating == "" {
+		return nil
+	}
+
+	def := strings.TrimLeft(line, " ")
+	switch {
+	case strings.HasPrefix(def, "`"):
+		column := parseTableName(def)
+		a.columns[a.creating] = append(a.columns[a.creating], column)
+		if typ, _, _ := strings.Cut(strings.TrimSpace(def[len(column)+2:]), " "); typ != "" {
+			a.types[a.creating+"."+column] = strings.TrimSuffix(typ, ",")
+		}
+	case strings.HasPrefix(def, ")"):
+		table := a.creating
+		a.creating = ""
+		// A missing column is most likely a typo; failing is safer than
+		// letting the real values through
+		for _, i := range a.matching(table) {
+			rule := a.rules[i]
+			if rule.Strategy != anonymizeTruncate && indexOf(a.columns[table], rule.Column) < 0 {
+				return fmt.Errorf("anonymize rule %s: table `%s` has no column `%s`", rule, table, rule.Column)
+			}
+			// A hex digest is neither a date nor one of a list of values,
+			// and a strict import rejects it
+			if typ := a.types[table+"."+rule.Column]; rule.Strategy == anonymizeHash && unhashableType.MatchString(typ) {
+				return fmt.Errorf("anonymize rule %s: cannot hash column `%s` of type %s; use fixed or null", rule, rule.Column, typ)
+			}
+		}
+	}
+	return nil
+}
+
+// rewriteInsert applies the rules for the table stmt inserts into. Truncated
+// tables lose the whole statement.
+func (a *Anonymizer) rewriteInsert(stmt string) (string, error) {
+	table := parseTableName(stmt[len(insertPrefix):])
+	rules := a.matching(table)
+	values := strings.Index(stmt, " VALUES ")
+	if len(rules) == 0 || values < 0 {
+		return stmt, nil
+	}
+	head, body := stmt[:values+len(" VALUES ")], stmt[values+len(" VALUES "):]
+
+	for _, i := range rules {
+		if a.rules[i].Strategy == anonymizeTruncate {
+			_, rows, err := rewriteTuples(body, nil)
+			if err != nil {
+				return "", fmt.Errorf("failed to parse INSERT INTO `%s`: %w", table, err)
+			}
+			a.stats.Rules[i].Tables[table] += rows
+			return "", nil
+		}
+	}
+
+	columns := a.columns[table]
+	if open := strings.IndexByte(head[len(insertPrefix):], '('); open >= 0 {
+		columns = parseColumnList(head[len(insertPrefix)+open:])
+	}
+	if columns == nil {
+		return "", fmt.Errorf("cannot anonymize `%s`: its column order is unknown (the dump has no CREATE TABLE for it)", table)
+	}
+
+	byColumn := map[int][]int{}
+	for _, i := range rules {
+		col := indexOf(columns, a.rules[i].Column)
+		if col < 0 {
+			return "", fmt.Errorf("anonymize rule %s: table `%s` has no column `%s`", a.rules[i], table, a.rules[i].Column)
+		}
+		byColumn[col] = append(byColumn[col], i)
+	}
+
+	out, _, err := rewriteTuples(body, func(col int, value string) string {
+		for _, i := range byColumn[col] {
+			value = a.anonymize(a.rules[i], table, value)
+			a.stats.Rules[i].Tables[table]++
+		}
+		return value
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to parse INSERT INTO `%s`: %w", table, err)
+	}
+	return head + out, nil
+}
+
+// startCopy prepares the rules for the rows of a COPY block into table,
+// whose header lists its columns.
+func (a *Anonymizer) startCopy(table string, columns []string) error {
+	c := &copyRules{table: table, byColumn: map[int][]int{}, truncate: -1}
+	for _, i := range a.matching(table) {
+		a.stats.Rules[i].Tables[table] += 0
+		rule := a.rules[i]
+		if rule.Strategy == anonymizeTruncate {
+			c.truncate = i
+			continue
+		}
+		col := indexOf(columns, rule.Column)
+		if col < 0 {
+			return fmt.Errorf("anonymize rule %s: table %s has no column %s", rule, table, rule.Column)
+		}
+		c.byColumn[col] = append(c.byColumn[col], i)
+	}
+	a.copying = c
+	return nil
+}
+
+// rewriteCopyRow applies the rules of the current COPY block to a row.
+func (a *Anonymizer) rewriteCopyRow(line string) string {
+	c := a.copying
+	if c.truncate >= 0 {
+		a.stats.Rules[c.truncate].Tables[c.table]++
+		return ""
+	}
+	if len(c.byColumn) == 0 {
+		return line
+	}
+
+	body := strings.TrimSuffix(line, "\n")
+	fields := strings.Split(body, "\t")
+	for col, rules := range c.byColumn {
+		if col >= len(fields) {
+			continue
+		}
+		for _, i := range rules {
+			fields[col] = a.anonymizeCopy(a.rules[i], c.table, fields[col])
+			a.stats.Rules[i].Tables[c.table]++
+		}
+	}
+	return strings.Join(fields, "\t") + line[len(body):]
+}
+
+// anonymize returns the SQL value replacing value, from table, under rule.
+func (a *Anonymizer) anonymize(rule AnonymizeRule, table, value string) string {
+	s, null := sqlValue(value)
+	out, outNull := a.anonymizeValue(rule, table, s, null)
+	switch {
+	case out == s && outNull == null:
+		return value
+	case outNull:
+		return "NULL"
+	case !strings.HasSuffix(strings.TrimSpace(value), "'") && numberValue.MatchString(out):
+		// Left unquoted, as the column is most likely numeric
+		return out
+	}
+	return "'" + escapeSQLString(out) + "'"
+}
+
+// anonymizeCopy returns the COPY field replacing field, from table, under
+// rule.
+func (a *Anonymizer) anonymizeCopy(rule AnonymizeRule, table, field string) string {
+	s, null := decodeCopyField(field)
+	out, outNull := a.anonymizeValue(rule, table, s, null)
+	switch {
+	case out == s && outNull == null:
+		return field
+	case outNull:
+		return `\N`
+	}
+	return encodeCopyField(out)
+}
+
+// anonymizeValue returns the decoded value replacing s, from table, or
+// null, under rule.
+func (a *Anonymizer) anonymizeValue(rule AnonymizeRule, table, s string, null bool) (string, bool) {
+	switch rule.Strategy {
+	case anonymizeNull:
+		return "", true
+	case anonymizeFixed:
+		return rule.Value, false
+	case anonymizeHash:
+		switch {
+		case null:
+		case numberValue.MatchString(s):
+			return a.digestNumber(s), false
+		default:
+			return a.digest(s)[:a.hashLength(rule, table)], false
+		}
+	case anonymizeEmail:
+		if !null && s != "" {
+			domain := rule.Value
+			if domain == "" {
+				domain = "example.com"
+			}
+			return "user_" + a.digest(s)[:16] + "@" + domain, false
+		}
+	}
+	return s, null
+}
+
+func (a *Anonymizer) digest(s string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	// numberValue matches the values hash turns into numbers
+	numberValue = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+	// unhashableType matches the MySQL column types a hex digest or a
+	// number does not fit
+	unhashableType = regexp.MustCompile(`(?i)^(date|time|datetime|timestamp|year|enum|set|json|bit)\b`)
+	// charWidth matches the MySQL string types with a maximum length
+	charWidth = regexp.MustCompile(`(?i)^(?:var)?char\(([0-9]+)\)`)
+)
+
+// digestNumber hashes a number into one of the same shape: the integer
+// part, never larger than that of s, and as many decimals, so the result
+// fits any numeric column s came from.
+func (a *Anonymizer) digestNumber(s string) string {
+	sign, digits := "", s
+	if strings.HasPrefix(s, "-") {
+		sign, digits = "-", s[1:]
+	}
+	whole, frac, _ := strings.Cut(digits, ".")
+
+	h, _ := new(big.Int).SetString(a.digest(s), 16)
+	limit, _ := new(big.Int).SetString(whole, 10)
+	n := new(big.Int).Mod(h, limit.Add(limit, big.NewInt(1))).String()
+	// Leading zeros kept, for number-like strings such as postcodes
+	out := sign + strings.Repeat("0", len(whole)-len(n)) + n
+	if frac != "" {
+		var b strings.Builder
+		for _, c := range a.digest(s + ".")[:len(frac)] {
+			b.WriteByte('0' + byte(c)%10)
+		}
+		out += "." + b.String()
+	}
+	return out
+}
+
+// hashLength returns how many hex digits of the digest rule keeps in table:
+// the rule's value, if set, but no more than the column's CREATE TABLE
+// allows.
+func (a *Anonymizer) hashLength(rule AnonymizeRule, table string) int {
+	n := 2 * sha256.Size
+	if rule.Value != "" {
+		n, _ = strconv.Atoi(rule.Value)
+	}
+	if m := charWidth.FindStringSubmatch(a.types[table+"."+rule.Column]); m != nil {
+		if width, _ := strconv.Atoi(m[1]); width > 0 && width < n {
+			n = width
+		}
+	}
+	return n
+}
+
+// sqlValue decodes a value as written by mysqldump: a quoted string
+// (optionally with a charset introducer such as _binary), NULL, or a bare
+// number or hex literal, which is returned as is.
+func sqlValue(raw string) (value string, null bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "NULL" {
+		return "", true
+	}
+	if strings.HasPrefix(raw, "_") {
+		if i := strings.IndexByte(raw, '\''); i > 0 {
+			raw = raw[i:]
+		}
+	}
+	if len(raw) >= 2 && raw[0] == '\'' && raw[len(raw)-1] == '\'' {
+		return unescapeSQLString(raw[1 : len(raw)-1]), false
+	}
+	return raw, false
+}
+
+// rewriteTuples walks the "(v1,v2),(v3,v4);" part of an INSERT, passing each
+// raw value and its column index to rewrite (if not nil) and substituting
+// its result. It returns the rewritten text and the number of rows.
+func rewriteTuples(s string, rewrite func(col int, value string) string) (string, int, error) {
+	var b strings.Builder
+	if rewrite != nil {
+		b.Grow(len(s))
+	}
+
+	rows, col, depth := 0, 0, 0
+	start := -1 // start of the current value, inside a row
+	last := 0   // end of the text already copied to b
+
+	emit := func(end int) {
+		if rewrite == nil {
+			return
+		}
+		value := s[start:end]
+		if out := rewrite(col, value); out != value {
+			b.WriteString(s[last:start])
+			b.WriteString(out)
+			last = end
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'':
+			end := scanSQLString(s, i)
+			if end < 0 {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			i = end - 1
+		case c == '(':
+			if depth == 0 {
+				col, start = 0, i+1
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				emit(i)
+				rows++
+				start = -1
+			}
+		case c == ',' && depth == 1:
+			emit(i)
+			col++
+			start = i + 1
+		}
+	}
+	if depth != 0 {
+		return "", 0, fmt.Errorf("unbalanced parentheses")
+	}
+	if rewrite == nil {
+		return s, rows, nil
+	}
+	b.WriteString(s[last:])
+	return b.String(), rows, nil
+}
+
+// parseColumnList reads "(`a`, `b`)" into its column names.
+func parseColumnList(s string) []string {
+	end := strings.IndexByte(s, ')')
+	if !strings.HasPrefix(s, "(") || end < 0 {
+		return nil
+	}
+	var columns []string
+	for _, name := range strings.Split(s[1:end], ",") {
+		columns = append(columns, strings.Trim(strings.TrimSpace(name), "`\""))
+	}
+	return columns
+}
+
+// statementEnd returns the index just past the statement at the start of
+// sql: after its semicolon and the newline following it.
+func statementEnd(sql string) int {
+	for i := 0; i < len(sql); i++ {
+		switch sql[i] {
+		case '\'':
+			if end := scanSQLString(sql, i); end >= 0 {
+				i = end - 1
+			} else {
+				return len(sql)
+			}
+		case '`':
+			i = skipPast(sql, i+1, "`") - 1
+		case ';':
+			if i+1 < len(sql) && sql[i+1] == '\n' {
+				return i + 2
+			}
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const anonymizeDump = "CREATE TABLE `wp_users` (\n" +
+	"  `ID` bigint(20) unsigned NOT NULL AUTO_INCREMENT,\n" +
+	"  `user_login` varchar(60) NOT NULL DEFAULT '',\n" +
+	"  `user_pass` varchar(255) NOT NULL DEFAULT '',\n" +
+	"  `user_email` varchar(100) NOT NULL DEFAULT '',\n" +
+	"  `display_name` varchar(250) DEFAULT NULL,\n" +
+	"  PRIMARY KEY (`ID`),\n" +
+	"  KEY `user_login_key` (`user_login`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;\n" +
+	"INSERT INTO `wp_users` VALUES (1,'admin','$P$Bxyz','jane@real.com','Jane (O\\'Neil), admin'),(2,'bob','$P$Babc','',NULL);\n" +
+	"CREATE TABLE `wp_sessions` (\n" +
+	"  `id` int NOT NULL,\n" +
+	"  `data` text\n" +
+	");\n" +
+	"INSERT INTO `wp_sessions` VALUES (1,'a;b'),(2,'c');\n" +
+	"INSERT INTO `wp_posts` VALUES (1,'jane@real.com');\n"
+
+func TestAnonymizerRewrite(t *testing.T) {
+	a, err := NewAnonymizer([]AnonymizeRule{
+		{Table: "wp_users", Column: "user_email", Strategy: anonymizeEmail},
+		{Table: "wp_users", Column: "user_pass", Strategy: anonymizeFixed, Value: "x'y"},
+		{Table: "wp_users", Column: "display_name", Strategy: anonymizeNull},
+		{Table: "wp_users", Column: "user_login", Strategy: anonymizeHash},
+		{Table: "wp_sess*", Strategy: anonymizeTruncate},
+		{Table: "wc_customers", Column: "email", Strategy: anonymizeEmail},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := streamStatements(&out, strings.NewReader(anonymizeDump), false, a.Rewrite); err != nil {
+		t.Fatalf("Rewrite() error: %v", err)
+	}
+	got := out.String()
+
+	// user_login is a varchar(60)
+	insert := regexp.MustCompile("INSERT INTO `wp_users` VALUES \\(1,'([0-9a-f]{60})','x\\\\'y','user_[0-9a-f]{16}@example.com',NULL\\),\\(2,'([0-9a-f]{60})','x\\\\'y','',NULL\\);\n")
+	if !insert.MatchString(got) {
+		t.Errorf("wp_users not anonymized as expected:\n%s", got)
+	}
+	if strings.Contains(got, "INSERT INTO `wp_sessions`") {
+		t.Error("truncated table still has rows")
+	}
+	if !strings.Contains(got, "CREATE TABLE `wp_sessions`") {
+		t.Error("truncated table lost its structure")
+	}
+	if !strings.Contains(got, "INSERT INTO `wp_posts` VALUES (1,'jane@real.com');\n") {
+		t.Error("table without rules was changed")
+	}
+
+	stats := a.Stats()
+	if n := stats.Rules[0].Tables["wp_users"]; n != 2 {
+		t.Errorf("email rule rewrote %d values, want 2", n)
+	}
+	if n := stats.Rules[4].Tables["wp_sessions"]; n != 2 {
+		t.Errorf("truncate rule removed %d rows, want 2", n)
+	}
+	if unmatched := stats.Unmatched(); len(unmatched) != 1 || unmatched[0].Table != "wc_customers" {
+		t.Errorf("Unmatched() = %v", unmatched)
+	}
+}
+
+func TestAnonymizerConsistentWithinRun(t *testing.T) {
+	a, err := NewAnonymizer([]AnonymizeRule{{Table: "*", Column: "email", Strategy: anonymizeEmail, Value: "test.invalid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := a.Rewrite("INSERT INTO `users` (`id`, `email`) VALUES (1,'jane@real.com');\n" +
+		"INSERT INTO `orders` (`email`, `total`) VALUES ('jane@real.com',10);\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := a.anonymize(a.rules[0], "users", "'jane@real.com'")
+	if !strings.HasSuffix(fake, "@test.invalid'") || strings.Count(got, fake) != 2 {
+		t.Errorf("equal values were not anonymized alike (%s):\n%s", fake, got)
+	}
+}
+
+func TestAnonymizerHashFitsColumn(t *testing.T) {
+	rules := []AnonymizeRule{
+		{Table: "customers", Column: "id", Strategy: anonymizeHash},
+		{Table: "customers", Column: "phone", Strategy: anonymizeHash},
+		{Table: "customers", Column: "postcode", Strategy: anonymizeHash},
+		{Table: "customers", Column: "balance", Strategy: anonymizeHash},
+		{Table: "customers", Column: "note", Strategy: anonymizeHash, Value: "8"},
+	}
+	a, err := NewAnonymizer(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := "CREATE TABLE `customers` (\n" +
+		"  `id` tinyint NOT NULL,\n" +
+		"  `phone` varchar(20) DEFAULT NULL,\n" +
+		"  `postcode` char(5) DEFAULT NULL,\n" +
+		"  `balance` decimal(5,2) NOT NULL,\n" +
+		"  `note` text\n" +
+		");\n" +
+		"INSERT INTO `customers` VALUES (127,'+44 20 7946 0958','00123',-123.45,'VIP');\n"
+
+	var out strings.Builder
+	if err := streamStatements(&out, strings.NewReader(dump), false, a.Rewrite); err != nil {
+		t.Fatalf("Rewrite() error: %v", err)
+	}
+	row := regexp.MustCompile(`VALUES \(([0-9]+),'([0-9a-f]+)','([0-9]+)',(-[0-9]+\.[0-9]+),'([0-9a-f]+)'\);`).FindStringSubmatch(out.String())
+	if row == nil {
+		t.Fatalf("customers not anonymized as expected:\n%s", out.String())
+	}
+	// Numbers stay numbers no larger than the original, so they fit the
+	// column, and strings fit its width
+	if id, _ := strconv.Atoi(row[1]); id > 127 {
+		t.Errorf("id = %s, more than the tinyint held", row[1])
+	}
+	if len(row[2]) != 20 || len(row[3]) != 5 || len(row[4]) != len("-123.45") || len(row[5]) != 8 {
+		t.Errorf("values %q do not fit their columns", row[2:])
+	}
+
+	// Without a CREATE TABLE, as in a pg_dump, numbers are still numbers
+	a, _ = NewAnonymizer(rules[:1])
+	a.useDialect(driverPostgres)
+	out.Reset()
+	copyBlock := "COPY public.customers (id) FROM stdin;\n42\n\\.\n"
+	if err := streamStatements(&out, strings.NewReader(copyBlock), true, a.Rewrite); err != nil {
+		t.Fatalf("Rewrite() error: %v", err)
+	}
+	if !regexp.MustCompile("FROM stdin;\n[0-9]{2}\n").MatchString(out.String()) {
+		t.Errorf("COPY id not hashed to a number:\n%s", out.String())
+	}
+}
+
+func TestAnonymizerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule AnonymizeRule
+		sql  string
+	}{
+		{
+			name: "missing column",
+			rule: AnonymizeRule{Table: "wp_users", Column: "email", Strategy: anonymizeNull},
+			sql:  anonymizeDump,
+		},
+		{
+			name: "hashed date",
+			rule: AnonymizeRule{Table: "orders", Column: "created", Strategy: anonymizeHash},
+			sql:  "CREATE TABLE `orders` (\n  `created` datetime NOT NULL\n);\n",
+		},
+		{
+			name: "unknown column order",
+			rule: AnonymizeRule{Table: "wp_posts", Column: "email", Strategy: anonymizeNull},
+			sql:  "INSERT INTO `wp_posts` VALUES (1,'a');\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewAnonymizer([]AnonymizeRule{tt.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := streamStatements(io.Discard, strings.NewReader(tt.sql), false, a.Rewrite); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	for _, rule := range []AnonymizeRule{
+		{Table: "wp_users", Strategy: "scramble"},
+		{Table: "wp_users", Strategy: anonymizeEmail},
+		{Column: "email", Strategy: anonymizeNull},
+		{Table: "wp_users", Column: "user_login", Strategy: anonymizeHash, Value: "65"},
+	} {
+		if _, err := NewAnonymizer([]AnonymizeRule{rule}); err == nil {
+			t.Errorf("invalid rule %+v accepted", rule)
+		}
+	}
+}
+
+func TestSyncDB_AnonymizesPullsOnly(t *testing.T) {
+	cfg := &Config{
+		Remote:    HostSettings{DB: "remote_db"},
+		Local:     HostSettings{DB: "local_db"},
+		Anonymize: []AnonymizeRule{{Table: "users", Column: "email", Strategy: anonymizeNull}},
+	}
+	dump := func(ctx context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, "INSERT INTO `users` (`email`) VALUES ('jane@real.com');\n")
+		return err
+	}
+	var written string
+	write := func(ctx context.Context, r io.Reader) error {
+		sql, err := io.ReadAll(r)
+		written = string(sql)
+		return err
+	}
+
+	if err := SyncDB(context.Background(), &MockDBProvider{DumpRemoteFunc: dump, WriteLocalFunc: write}, cfg, SyncOptions{}); err != nil {
+		t.Fatalf("SyncDB failed: %v", err)
+	}
+	if written != "INSERT INTO `users` (`email`) VALUES (NULL);\n" {
+		t.Errorf("pull wrote %q", written)
+	}
+
+	if err := SyncDB(context.Background(), &MockDBProvider{DumpLocalFunc: dump, WriteRemoteFunc: write}, cfg, SyncOptions{Reverse: true}); err != nil {
+		t.Fatalf("SyncDB failed: %v", err)
+	}
+	if !strings.Contains(written, "jane@real.com") {
+		t.Errorf("push must not anonymize, wrote %q", written)
+	}
+}
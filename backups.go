@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat is the timestamp embedded in backup file names.
+const backupTimeFormat = "20060102_150405"
+
+// BackupPolicy decides which remote backups prune keeps. A backup is kept
+// if any configured rule keeps it; with no rules every backup is kept.
+type BackupPolicy struct {
+	KeepLast   int `json:"keepLast,omitempty"`   // keep the newest N backups
+	MaxAgeDays int `json:"maxAgeDays,omitempty"` // keep backups newer than this
+}
+
+func (p BackupPolicy) IsSet() bool {
+	return p.KeepLast > 0 || p.MaxAgeDays > 0
+}
+
+// Apply splits backups into those the policy keeps and those it removes.
+// Both are returned newest first.
+func (p BackupPolicy) Apply(backups []backupFile, now time.Time) (keep, remove []backupFile) {
+	sorted := sortBackups(backups)
+	if !p.IsSet() {
+		return sorted, nil
+	}
+
+	cutoff := now.AddDate(0, 0, -p.MaxAgeDays)
+	for i, b := range sorted {
+		if i < p.KeepLast || (p.MaxAgeDays > 0 && b.Time.After(cutoff)) {
+			keep = append(keep, b)
+		} else {
+			remove = append(remove, b)
+		}
+	}
+	return keep, remove
+}
+
+// sortBackups returns a copy of backups, newest first.
+func sortBackups(backups []backupFile) []backupFile {
+	sorted := append([]backupFile(nil), backups...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Time.After(sorted[j].Time)
+	})
+	return sorted
+}
+
+// backupFile is a timestamped database backup: one written to the SSH
+// user's home directory by sshDB.Backup, or a local snapshot.
+type backupFile struct {
+	Name string
+	Time time.Time
+	Size int64
+}
+
+func remoteBackupName(db string, t time.Time) string {
+	return fmt.Sprintf("%s_backup_%s.sql", db, t.Format(backupTimeFormat))
+}
+
+// parseBackupName returns the time a backup of db was taken, or false if
+// name is not such a backup.
+func parseBackupName(db, name string) (time.Time, bool) {
+	return parseStampedName(name, db+"_backup_", ".sql")
+}
+
+// parseStampedName parses names of the form <prefix><timestamp><suffix>.
+func parseStampedName(name, prefix, suffix string) (time.Time, bool) {
+	stamp, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	stamp, ok = strings.CutSuffix(stamp, suffix)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// ListBackups returns the backups of the database on the SSH host, newest
+// first.
+func (d *sshDB) ListBackups(ctx context.Context) ([]backupFile, error) {
+	// Print "<size>\t<name>" for every candidate; the glob stays unexpanded
+	// when nothing matches, which the -f test filters out
+	script := fmt.Sprintf(`for f in %s*.sql; do [ -f "$f" ] && printf '%%s\t%%s\n' "$(wc -c < "$f")" "$f"; done; true`,
+		shellQuote(d.db.name()+"_backup_"))
+
+	output, err := d.output(ctx, script)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var backups []backupFile
+	for _, line := range strings.Split(string(output), "\n") {
+		sizeField, name, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		t, ok := parseBackupName(d.db.name(), name)
+		if !ok {
+			continue
+		}
+		size, _ := strconv.ParseInt(strings.TrimSpace(sizeField), 10, 64)
+		backups = append(backups, backupFile{Name: name, Time: t, Size: size})
+	}
+
+	return sortBackups(backups), nil
+}
+
+// ReadBackup streams a backup file to w.
+func (d *sshDB) ReadBackup(ctx context.Context, name string, w io.Writer) error {
+	if _, ok := parseBackupName(d.db.name(), name); !ok {
+		return fmt.Errorf("'%s' is not a backup of database '%s'", name, d.db.DB)
+	}
+
+	wrap, err := d.compression.outputWrapper()
+	if err != nil {
+		return err
+	}
+	if err := d.stream(ctx, d.command(wrap("cat -- "+shellQuote(name)), nil), w); err != nil {
+		return fmt.Errorf("failed to read backup %s: %w", name, err)
+	}
+	return nil
+}
+
+// RemoveBackups deletes backup files from the SSH host.
+func (d *sshDB) RemoveBackups(ctx context.Context, backups []backupFile) error {
+	if len(backups) == 0 {
+		return nil
+	}
+
+	args := []string{"rm", "-f", "--"}
+	for _, b := range backups {
+		if _, ok := parseBackupName(d.db.name(), b.Name); !ok {
+			return fmt.Errorf("refusing to remove '%s': not a backup of database '%s'", b.Name, d.db.DB)
+		}
+		args = append(args, shellQuote(b.Name))
+	}
+
+	if _, err := d.output(ctx, strings.Join(args, " ")); err != nil {
+		return fmt.Errorf("failed to remove backups: %w", err)
+	}
+	return nil
+}
+
+// Prune removes the backups the policy does not keep and returns them.
+func (d *sshDB) Prune(ctx context.Context, policy BackupPolicy) ([]backupFile, error) {
+	if !policy.IsSet() {
+		return nil, nil
+	}
+	backups, err := d.ListBackups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, remove := policy.Apply(backups, time.Now())
+	return remove, d.RemoveBackups(ctx, remove)
+}
+
+// output runs a script on the SSH host and returns its stdout.
+func (d *sshDB) output(ctx context.Context, script string) ([]byte, error) {
+	stdout, stderr, err := output(ctx, d.exec, d.command(script, nil))
+	if err != nil {
+		return nil, fmt.Errorf("ssh command failed: %s: %w", stderr, err)
+	}
+	return stdout, nil
+}
+
+// backupHost returns the SSH database of the named environment, whose
+// backups the backups commands work with.
+func (c *Config) backupHost(name string) (*sshDB, error) {
+	env, err := c.environment(name)
+	if err != nil {
+		return nil, err
+	}
+	if env.IsLocal() {
+		return nil, fmt.Errorf("environment '%s' is local; backups are kept on remote environments", name)
+	}
+	return newSSHDB(env, c.dbSettings()), nil
+}
+
+// restoreBackup loads a backup taken on environment from into the database
+// of environment to. The target is backed up first, like in any other sync
+// into it.
+func (c *Config) restoreBackup(ctx context.Context, from, name, to string, opts SyncOptions) error {
+	src, err := c.backupHost(from)
+	if err != nil {
+		return err
+	}
+	replacer, err := c.restoreReplacer(from, to)
+	if err != nil {
+		return err
+	}
+	env, err := c.environment(to)
+	if err != nil {
+		return err
+	}
+	if err := checkSameDriver(src.db, env.DB); err != nil {
+		return err
+	}
+
+	t := dbTransfer{
+		source:   from,
+		target:   to,
+		driver:   env.DB.driverName(),
+		sourceDB: name,
+		targetDB: env.DB.DB,
+		dump: func(ctx context.Context, w io.Writer) error {
+			return src.ReadBackup(ctx, name, w)
+		},
+		replacer: replacer,
+		dumpPath: name,
+	}
+	if env.IsLocal() {
+		dst := newLocalDB(env.DB, c.dbSettings())
+		t.write, t.backup = dst.Write, dst.Backup
+		if t.anonymizer, err = c.anonymizer(); err != nil {
+			return err
+		}
+	} else {
+		// Without pruning: the policy could otherwise remove the very
+		// backup being restored
+		settings := c.dbSettings()
+		settings.backups = BackupPolicy{}
+		dst := newSSHDB(env, settings)
+		t.write, t.backup = dst.Write, dst.Backup
+	}
+
+	return transferDB(ctx, t, opts)
+}
+
+// restoreReplacer returns the replacer for loading a dump taken on one
+// environment into another: none for the same environment, otherwise the
+// same rules a sync between the two would apply.
+func (c *Config) restoreReplacer(from, to string) (*Replacer, error) {
+	if from == to {
+		return NewReplacer(nil), nil
+	}
+	if c.IsRemotePair(from, to) {
+		pair, err := c.RemotePair(from, to)
+		if err != nil {
+			return nil, err
+		}
+		return NewSinglePassReplacer(pair.DBReplace), nil
+	}
+	pair, reverse, err := c.ForPair(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if reverse {
+		// ForPair orients the rules remote -> local
+		return pair.replacer(reverseReplacements(pair.DBReplace)), nil
+	}
+	return pair.replacer(pair.DBReplace), nil
+}
+
+// formatSize renders a byte count for humans.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBackupName(t *testing.T) {
+	tests := []struct {
+		name   string
+		db     string
+		file   string
+		want   string
+		wantOK bool
+	}{
+		{"backup", "shop", "shop_backup_20240102_030405.sql", "2024-01-02 03:04:05", true},
+		{"db with underscore", "my_shop", "my_shop_backup_20240102_030405.sql", "2024-01-02 03:04:05", true},
+		{"other db", "shop", "blog_backup_20240102_030405.sql", "", false},
+		{"prefix of other db", "shop", "shop_backup_x_backup_20240102_030405.sql", "", false},
+		{"bad stamp", "shop", "shop_backup_latest.sql", "", false},
+		{"other extension", "shop", "shop_backup_20240102_030405.txt", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseBackupName(tt.db, tt.file)
+			if ok != tt.wantOK {
+				t.Fatalf("parseBackupName() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && got.Format("2006-01-02 15:04:05") != tt.want {
+				t.Errorf("parseBackupName() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupPolicyApply(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.Local)
+	var backups []backupFile
+	for _, daysAgo := range []int{40, 1, 10, 3, 20} {
+		backups = append(backups, backupFile{Name: fmt.Sprintf("%dd", daysAgo), Time: now.AddDate(0, 0, -daysAgo)})
+	}
+	names := func(bs []backupFile) []string {
+		var out []string
+		for _, b := range bs {
+			out = append(out, b.Name)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name       string
+		policy     BackupPolicy
+		keep, drop []string
+	}{
+		{"no policy keeps all", BackupPolicy{}, []string{"1d", "3d", "10d", "20d", "40d"}, nil},
+		{"keep last", BackupPolicy{KeepLast: 2}, []string{"1d", "3d"}, []string{"10d", "20d", "40d"}},
+		{"max age", BackupPolicy{MaxAgeDays: 15}, []string{"1d", "3d", "10d"}, []string{"20d", "40d"}},
+		{"either rule keeps", BackupPolicy{KeepLast: 4, MaxAgeDays: 5}, []string{"1d", "3d", "10d", "20d"}, []string{"40d"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep, drop := tt.policy.Apply(backups, now)
+			if !reflect.DeepEqual(names(keep), tt.keep) || !reflect.DeepEqual(names(drop), tt.drop) {
+				t.Errorf("Apply() keep %v, drop %v; want keep %v, drop %v", names(keep), names(drop), tt.keep, tt.drop)
+			}
+		})
+	}
+}
+
+func TestSSHDBBackupFiles(t *testing.T) {
+	// A fake ssh that runs the remote command in a temporary "home"
+	home := t.TempDir()
+	bin := t.TempDir()
+	fake := "#!/bin/sh\nfor a; do cmd=$a; done\ncd \"" + home + "\" && eval \"$cmd\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte(fake), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for name, content := range map[string]string{
+		"shop_backup_20240101_000000.sql": "old",
+		"shop_backup_20240301_000000.sql": "newer",
+		"shop_backup_notes.sql":           "ignored",
+		"blog_backup_20240101_000000.sql": "other db",
+	} {
+		if err := os.WriteFile(filepath.Join(home, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	db := newSSHDB(&Environment{SSHHost: "user@host", DB: HostSettings{DB: "shop"}}, dbSettings{exec: systemExecutor{}})
+
+	backups, err := db.ListBackups(ctx)
+	if err != nil {
+		t.Fatalf("ListBackups() error: %v", err)
+	}
+	if len(backups) != 2 || backups[0].Name != "shop_backup_20240301_000000.sql" || backups[0].Size != 5 {
+		t.Fatalf("ListBackups() = %+v", backups)
+	}
+
+	removed, err := db.Prune(ctx, BackupPolicy{KeepLast: 1})
+	if err != nil {
+		t.Fatalf("Prune() error: %v", err)
+	}
+	if len(removed) != 1 || removed[0].Name != "shop_backup_20240101_000000.sql" {
+		t.Errorf("Prune() removed %+v", removed)
+	}
+	for name, want := range map[string]bool{
+		"shop_backup_20240101_000000.sql": false,
+		"shop_backup_20240301_000000.sql": true,
+		"blog_backup_20240101_000000.sql": true,
+	} {
+		if _, err := os.Stat(filepath.Join(home, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, want)
+		}
+	}
+
+	if err := db.ReadBackup(ctx, "../etc/passwd", nil); err == nil {
+		t.Error("ReadBackup() accepted a name that is not a backup")
+	}
+}
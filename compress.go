@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression codecs. codecAuto picks the best one available on the far
+// side of an SSH connection at runtime.
+const (
+	codecAuto = "auto"
+	codecZstd = "zstd"
+	codecGzip = "gzip"
+	codecNone = "none"
+)
+
+// CompressionSettings controls how database dumps travel over SSH.
+type CompressionSettings struct {
+	Codec string `json:"codec,omitempty"` // auto (default), zstd, gzip or none
+	Level int    `json:"level,omitempty"` // codec specific; 0 uses the codec default
+}
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// candidates returns the codecs to try on the far side, in order of
+// preference.
+func (c CompressionSettings) candidates() ([]string, error) {
+	switch c.Codec {
+	case "", codecAuto:
+		return []string{codecZstd, codecGzip}, nil
+	case codecZstd, codecGzip:
+		return []string{c.Codec}, nil
+	case codecNone:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown compression codec '%s' (use auto, zstd, gzip or none)", c.Codec)
+}
+
+// level returns the level to use with codec, checking it is in range.
+func (c CompressionSettings) level(codec string) (int, error) {
+	lo, hi, def := 1, 19, 3
+	if codec == codecGzip {
+		lo, hi, def = 1, 9, 6
+	}
+	if c.Level == 0 {
+		return def, nil
+	}
+	if c.Level < lo || c.Level > hi {
+		return 0, fmt.Errorf("compression level %d is out of range for %s (%d-%d)", c.Level, codec, lo, hi)
+	}
+	return c.Level, nil
+}
+
+// outputWrapper returns a function that wraps a shell command so its
+// output is compressed with the first codec found on the host, or left as
+// is when none is. The command's exit status is preserved; the reader tells
+// the codecs apart by their magic bytes (see decompressReader). Commands
+// after the wrapped one only run if it succeeded.
+func (c CompressionSettings) outputWrapper() (func(run string) string, error) {
+	candidates, err := c.candidates()
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return func(run string) string { return run }, nil
+	}
+
+	var lookup []string
+	for _, codec := range candidates {
+		level, err := c.level(codec)
+		if err != nil {
+			return nil, err
+		}
+		lookup = append(lookup, fmt.Sprintf(`{ command -v %s >/dev/null && z="%s"; }`, codec, farCompressCommand(codec, level)))
+	}
+	fallback := `z=cat`
+	if c.Codec == codecZstd || c.Codec == codecGzip {
+		fallback = fmt.Sprintf(`{ echo "%s not found" >&2; exit 127; }`, c.Codec)
+	}
+
+	return func(run string) string {
+		return strings.Join([]string{
+			`st=$(mktemp) || exit 1`,
+			`trap 'rm -f ${f:+"$f"} "$st"' EXIT`,
+			strings.Join(lookup, " || ") + " || " + fallback,
+			fmt.Sprintf(`{ %s; echo $? > "$st"; } | $z || exit 1`, run),
+			`rc=$(cat "$st"); [ "${rc:-1}" = 0 ] || exit "${rc:-1}"`,
+		}, "\n")
+	}, nil
+}
+
+// inputWrapper returns a function that wraps a shell command so its input
+// is decompressed with codec first. Both exit statuses are checked, so a
+// truncated stream is not mistaken for a complete import; commands after
+// the wrapped one only run if both succeeded.
+func inputWrapper(codec string) func(run string) string {
+	return func(run string) string {
+		if codec == codecNone {
+			return run
+		}
+		return strings.Join([]string{
+			`st=$(mktemp) || exit 1`,
+			`trap 'rm -f ${f:+"$f"} "$st"' EXIT`,
+			fmt.Sprintf(`{ %s -d -c; echo $? > "$st"; } | %s || exit $?`, codec, run),
+			`rc=$(cat "$st"); [ "${rc:-1}" = 0 ] || exit "${rc:-1}"`,
+		}, "\n")
+	}
+}
+
+// detectCodecScript prints the first of the candidate codecs installed on
+// the host, or "none".
+func (c CompressionSettings) detectCodecScript() (string, error) {
+	candidates, err := c.candidates()
+	if err != nil {
+		return "", err
+	}
+	script := ""
+	for _, codec := range candidates {
+		script += fmt.Sprintf("command -v %s >/dev/null && echo %[1]s && exit 0\n", codec)
+	}
+	return script + "echo none", nil
+}
+
+// chooseCodec interprets the output of detectCodecScript.
+func (c CompressionSettings) chooseCodec(detected string) (string, error) {
+	codec := strings.TrimSpace(detected)
+	if codec == codecNone && (c.Codec == codecZstd || c.Codec == codecGzip) {
+		return "", fmt.Errorf("%s not found on the remote host", c.Codec)
+	}
+	return codec, nil
+}
+
+func farCompressCommand(codec string, level int) string {
+	if codec == codecZstd {
+		return fmt.Sprintf("zstd -q -c -%d", level)
+	}
+	return fmt.Sprintf("gzip -c -%d", level)
+}
+
+// decompressReader returns a reader of r's content, decompressed if it
+// starts with a zstd or gzip header. close releases the decoder.
+func decompressReader(r io.Reader) (out io.Reader, close func(), err error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	head, _ := br.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(head, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	case bytes.HasPrefix(head, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	}
+	return br, func() {}, nil
+}
+
+// compressWriter returns a WriteCloser that compresses into w with codec.
+// Closing it flushes the compressor but does not close w.
+func compressWriter(w io.Writer, codec string, level int) (io.WriteCloser, error) {
+	switch codec {
+	case codecZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	case codecGzip:
+		return gzip.NewWriterLevel(w, level)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressedReader returns a reader of r's content compressed with codec.
+// Closing it stops the compressor.
+func compressedReader(r io.Reader, codec string, level int) io.ReadCloser {
+	if codec == codecNone {
+		return io.NopCloser(r)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := compressWriter(pw, codec, level)
+		if err == nil {
+			if _, err = io.Copy(zw, r); err == nil {
+				err = zw.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// sqlFileCodec returns the codec implied by a dump file's extension.
+func sqlFileCodec(path string) string {
+	switch filepath.Ext(path) {
+	case ".zst":
+		return codecZstd
+	case ".gz":
+		return codecGzip
+	}
+	return codecNone
+}
+
+// sqlFile is a dump file being written, compressed according to its
+// extension.
+type sqlFile struct {
+	f *os.File
+	io.WriteCloser
+}
+
+// createSQLFile creates a .sql, .sql.gz or .sql.zst file.
+func createSQLFile(path string) (*sqlFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	codec := sqlFileCodec(path)
+	level, _ := CompressionSettings{}.level(codec)
+	zw, err := compressWriter(f, codec, level)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sqlFile{f: f, WriteCloser: zw}, nil
+}
+
+// Close flushes the compressor and closes the file.
+func (s *sqlFile) Close() error {
+	err := s.WriteCloser.Close()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readSQLFile streams a .sql, .sql.gz or .sql.zst file to w.
+func readSQLFile(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, closeReader, err := decompressReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	defer closeReader()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
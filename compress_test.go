@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSQLFileRoundTrip(t *testing.T) {
+	sql := strings.Repeat("INSERT INTO `t` VALUES ('x');\n", 1000)
+
+	for _, name := range []string{"db.sql", "db.sql.gz", "db.sql.zst"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			f, err := createSQLFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(f, sql); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var got bytes.Buffer
+			if err := readSQLFile(path, &got); err != nil {
+				t.Fatalf("readSQLFile() error: %v", err)
+			}
+			if got.String() != sql {
+				t.Errorf("round trip through %s changed the content", name)
+			}
+		})
+	}
+}
+
+func TestCompressionScripts(t *testing.T) {
+	for _, codec := range []string{codecZstd, codecGzip} {
+		t.Run(codec, func(t *testing.T) {
+			if _, err := exec.LookPath(codec); err != nil {
+				t.Skipf("%s not available", codec)
+			}
+			settings := CompressionSettings{Codec: codec}
+
+			wrap, err := settings.outputWrapper()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := exec.Command("sh", "-c", wrap(`sh -c 'echo hello; exit 3'`)).Output()
+			if code := exitCode(err); code != 3 {
+				t.Errorf("exit status = %d, want 3 (%v)", code, err)
+			}
+			r, closeReader, err := decompressReader(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeReader()
+			if got, _ := io.ReadAll(r); string(got) != "hello\n" {
+				t.Errorf("decompressed output = %q", got)
+			}
+
+			dir := t.TempDir()
+			cmd := exec.Command("sh", "-c", inputWrapper(codec)("cat > "+shellQuote(filepath.Join(dir, "in"))+"; cat "+shellQuote(filepath.Join(dir, "in"))))
+			cmd.Stdin = compressedReader(strings.NewReader("payload"), codec, 1)
+			got, err := cmd.Output()
+			if err != nil || string(got) != "payload" {
+				t.Errorf("decompressed input = %q, %v", got, err)
+			}
+
+			cmd = exec.Command("sh", "-c", inputWrapper(codec)("cat >/dev/null"))
+			cmd.Stdin = strings.NewReader("not compressed")
+			if err := cmd.Run(); err == nil {
+				t.Error("a corrupt stream was not reported as a failure")
+			}
+		})
+	}
+}
+
+func TestDecompressReaderPassesPlainSQL(t *testing.T) {
+	r, closeReader, err := decompressReader(strings.NewReader("-- MariaDB dump\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeReader()
+	if got, _ := io.ReadAll(r); string(got) != "-- MariaDB dump\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCompressionSettingsValidation(t *testing.T) {
+	if _, err := (CompressionSettings{Codec: "lz4"}).outputWrapper(); err == nil {
+		t.Error("unknown codec accepted")
+	}
+	if _, err := (CompressionSettings{Codec: codecGzip, Level: 12}).outputWrapper(); err == nil {
+		t.Error("out of range gzip level accepted")
+	}
+	if _, err := (CompressionSettings{Codec: codecZstd}).chooseCodec("none\n"); err == nil {
+		t.Error("missing explicit codec accepted")
+	}
+	if codec, err := (CompressionSettings{}).chooseCodec("none\n"); err != nil || codec != codecNone {
+		t.Errorf("auto without codecs = %q, %v", codec, err)
+	}
+}
+
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+func TestSSHDBDumpAndWriteCompressed(t *testing.T) {
+	if _, err := exec.LookPath("gzip"); err != nil {
+		t.Skip("gzip not available")
+	}
+
+	// ssh runs the remote command locally; the client tools echo what they get
+	bin := t.TempDir()
+	out := filepath.Join(bin, "written.sql")
+	for name, script := range map[string]string{
+		"ssh":          "#!/bin/sh\nfor a; do cmd=$a; done\neval \"$cmd\"\n",
+		"mariadb-dump": "#!/bin/sh\necho \"INSERT INTO t VALUES ('dump');\"\n",
+		"mariadb":      "#!/bin/sh\ncat > " + shellQuote(out) + "\n",
+	} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	db := newSSHDB(&Environment{SSHHost: "user@host", DB: HostSettings{DB: "shop"}}, dbSettings{compression: CompressionSettings{Codec: codecGzip}, exec: systemExecutor{}})
+
+	var dump bytes.Buffer
+	if err := db.Dump(context.Background(), &dump); err != nil {
+		t.Fatalf("Dump() error: %v", err)
+	}
+	if dump.String() != "INSERT INTO t VALUES ('dump');\n" {
+		t.Errorf("Dump() wrote %q", dump.String())
+	}
+
+	if err := db.Write(context.Background(), strings.NewReader("INSERT INTO t VALUES ('write');\n")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != "INSERT INTO t VALUES ('write');\n" {
+		t.Errorf("Write() delivered %q", got)
+	}
+}
@@ -2,28 +2,113 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 )
 
 type Config struct {
 	SSHHost   string       `json:"sshHost"`
-	Port      string       `json:"port"`
+	Port      string       `json:"port,omitempty"` // empty uses ssh_config's, or 22
 	Remote    HostSettings `json:"remote"`
 	Local     HostSettings `json:"local"`
 	DBReplace []DBReplace  `json:"dbReplace"`
 	Sync      []SyncPath   `json:"sync"`
+
+	// Environments replaces the single SSHHost/Remote/Local layout with any
+	// number of named environments; see ForPair.
+	Environments map[string]*Environment `json:"environments,omitempty"`
+
+	// Backups is the retention policy for the backups taken of remote
+	// databases before they are overwritten.
+	Backups BackupPolicy `json:"backups"`
+
+	// Snapshots configures the snapshots taken of the local database before
+	// it is overwritten.
+	Snapshots SnapshotSettings `json:"snapshots"`
+
+	// Compression selects how dumps are compressed over SSH.
+	Compression CompressionSettings `json:"compression"`
+
+	// Tables filters the tables a database sync copies; environments can
+	// add their own filters on top.
+	Tables TableFilter `json:"tables"`
+
+	// Anonymize rewrites personal data in dumps pulled into a local
+	// database.
+	Anonymize []AnonymizeRule `json:"anonymize,omitempty"`
+
+	// SSH selects the SSH client and the options every ssh and rsync
+	// command uses.
+	SSH SSHSettings `json:"ssh"`
+
+	// clients holds the connections of the built-in SSH client, shared by
+	// every command of a run; see Close.
+	clients *sshClients
+
+	// derivedReplace marks DBReplace as derived from environment values,
+	// which must be applied in a single pass; see NewSinglePassReplacer.
+	derivedReplace bool
+}
+
+// Environment is one place a site is deployed to, e.g. production, staging
+// or local. An environment without an SSH host lives on this machine.
+type Environment struct {
+	SSHHost string       `json:"sshHost,omitempty"`
+	Port    string       `json:"port,omitempty"`
+	DB      HostSettings `json:"db"`
+
+	// SSH overrides the top-level SSH options for this environment.
+	SSH SSHSettings `json:"ssh,omitempty"`
+
+	// Paths maps a name shared between environments to a directory on this
+	// environment, e.g. "uploads" -> "/var/www/wp-content/uploads".
+	Paths map[string]string `json:"paths,omitempty"`
+
+	// Replace maps a name shared between environments to this environment's
+	// value, e.g. "url" -> "https://example.com". Replacement rules are
+	// derived for every name both sides of a sync define.
+	Replace map[string]string `json:"replace,omitempty"`
+
+	// Tables filters the tables dumped when this environment is the source
+	// of a sync, on top of the top-level filter.
+	Tables TableFilter `json:"tables,omitempty"`
 }
 
 type HostSettings struct {
-	Host string `json:"host"`
-	DB   string `json:"db"`
+	// Driver selects the database engine: mysql (the default, also for
+	// MariaDB), postgres or sqlite, for which DB is the path of the file.
+	Driver string `json:"driver,omitempty"`
+
+	Host         string `json:"host"`
+	Port         string `json:"port,omitempty"`
+	Socket       string `json:"socket,omitempty"`
+	User         string `json:"user,omitempty"`
+	Password     string `json:"password,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+	PasswordEnv  string `json:"passwordEnv,omitempty"`
+	DB           string `json:"db"`
+
+	// AppUser and AppPassword describe the account the site itself connects
+	// with; it is created on the local side when missing.
+	AppUser     string `json:"appUser,omitempty"`
+	AppPassword string `json:"appPassword,omitempty"`
+
+	// Exec configures where the client tools of a local database run.
+	Exec *LocalExec `json:"exec,omitempty"`
 }
 
 type SyncPath struct {
 	Remote  string   `json:"remote"`
 	Local   string   `json:"local"`
 	Exclude []string `json:"exclude"`
+
+	// Path names an entry of Environment.Paths; it is used instead of
+	// Remote/Local when the config defines environments.
+	Path string `json:"path,omitempty"`
 }
 
 type DBReplace struct {
@@ -31,24 +116,191 @@ type DBReplace struct {
 	To   string `json:"to"`
 }
 
+// ResolvePassword returns the password from Password, PasswordFile or
+// PasswordEnv, in that order of precedence.
+func (h HostSettings) ResolvePassword() (string, error) {
+	switch {
+	case h.Password != "":
+		return h.Password, nil
+	case h.PasswordFile != "":
+		data, err := os.ReadFile(expandHome(h.PasswordFile))
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case h.PasswordEnv != "":
+		password, ok := os.LookupEnv(h.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("password environment variable %s is not set", h.PasswordEnv)
+		}
+		return password, nil
+	}
+	return "", nil
+}
+
+func (h HostSettings) hasPassword() bool {
+	return h.Password != "" || h.PasswordFile != "" || h.PasswordEnv != ""
+}
+
 func LoadConfig(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+	return loadConfigFiles([]string{path}, true)
+}
+
+// loadConfigFiles reads the config from paths, each laid over the ones
+// before it, and checks it. Unless resolve is false, which leaves the
+// values as written, relative paths are taken from the directory of their
+// file and ${VAR} and secret references are resolved.
+func loadConfigFiles(paths []string, resolve bool) (*Config, error) {
+	var raw any
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		// Every format is read through the values JSON would produce, so
+		// the json tags name the keys of all of them
+		file, err := decodeConfig(data, configFormat(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		if resolve {
+			rebaseConfigPaths(file, filepath.Dir(absPath(path)))
+		}
+		raw = mergeConfig(raw, file)
 	}
 
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
 	var cfg Config
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	var problems ConfigError
+	unknownKeys(raw, reflect.TypeOf(cfg), "", &problems)
+	if resolve {
+		if err := newConfigResolver().resolve(&cfg); err != nil {
+			// The checks below would only repeat these problems
+			problems.merge(err)
+			return nil, problems.err()
+		}
+	}
+
+	cfg.applyDefaults()
+
+	problems.merge(cfg.validate())
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
 
-func GenerateConfig(path string) error {
-	defaultConf := Config{
+// applyDefaults fills in the credentials dsync has always assumed: root
+// without a password on the remote host and root/secret in the local
+// container (postgres instead of root for PostgreSQL).
+func (c *Config) applyDefaults() {
+	c.Remote.applyDefaults(false)
+	c.Local.applyDefaults(true)
+	for _, env := range c.Environments {
+		if env != nil {
+			env.DB.applyDefaults(env.IsLocal())
+		}
+	}
+}
+
+func (h *HostSettings) applyDefaults(local bool) {
+	if h.User == "" {
+		h.User = "root"
+		if h.driverName() == driverPostgres {
+			h.User = "postgres"
+		}
+		if local && !h.hasPassword() {
+			h.Password = "secret"
+		}
+	}
+	if !local {
+		return
+	}
+	if h.AppUser == "" {
+		h.AppUser = h.DB
+	}
+	if h.AppPassword == "" {
+		h.AppPassword = "secret"
+	}
+}
+
+// validateDatabases checks every database names a known driver and that
+// only local ones configure an executor.
+func (c *Config) validateDatabases() error {
+	var e ConfigError
+	if err := c.Remote.validate(false); err != nil {
+		e.add("remote", "%v", err)
+	}
+	if err := c.Local.validate(true); err != nil {
+		e.add("local", "%v", err)
+	}
+	for _, name := range c.EnvironmentNames() {
+		if env := c.Environments[name]; env != nil {
+			if err := env.DB.validate(env.IsLocal()); err != nil {
+				e.add("environments."+name+".db", "%v", err)
+			}
+		}
+	}
+	return e.err()
+}
+
+func (h HostSettings) validate(local bool) error {
+	if err := h.validateDriver(); err != nil {
+		return err
+	}
+	if !local {
+		if h.Exec != nil {
+			return errors.New("exec only applies to local databases")
+		}
+		return nil
+	}
+	if err := h.validateExec(); err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+	return nil
+}
+
+// sshClients returns the built-in SSH client of the run, or nil when the
+// ssh binary is used.
+func (c *Config) sshClients() *sshClients {
+	if c.SSH.Client == sshClientSystem {
+		return nil
+	}
+	if c.clients == nil {
+		c.clients = newSSHClients()
+	}
+	return c.clients
+}
+
+// Close closes the SSH connections opened for the config.
+func (c *Config) Close() error {
+	if c.clients == nil {
+		return nil
+	}
+	return c.clients.Close()
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// defaultConfig is the config GenerateConfig writes.
+func defaultConfig() Config {
+	return Config{
 		SSHHost: "user@host.com",
-		Port:    "22",
 		Remote: HostSettings{
 			DB: "db",
 		},
@@ -71,10 +323,25 @@ func GenerateConfig(path string) error {
 			{From: "/home/host/public_html", To: "/home/user/www/project"},
 		},
 	}
+}
 
-	data, err := json.MarshalIndent(defaultConf, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal default config: %w", err)
+// GenerateConfig writes the default config to path, in the format of its
+// extension. Every format but plain JSON explains the settings in comments.
+func GenerateConfig(path string) error {
+	var data []byte
+	switch configFormat(path) {
+	case formatJSONC:
+		data = []byte(jsoncTemplate)
+	case formatYAML:
+		data = []byte(yamlTemplate)
+	case formatTOML:
+		data = []byte(tomlTemplate)
+	default:
+		var err error
+		data, err = json.MarshalIndent(defaultConfig(), "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal default config: %w", err)
+		}
 	}
 
 	if err := os.WriteFile(path, data, 0644); err != nil {
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultConfigName is the config file used when none is given or found.
+const defaultConfigName = "dsync-config.json"
+
+// configNames are the project config files looked for when none is given,
+// in order of preference.
+var configNames = []string{
+	defaultConfigName,
+	"dsync-config.jsonc",
+	"dsync-config.yaml",
+	"dsync-config.yml",
+	"dsync-config.toml",
+}
+
+// globalConfigNames are the names the global config may have in its
+// directory; see globalConfig.
+var globalConfigNames = []string{"config", "config.json", "config.jsonc", "config.yaml", "config.yml", "config.toml"}
+
+// findConfig looks for one of configNames in dir and then in each of its
+// parents, like git looks for .git, and returns the first found. Without
+// one it returns defaultConfigName in dir.
+func findConfig(dir string) string {
+	abs, err := filepath.Abs(dir)
+	for d := dir; ; d = abs {
+		if path := firstExisting(d, configNames); path != "" {
+			return path
+		}
+		if err != nil || filepath.Dir(abs) == abs {
+			break
+		}
+		abs = filepath.Dir(abs)
+	}
+	return filepath.Join(dir, defaultConfigName)
+}
+
+// globalConfig returns the user's config of shared defaults,
+// $XDG_CONFIG_HOME/dsync/config (~/.config/dsync/config) with any of the
+// config extensions, or "" if there is none.
+func globalConfig() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return firstExisting(filepath.Join(dir, "dsync"), globalConfigNames)
+}
+
+func firstExisting(dir string, names []string) string {
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// configFiles returns the files the config at path is read from, lowest
+// precedence first: the global config, if there is one, and path.
+func configFiles(path string) []string {
+	global := globalConfig()
+	if global == "" {
+		return []string{path}
+	}
+	if a, b := absPath(global), absPath(path); a == b {
+		return []string{path}
+	}
+	return []string{global, path}
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// mergeConfig lays over, a decoded config file, on top of base: objects are
+// merged key by key, anything else in over replaces base's.
+func mergeConfig(base, over any) any {
+	b, ok := base.(map[string]any)
+	o, ok2 := over.(map[string]any)
+	if !ok || !ok2 {
+		return over
+	}
+	for key, value := range o {
+		b[key] = mergeConfig(b[key], value)
+	}
+	return b
+}
+
+// rebaseConfigPaths makes the relative paths on this machine in raw, a
+// decoded config file in dir, relative to dir rather than to where dsync
+// runs, so a config found in a parent directory means the same as it does
+// next to it. Paths starting with ~ or a $ reference are left alone.
+func rebaseConfigPaths(raw any, dir string) {
+	root, ok := raw.(map[string]any)
+	if !ok {
+		return
+	}
+	rebase := func(m map[string]any, key string) {
+		p, ok := m[key].(string)
+		if !ok || p == "" || filepath.IsAbs(p) || strings.HasPrefix(p, "~") || strings.HasPrefix(p, "$") {
+			return
+		}
+		m[key] = filepath.Join(dir, p)
+	}
+	database := func(m map[string]any, local bool) {
+		rebase(m, "passwordFile")
+		if !local {
+			return
+		}
+		if m["driver"] == driverSQLite {
+			rebase(m, "db")
+		}
+		rebase(object(m, "exec"), "file")
+	}
+
+	database(object(root, "remote"), false)
+	database(object(root, "local"), true)
+	if sync, ok := root["sync"].([]any); ok {
+		for _, entry := range sync {
+			if m, ok := entry.(map[string]any); ok {
+				rebase(m, "local")
+			}
+		}
+	}
+	rebase(object(root, "snapshots"), "dir")
+	rebase(object(root, "ssh"), "identityFile")
+
+	for _, value := range object(root, "environments") {
+		env, ok := value.(map[string]any)
+		if !ok {
+			continue
+		}
+		local := env["sshHost"] == nil || env["sshHost"] == ""
+		database(object(env, "db"), local)
+		rebase(object(env, "ssh"), "identityFile")
+		if local {
+			paths := object(env, "paths")
+			for name := range paths {
+				rebase(paths, name)
+			}
+		}
+	}
+}
+
+// object returns the object under key in m, or an empty one.
+func object(m map[string]any, key string) map[string]any {
+	if o, ok := m[key].(map[string]any); ok {
+		return o
+	}
+	return map[string]any{}
+}
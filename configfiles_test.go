@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindConfig(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "project", "wp-content", "themes")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := findConfig(sub); got != filepath.Join(sub, "dsync-config.json") {
+		t.Errorf("findConfig() without a config = %s", got)
+	}
+
+	// The nearest directory wins, and within it the order of configNames
+	writeConfigFile(t, filepath.Join(root, "dsync-config.json"), "{}")
+	writeConfigFile(t, filepath.Join(root, "project", "dsync-config.toml"), "")
+	writeConfigFile(t, filepath.Join(root, "project", "dsync-config.yaml"), "")
+	if got := findConfig(sub); got != filepath.Join(root, "project", "dsync-config.yaml") {
+		t.Errorf("findConfig() = %s, want the project's YAML config", got)
+	}
+}
+
+func TestConfigFiles(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	project := filepath.Join(t.TempDir(), "dsync-config.json")
+
+	if got := configFiles(project); !reflect.DeepEqual(got, []string{project}) {
+		t.Errorf("configFiles() without a global config = %v", got)
+	}
+	global := filepath.Join(xdg, "dsync", "config")
+	writeConfigFile(t, global, "{}")
+	if got := configFiles(project); !reflect.DeepEqual(got, []string{global, project}) {
+		t.Errorf("configFiles() = %v, want the global config first", got)
+	}
+	// Pointing -c at the global config reads it once
+	if got := configFiles(global); !reflect.DeepEqual(got, []string{global}) {
+		t.Errorf("configFiles(global) = %v", got)
+	}
+}
+
+func TestLoadConfigFilesMerge(t *testing.T) {
+	globalDir, projectDir := t.TempDir(), t.TempDir()
+	global := filepath.Join(globalDir, "config.yaml")
+	writeConfigFile(t, global, `ssh:
+  identityFile: keys/deploy
+  options: [ServerAliveInterval=30]
+snapshots:
+  dir: snapshots
+  keepLast: 5
+local:
+  exec:
+    file: ~/www/dev/docker-compose.yml
+`)
+	project := filepath.Join(projectDir, "dsync-config.json")
+	writeConfigFile(t, project, `{
+		"sshHost": "user@example.com",
+		"remote": {"db": "prod", "passwordFile": "/etc/dsync/prod"},
+		"local": {"db": "dev"},
+		"sync": [{"remote": "/var/www/uploads", "local": "wp-content/uploads"}],
+		"snapshots": {"keepLast": 2}
+	}`)
+
+	cfg, err := loadConfigFiles([]string{global, project}, true)
+	if err != nil {
+		t.Fatalf("loadConfigFiles() error: %v", err)
+	}
+	for _, check := range []struct{ name, got, want string }{
+		// Relative paths are taken from the file that sets them
+		{"ssh.identityFile", cfg.SSH.IdentityFile, filepath.Join(globalDir, "keys/deploy")},
+		{"snapshots.dir", cfg.Snapshots.Dir, filepath.Join(globalDir, "snapshots")},
+		{"sync[0].local", cfg.Sync[0].Local, filepath.Join(projectDir, "wp-content/uploads")},
+		// Others are kept as they are
+		{"sync[0].remote", cfg.Sync[0].Remote, "/var/www/uploads"},
+		{"local.exec.file", cfg.Local.Exec.File, "~/www/dev/docker-compose.yml"},
+		{"remote.passwordFile", cfg.Remote.PasswordFile, "/etc/dsync/prod"},
+	} {
+		if check.got != check.want {
+			t.Errorf("%s = %q, want %q", check.name, check.got, check.want)
+		}
+	}
+	// Objects merge key by key, with the project on top
+	if cfg.Snapshots.KeepLast != 2 || len(cfg.SSH.Options) != 1 || cfg.Local.DB != "dev" {
+		t.Errorf("merged config = %+v, %+v, %+v", cfg.Snapshots, cfg.SSH, cfg.Local)
+	}
+}
+
+func writeConfigFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats, chosen by the extension of the file.
+const (
+	formatJSON  = "json"
+	formatJSONC = "jsonc" // JSON with comments and trailing commas
+	formatYAML  = "yaml"
+	formatTOML  = "toml"
+)
+
+// configFormat returns the format of the config file at path; anything not
+// YAML, TOML or JSONC is read as JSON.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	case ".jsonc":
+		return formatJSONC
+	}
+	return formatJSON
+}
+
+// configFileName returns the default file name for a config in format.
+func configFileName(format string) (string, error) {
+	switch format {
+	case formatJSON, formatJSONC, formatYAML, formatTOML:
+		return "dsync-config." + format, nil
+	}
+	return "", fmt.Errorf("unknown format '%s' (use json, jsonc, yaml or toml)", format)
+}
+
+// decodeConfig parses data, a config file in format, into the values
+// encoding/json would produce for it.
+func decodeConfig(data []byte, format string) (any, error) {
+	var raw any
+	switch format {
+	case formatYAML:
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+	case formatTOML:
+		var table map[string]any
+		if err := toml.Unmarshal(data, &table); err != nil {
+			return nil, err
+		}
+		raw = table
+	default:
+		// Comments are accepted in .json files as well
+		if err := json.Unmarshal(stripJSONComments(data), &raw); err != nil {
+			return nil, err
+		}
+	}
+	return normalizeConfig(raw, reflect.TypeOf(Config{})), nil
+}
+
+// normalizeConfig converts what the YAML and TOML decoders produce to the
+// types encoding/json uses, and numbers and booleans given for string
+// fields, like a YAML port: 22, to strings. t is the type raw decodes into.
+func normalizeConfig(raw any, t reflect.Type) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch v := raw.(type) {
+	case map[string]any:
+		var fields map[string]reflect.Type
+		if t.Kind() == reflect.Struct {
+			fields = jsonFields(t)
+		}
+		for key, value := range v {
+			switch {
+			case fields != nil:
+				if field, ok := fields[key]; ok {
+					v[key] = normalizeConfig(value, field)
+				}
+			case t.Kind() == reflect.Map:
+				v[key] = normalizeConfig(value, t.Elem())
+			}
+		}
+		return v
+	case []map[string]any:
+		// TOML arrays of tables
+		list := make([]any, len(v))
+		for i, m := range v {
+			list[i] = m
+		}
+		return normalizeConfig(list, t)
+	case []any:
+		if t.Kind() == reflect.Slice {
+			for i := range v {
+				v[i] = normalizeConfig(v[i], t.Elem())
+			}
+		}
+		return v
+	case int, int64, uint64, float64, bool:
+		if t.Kind() == reflect.String {
+			return fmt.Sprint(v)
+		}
+	}
+	return raw
+}
+
+// stripJSONComments turns JSONC into JSON: // and /* */ comments and
+// commas before a closing bracket are removed, outside of strings.
+func stripJSONComments(data []byte) []byte {
+	var out bytes.Buffer
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			out.WriteByte(c)
+			switch c {
+			case '\\':
+				if i+1 < len(data) {
+					i++
+					out.WriteByte(data[i])
+				}
+			case '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+			out.WriteByte(c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			// Keep the newline, so line numbers stay the same
+			i--
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				// Unterminated: left to the JSON parser to report
+				out.Write(data[i:])
+				return out.Bytes()
+			}
+			out.Write(bytes.Repeat([]byte("\n"), bytes.Count(data[i:i+2+end], []byte("\n"))))
+			i += end + 3
+		case c == ',' && closesNext(data[i+1:]):
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.Bytes()
+}
+
+// closesNext reports whether the next token of data, skipping whitespace
+// and comments, closes an object or array.
+func closesNext(data []byte) bool {
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return false
+			}
+			i += end + 3
+		default:
+			return c == '}' || c == ']'
+		}
+	}
+	return false
+}
+
+// The default config with comments, in the formats that allow them. They
+// must describe the same config as defaultConfig.
+const (
+	jsoncTemplate = `{
+  // SSH destination of the remote site: [user@]host or a ~/.ssh/config alias
+  "sshHost": "user@host.com",
+
+  // Database on the remote host, and the one of the local docker stack
+  "remote": { "db": "db" },
+  "local": { "db": "db" },
+
+  // Directories to sync. exclude takes rsync patterns, relative to the
+  // directory; say why each one is there.
+  "sync": [
+    {
+      "remote": "/home/user/public_html/wp-content/plugins",
+      "local": "/home/user/www/host.test/wp-content/plugins",
+      "exclude": ["some-plugins"]
+    },
+    {
+      "remote": "/home/username/public_html/wp-content/uploads",
+      "local": "/home/usernmae/www/host.test/wp-content/uploads"
+    }
+  ],
+
+  // Replacements applied to the database dump, in order, when pulling;
+  // pushing applies them the other way round.
+  "dbReplace": [
+    // The site URL
+    { "from": "host.com", "to": "host.test" },
+    // Absolute paths stored by plugins
+    { "from": "/home/host/public_html", "to": "/home/user/www/project" }
+  ]
+}
+`
+
+	yamlTemplate = `# SSH destination of the remote site: [user@]host or a ~/.ssh/config alias
+sshHost: user@host.com
+
+# Database on the remote host, and the one of the local docker stack
+remote:
+  db: db
+local:
+  db: db
+
+# Directories to sync. exclude takes rsync patterns, relative to the
+# directory; say why each one is there.
+sync:
+  - remote: /home/user/public_html/wp-content/plugins
+    local: /home/user/www/host.test/wp-content/plugins
+    exclude:
+      - some-plugins
+  - remote: /home/username/public_html/wp-content/uploads
+    local: /home/usernmae/www/host.test/wp-content/uploads
+
+# Replacements applied to the database dump, in order, when pulling;
+# pushing applies them the other way round.
+dbReplace:
+  # The site URL
+  - from: host.com
+    to: host.test
+  # Absolute paths stored by plugins
+  - from: /home/host/public_html
+    to: /home/user/www/project
+`
+
+	tomlTemplate = `# SSH destination of the remote site: [user@]host or a ~/.ssh/config alias
+sshHost = "user@host.com"
+
+# Database on the remote host, and the one of the local docker stack
+[remote]
+db = "db"
+
+[local]
+db = "db"
+
+# Directories to sync. exclude takes rsync patterns, relative to the
+# directory; say why each one is there.
+[[sync]]
+remote = "/home/user/public_html/wp-content/plugins"
+local = "/home/user/www/host.test/wp-content/plugins"
+exclude = ["some-plugins"]
+
+[[sync]]
+remote = "/home/username/public_html/wp-content/uploads"
+local = "/home/usernmae/www/host.test/wp-content/uploads"
+
+# Replacements applied to the database dump, in order, when pulling;
+# pushing applies them the other way round.
+
+# The site URL
+[[dbReplace]]
+from = "host.com"
+to = "host.test"
+
+# Absolute paths stored by plugins
+[[dbReplace]]
+from = "/home/host/public_html"
+to = "/home/user/www/project"
+`
+)
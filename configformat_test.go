@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGenerateConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	want, err := func() (*Config, error) {
+		path := filepath.Join(dir, "dsync-config.json")
+		if err := GenerateConfig(path); err != nil {
+			return nil, err
+		}
+		return LoadConfig(path)
+	}()
+	if err != nil {
+		t.Fatalf("JSON config: %v", err)
+	}
+
+	// The commented templates must describe the same config
+	for _, name := range []string{"dsync-config.jsonc", "dsync-config.yaml", "dsync-config.yml", "dsync-config.toml"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := GenerateConfig(path); err != nil {
+				t.Fatalf("GenerateConfig() error: %v", err)
+			}
+			got, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s loads as\n%+v\nwant\n%+v", name, got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	want := HostSettings{Host: "db.internal", Port: "3306", DB: "prod", User: "root"}
+	tests := []struct {
+		name, data string
+	}{
+		{
+			name: "dsync-config.jsonc",
+			data: `{
+				// The remote site
+				"sshHost": "user@example.com", /* inline */
+				"remote": {"host": "db.internal", "port": "3306", "db": "prod",},
+				"local": {"db": "dev"},
+				"dbReplace": [{"from": "https://example.com", "to": "http://example.test"},],
+			}`,
+		},
+		{
+			name: "dsync-config.yaml",
+			data: `# The remote site
+sshHost: user@example.com
+remote:
+  host: db.internal
+  port: 3306 # a number, read as a string
+  db: prod
+local:
+  db: dev
+dbReplace:
+  - from: https://example.com
+    to: http://example.test
+`,
+		},
+		{
+			name: "dsync-config.toml",
+			data: `# The remote site
+sshHost = "user@example.com"
+
+[remote]
+host = "db.internal"
+port = 3306
+db = "prod"
+
+[local]
+db = "dev"
+
+[[dbReplace]]
+from = "https://example.com"
+to = "http://example.test"
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.name)
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig() error: %v", err)
+			}
+			if cfg.SSHHost != "user@example.com" || !reflect.DeepEqual(cfg.Remote, want) {
+				t.Errorf("LoadConfig() = %q, %+v", cfg.SSHHost, cfg.Remote)
+			}
+			if len(cfg.DBReplace) != 1 || cfg.DBReplace[0].To != "http://example.test" {
+				t.Errorf("dbReplace = %+v", cfg.DBReplace)
+			}
+		})
+	}
+}
+
+func TestStripJSONComments(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{name: "plain", in: `{"a": [1, 2]}`, want: `{"a": [1, 2]}`},
+		{name: "line comment", in: "{\"a\": 1 // one\n}", want: "{\"a\": 1 \n}"},
+		{name: "block comment", in: "{/* a\nb */\"a\": 1}", want: "{\n\"a\": 1}"},
+		{name: "trailing commas", in: `{"a": [1, 2, ], "b": 3 , }`, want: `{"a": [1, 2 ], "b": 3  }`},
+		{name: "comma before a comment", in: "[1, // last\n]", want: "[1 \n]"},
+		{name: "in strings", in: `{"url": "https://example.com/*", "s": "a,]\"//"}`, want: `{"url": "https://example.com/*", "s": "a,]\"//"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(stripJSONComments([]byte(tt.in)))
+			if got != tt.want {
+				t.Errorf("stripJSONComments() = %q, want %q", got, tt.want)
+			}
+			if !json.Valid([]byte(got)) {
+				t.Errorf("stripJSONComments() = %q is not JSON", got)
+			}
+		})
+	}
+}
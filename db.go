@@ -3,293 +3,851 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pterm/pterm"
 )
 
 type DBProvider interface {
-	DumpRemote(ctx context.Context) (string, error)
-	DumpLocal(ctx context.Context) (string, error)
-	WriteRemote(ctx context.Context, sql string) error
-	WriteLocal(ctx context.Context, sql string) error
+	DumpRemote(ctx context.Context, w io.Writer) error
+	DumpLocal(ctx context.Context, w io.Writer) error
+	WriteRemote(ctx context.Context, r io.Reader) error
+	WriteLocal(ctx context.Context, r io.Reader) error
 	BackupRemote(ctx context.Context) error
+	BackupLocal(ctx context.Context) error
 }
 
 type RealDBProvider struct {
-	cfg *Config
+	cfg  *Config
+	exec Executor
 }
 
 func NewRealDBProvider(cfg *Config) *RealDBProvider {
-	return &RealDBProvider{cfg: cfg}
+	return &RealDBProvider{cfg: cfg, exec: systemExecutor{}}
 }
 
-func SyncDB(ctx context.Context, provider DBProvider, cfg *Config, dumpDB bool, reverse bool) error {
-	if reverse {
-		return syncDBReverse(ctx, provider, cfg, dumpDB)
+func SyncDB(ctx context.Context, provider DBProvider, cfg *Config, opts SyncOptions) error {
+	if err := checkSameDriver(cfg.Remote, cfg.Local); err != nil {
+		return err
+	}
+	if opts.Reverse {
+		return syncDBReverse(ctx, provider, cfg, opts)
 	}
 
 	pterm.DefaultSection.Println("Syncing Database (remote to local)")
 
-	// 1. Dump remote DB
-	spinner, _ := pterm.DefaultSpinner.Start(fmt.Sprintf("Dumping remote database '%s'...", cfg.Remote.DB))
-	sqlDump, err := provider.DumpRemote(ctx)
+	anonymizer, err := cfg.anonymizer()
 	if err != nil {
-		spinner.Fail(fmt.Sprintf("Failed to dump remote db: %v", err))
-		return fmt.Errorf("failed to dump remote db: %w", err)
+		return err
 	}
-	spinner.Success(fmt.Sprintf("Dumped remote database '%s'", cfg.Remote.DB))
 
-	// 2. Apply replacements
-	spinner, _ = pterm.DefaultSpinner.Start("Applying replacements...")
-	sqlDump = ApplyDBReplacements(sqlDump, cfg.DBReplace)
-	spinner.Success("Applied replacements")
+	return transferDB(ctx, dbTransfer{
+		source:     "remote",
+		target:     "local",
+		driver:     cfg.Remote.driverName(),
+		sourceDB:   cfg.Remote.DB,
+		targetDB:   cfg.Local.DB,
+		dump:       provider.DumpRemote,
+		write:      provider.WriteLocal,
+		backup:     provider.BackupLocal,
+		replacer:   cfg.replacer(cfg.DBReplace),
+		anonymizer: anonymizer,
+		dumpPath:   "db.sql",
+	}, opts)
+}
+
+func syncDBReverse(ctx context.Context, provider DBProvider, cfg *Config, opts SyncOptions) error {
+	pterm.DefaultSection.Println("Syncing Database (local to remote)")
+
+	// Replacements are applied in reverse
+	reversedReplacements := reverseReplacements(cfg.DBReplace)
+
+	return transferDB(ctx, dbTransfer{
+		source:   "local",
+		target:   "remote",
+		driver:   cfg.Local.driverName(),
+		sourceDB: cfg.Local.DB,
+		targetDB: cfg.Remote.DB,
+		dump:     provider.DumpLocal,
+		write:    provider.WriteRemote,
+		backup:   provider.BackupRemote,
+		replacer: cfg.replacer(reversedReplacements),
+		dumpPath: "db_reverse.sql",
+	}, opts)
+}
+
+// SyncDBBetween copies a database from one SSH environment to another. The
+// dump is streamed through this machine so replacements can be applied, but
+// is never stored on it.
+func SyncDBBetween(ctx context.Context, src, dst DBEndpoint, pair *RemotePair, opts SyncOptions) error {
+	pterm.DefaultSection.Printf("Syncing Database (%s to %s)\n", pair.FromName, pair.ToName)
 
-	// 3. Write to local DB
-	spinner, _ = pterm.DefaultSpinner.Start(fmt.Sprintf("Writing to local database '%s'...", cfg.Local.DB))
-	if err := provider.WriteLocal(ctx, sqlDump); err != nil {
-		spinner.Fail(fmt.Sprintf("Failed to write to local db: %v", err))
-		return fmt.Errorf("failed to write to local db: %w", err)
+	if err := checkSameDriver(pair.From.DB, pair.To.DB); err != nil {
+		return err
 	}
-	spinner.Success(fmt.Sprintf("Wrote to local database '%s'", cfg.Local.DB))
 
-	if dumpDB {
-		spinner, _ = pterm.DefaultSpinner.Start("Saving db.sql...")
-		if err := os.WriteFile("db.sql", []byte(sqlDump), 0644); err != nil {
-			spinner.Fail(fmt.Sprintf("Failed to save db.sql: %v", err))
-			return fmt.Errorf("failed to save db.sql: %w", err)
+	return transferDB(ctx, dbTransfer{
+		source:   pair.FromName,
+		target:   pair.ToName,
+		driver:   pair.From.DB.driverName(),
+		sourceDB: pair.From.DB.DB,
+		targetDB: pair.To.DB.DB,
+		dump:     src.Dump,
+		write:    dst.Write,
+		backup:   dst.Backup,
+		replacer: NewSinglePassReplacer(pair.DBReplace),
+		dumpPath: "db.sql",
+	}, opts)
+}
+
+// dbTransfer describes copying one database into another.
+type dbTransfer struct {
+	source, target     string // labels used in messages, e.g. "remote"
+	driver             string // of both databases
+	sourceDB, targetDB string
+
+	dump   func(ctx context.Context, w io.Writer) error
+	write  func(ctx context.Context, r io.Reader) error
+	backup func(ctx context.Context) error // nil if the target is not backed up
+
+	replacer   *Replacer
+	anonymizer *Anonymizer // nil unless the target is local
+	dumpPath   string      // where --dump saves the replaced SQL, unless opts.DumpPath is set
+}
+
+// transferDB backs up the target, then streams the source dump through the
+// replacer into it. A dry run only dumps and replaces, then reports what the
+// replacements would change.
+//
+// With FailOnUnmatched the rewritten dump is staged in a temporary file
+// instead, and the target is only backed up and written once every rule is
+// known to have matched.
+func transferDB(ctx context.Context, t dbTransfer, opts SyncOptions) error {
+	if t.anonymizer != nil && t.driver == driverSQLite {
+		return errors.New("anonymization is not supported for SQLite databases")
+	}
+	t.replacer.useDialect(t.driver)
+	if t.anonymizer != nil {
+		t.anonymizer.useDialect(t.driver)
+	}
+
+	staged := !opts.DryRun && opts.FailOnUnmatched && len(t.replacer.rules) > 0
+	if !opts.DryRun && !staged {
+		// Backup the target DB before anything is streamed into it
+		if err := t.backupTarget(ctx); err != nil {
+			return err
 		}
-		spinner.Success("Saved db.sql")
 	}
 
-	return nil
-}
+	savePath := ""
+	if opts.DumpDB {
+		savePath = t.dumpPath
+		if opts.DumpPath != "" {
+			savePath = opts.DumpPath
+		}
+	}
 
-func syncDBReverse(ctx context.Context, provider DBProvider, cfg *Config, dumpDB bool) error {
-	pterm.DefaultSection.Println("Syncing Database (local to remote)")
+	write := t.write
+	start := fmt.Sprintf("Streaming %s database '%s' into %s database '%s'...", t.source, t.sourceDB, t.target, t.targetDB)
+	done := fmt.Sprintf("Synced %s database '%s' into %s database '%s'", t.source, t.sourceDB, t.target, t.targetDB)
+	if opts.DryRun {
+		write = discardSQL
+		start = fmt.Sprintf("Dumping %s database '%s' and applying replacements (dry run)...", t.source, t.sourceDB)
+		done = fmt.Sprintf("Dumped %s database '%s' (dry run, %s database '%s' left untouched)", t.source, t.sourceDB, t.target, t.targetDB)
+	}
+	var stage *os.File
+	if staged {
+		f, err := os.CreateTemp("", "dsync-*.sql")
+		if err != nil {
+			return fmt.Errorf("failed to create a staging file: %w", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		stage = f
+		write = func(ctx context.Context, r io.Reader) error {
+			_, err := io.Copy(f, r)
+			return err
+		}
+		start = fmt.Sprintf("Dumping %s database '%s' and applying replacements...", t.source, t.sourceDB)
+		done = fmt.Sprintf("Dumped %s database '%s'", t.source, t.sourceDB)
+	}
 
-	// 1. Dump local DB
-	spinner, _ := pterm.DefaultSpinner.Start(fmt.Sprintf("Dumping local database '%s'...", cfg.Local.DB))
-	sqlDump, err := provider.DumpLocal(ctx)
+	// Dump, apply replacements and write in one stream
+	spinner, _ := pterm.DefaultSpinner.Start(start)
+	err := streamDB(ctx, dbPipeline{
+		dump:       t.dump,
+		dumpErr:    fmt.Sprintf("failed to dump %s db", t.source),
+		replacer:   t.replacer,
+		anonymizer: t.anonymizer,
+		write:      write,
+		writeErr:   fmt.Sprintf("failed to write to %s db", t.target),
+		savePath:   savePath,
+		saveError:  fmt.Sprintf("failed to save %s", savePath),
+	})
 	if err != nil {
-		spinner.Fail(fmt.Sprintf("Failed to dump local db: %v", err))
-		return fmt.Errorf("failed to dump local db: %w", err)
-	}
-	spinner.Success(fmt.Sprintf("Dumped local database '%s'", cfg.Local.DB))
-
-	// 2. Apply replacements (Reversed)
-	spinner, _ = pterm.DefaultSpinner.Start("Applying replacements (Reverse)...")
-	var reversedReplacements []DBReplace
-	// Iterate backwards to ensure correct order of operations (e.g. protocol replacement before domain replacement)
-	for i := len(cfg.DBReplace) - 1; i >= 0; i-- {
-		r := cfg.DBReplace[i]
-		reversedReplacements = append(reversedReplacements, DBReplace{From: r.To, To: r.From})
-	}
-	sqlDump = ApplyDBReplacements(sqlDump, reversedReplacements)
-	spinner.Success("Applied replacements (Reverse)")
-
-	if dumpDB {
-		spinner, _ = pterm.DefaultSpinner.Start("Saving db_reverse.sql...")
-		if err := os.WriteFile("db_reverse.sql", []byte(sqlDump), 0644); err != nil {
-			spinner.Fail(fmt.Sprintf("Failed to save db_reverse.sql: %v", err))
-			return fmt.Errorf("failed to save db_reverse.sql: %w", err)
+		spinner.Fail(err.Error())
+		return err
+	}
+	spinner.Success(done)
+
+	if opts.DumpDB {
+		pterm.Success.Printf("Saved %s\n", savePath)
+	}
+
+	if t.anonymizer != nil {
+		reportAnonymization(t.anonymizer.Stats())
+	}
+	if err := reportReplacements(t.replacer.Stats(), opts); err != nil {
+		if staged {
+			return fmt.Errorf("%w; %s database '%s' was left untouched", err, t.target, t.targetDB)
 		}
-		spinner.Success("Saved db_reverse.sql")
+		return err
+	}
+	if stage == nil {
+		return nil
 	}
+	return t.writeStaged(ctx, stage)
+}
 
-	// 3. Backup Remote DB
-	spinner, _ = pterm.DefaultSpinner.Start("Backing up remote database...")
-	if err := provider.BackupRemote(ctx); err != nil {
-		spinner.Fail(fmt.Sprintf("Failed to backup remote db: %v", err))
-		return fmt.Errorf("failed to backup remote db: %w", err)
+// backupTarget backs up the target database, if it is backed up at all.
+func (t dbTransfer) backupTarget(ctx context.Context) error {
+	if t.backup == nil {
+		return nil
+	}
+	spinner, _ := pterm.DefaultSpinner.Start(fmt.Sprintf("Backing up %s database...", t.target))
+	if err := t.backup(ctx); err != nil {
+		spinner.Fail(fmt.Sprintf("Failed to backup %s db: %v", t.target, err))
+		return fmt.Errorf("failed to backup %s db: %w", t.target, err)
 	}
-	spinner.Success("Backed up remote database")
+	spinner.Success(fmt.Sprintf("Backed up %s database", t.target))
+	return nil
+}
 
-	// 4. Write to remote DB
-	spinner, _ = pterm.DefaultSpinner.Start(fmt.Sprintf("Writing to remote database '%s'...", cfg.Remote.DB))
-	if err := provider.WriteRemote(ctx, sqlDump); err != nil {
-		spinner.Fail(fmt.Sprintf("Failed to write to remote db: %v", err))
-		return fmt.Errorf("failed to write to remote db: %w", err)
+// writeStaged backs up the target, then writes the staged dump into it.
+func (t dbTransfer) writeStaged(ctx context.Context, stage *os.File) error {
+	if err := t.backupTarget(ctx); err != nil {
+		return err
+	}
+	if _, err := stage.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read the staging file: %w", err)
 	}
-	spinner.Success(fmt.Sprintf("Wrote to remote database '%s'", cfg.Remote.DB))
 
+	spinner, _ := pterm.DefaultSpinner.Start(fmt.Sprintf("Writing %s database '%s'...", t.target, t.targetDB))
+	if err := t.write(ctx, stage); err != nil {
+		err = fmt.Errorf("failed to write to %s db: %w", t.target, err)
+		spinner.Fail(err.Error())
+		return err
+	}
+	spinner.Success(fmt.Sprintf("Synced %s database '%s' into %s database '%s'", t.source, t.sourceDB, t.target, t.targetDB))
+	return nil
+}
+
+// reportReplacements prints how often each rule matched and warns about
+// rules that matched nothing, which usually means a typo in From. With
+// FailOnUnmatched those rules are an error instead.
+func reportReplacements(stats ReplaceStats, opts SyncOptions) error {
+	if len(stats.Rules) == 0 {
+		if opts.DryRun {
+			pterm.Info.Println("No replacement rules configured")
+		}
+		return nil
+	}
+
+	pterm.Success.Printf("Applied replacements (%d matches)\n", stats.Total())
+	printReplaceStats(stats)
+
+	unmatched := stats.Unmatched()
+	if len(unmatched) == 0 {
+		return nil
+	}
+
+	var froms []string
+	for _, rule := range unmatched {
+		froms = append(froms, fmt.Sprintf("'%s'", rule.From))
+	}
+	msg := fmt.Sprintf("%d replacement rule(s) matched nothing: %s", len(unmatched), strings.Join(froms, ", "))
+	if opts.FailOnUnmatched {
+		return errors.New(msg)
+	}
+	pterm.Warning.Println(msg)
 	return nil
 }
 
-func (p *RealDBProvider) DumpRemote(ctx context.Context) (string, error) {
-	args := []string{
-		p.cfg.SSHHost,
-		"-p", p.cfg.Port,
-		"mysqldump", "-uroot", p.cfg.Remote.DB,
+// reportAnonymization prints what each anonymization rule changed and warns
+// about rules whose table was not in the dump.
+func reportAnonymization(stats AnonymizeStats) {
+	data := pterm.TableData{{"Table", "Column", "Strategy", "Values"}}
+	for _, r := range stats.Rules {
+		var tables []string
+		for _, name := range r.TableNames() {
+			tables = append(tables, fmt.Sprintf("%s (%d)", name, r.Tables[name]))
+		}
+		column := r.Rule.Column
+		if r.Rule.Strategy == anonymizeTruncate {
+			column = "(all rows)"
+		}
+		data = append(data, []string{strings.Join(tables, ", "), column, r.Rule.Strategy, fmt.Sprint(r.Total())})
+	}
+	pterm.Success.Println("Anonymized personal data")
+	pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+
+	if unmatched := stats.Unmatched(); len(unmatched) > 0 {
+		var names []string
+		for _, rule := range unmatched {
+			names = append(names, fmt.Sprintf("'%s'", rule))
+		}
+		pterm.Warning.Printf("%d anonymization rule(s) matched no table: %s\n", len(unmatched), strings.Join(names, ", "))
+	}
+}
+
+func discardSQL(ctx context.Context, r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// printReplaceStats reports per-rule match counts, split by escaping
+// variant, and the tables affected.
+func printReplaceStats(stats ReplaceStats) {
+	data := pterm.TableData{{"From", "To", "Matches", "Plain", `\/`, `\\/`, "Tables"}}
+	for _, r := range stats.Rules {
+		var tables []string
+		for _, name := range r.TableNames() {
+			label := name
+			if label == "" {
+				label = "(outside table data)"
+			}
+			tables = append(tables, fmt.Sprintf("%s (%d)", label, r.Tables[name]))
+		}
+		data = append(data, []string{
+			r.Rule.From, r.Rule.To,
+			fmt.Sprint(r.Matches), fmt.Sprint(r.Plain), fmt.Sprint(r.Escaped), fmt.Sprint(r.DoubleEscaped),
+			strings.Join(tables, ", "),
+		})
+	}
+	pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+// replacer returns the Replacer for rules taken from c.
+func (c *Config) replacer(rules []DBReplace) *Replacer {
+	if c.derivedReplace {
+		return NewSinglePassReplacer(rules)
+	}
+	return NewReplacer(rules)
+}
+
+// dbPipeline describes one dump -> replace -> write stream.
+type dbPipeline struct {
+	dump       func(ctx context.Context, w io.Writer) error
+	dumpErr    string
+	replacer   *Replacer
+	anonymizer *Anonymizer
+	write      func(ctx context.Context, r io.Reader) error
+	writeErr   string
+	savePath   string
+	saveError  string
+}
+
+// streamDB connects the dump, the replacer and the writer with pipes so the
+// SQL never has to fit in memory. The first stage to fail cancels the
+// context, which kills the other commands; errors caused by that shutdown
+// are not reported. The mysql and psql clients commit each statement as it
+// arrives, so a dump failing halfway leaves the target partly written: the
+// backup or snapshot taken before the write is what protects it.
+func streamDB(ctx context.Context, p dbPipeline) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		once     sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	dumpR, dumpW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	var (
+		out  io.Writer = outW
+		save *sqlFile
+	)
+	if p.savePath != "" {
+		var err error
+		if save, err = createSQLFile(p.savePath); err != nil {
+			return fmt.Errorf("%s: %w", p.saveError, err)
+		}
+		out = io.MultiWriter(outW, save)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		err := p.dump(ctx, dumpW)
+		if err != nil {
+			fail(fmt.Errorf("%s: %w", p.dumpErr, err))
+		}
+		dumpW.CloseWithError(err)
+	}()
+
+	go func() {
+		defer wg.Done()
+		err := p.rewrite(out, dumpR)
+		switch {
+		case errors.Is(err, errPipelineClosed):
+			fail(fmt.Errorf("%s: stopped reading before the dump was complete", p.writeErr))
+		case err != nil:
+			fail(fmt.Errorf("failed to process the dump: %w", err))
+		}
+		dumpR.CloseWithError(err)
+		outW.CloseWithError(err)
+	}()
+
+	if err := p.write(ctx, outR); err != nil {
+		fail(fmt.Errorf("%s: %w", p.writeErr, err))
+	}
+	// Unblock the replacer if the writer stopped reading early
+	outR.CloseWithError(errPipelineClosed)
+
+	wg.Wait()
+
+	if save != nil {
+		if err := save.Close(); err != nil && firstErr == nil {
+			return fmt.Errorf("%s: %w", p.saveError, err)
+		}
+	}
+	return firstErr
+}
+
+// rewrite copies the dump from src to dst through the anonymizer, if any,
+// and the replacer.
+func (p dbPipeline) rewrite(dst io.Writer, src io.Reader) error {
+	if p.anonymizer == nil {
+		return p.replacer.Stream(dst, src)
+	}
+	return streamStatements(dst, src, p.replacer.standardStrings, func(sql string) (string, error) {
+		sql, err := p.anonymizer.Rewrite(sql)
+		if err != nil {
+			return "", err
+		}
+		return p.replacer.Replace(sql), nil
+	})
+}
+
+var errPipelineClosed = errors.New("pipeline closed")
+
+// DBEndpoint is a single database that can be dumped, written and backed up.
+type DBEndpoint interface {
+	Dump(ctx context.Context, w io.Writer) error
+	Write(ctx context.Context, r io.Reader) error
+	Backup(ctx context.Context) error
+}
+
+func (p *RealDBProvider) DumpRemote(ctx context.Context, w io.Writer) error {
+	return p.remote().Dump(ctx, w)
+}
+
+func (p *RealDBProvider) DumpLocal(ctx context.Context, w io.Writer) error {
+	return p.local().Dump(ctx, w)
+}
+
+func (p *RealDBProvider) WriteRemote(ctx context.Context, r io.Reader) error {
+	return p.remote().Write(ctx, r)
+}
+
+func (p *RealDBProvider) WriteLocal(ctx context.Context, r io.Reader) error {
+	return p.local().Write(ctx, r)
+}
+
+func (p *RealDBProvider) BackupRemote(ctx context.Context) error {
+	return p.remote().Backup(ctx)
+}
+
+func (p *RealDBProvider) BackupLocal(ctx context.Context) error {
+	return p.local().Backup(ctx)
+}
+
+func (p *RealDBProvider) remote() *sshDB {
+	return newSSHDB(&Environment{SSHHost: p.cfg.SSHHost, Port: p.cfg.Port, SSH: p.cfg.SSH, DB: p.cfg.Remote}, p.settings())
+}
+
+func (p *RealDBProvider) local() *localDB {
+	return newLocalDB(p.cfg.Local, p.settings())
+}
+
+func (p *RealDBProvider) settings() dbSettings {
+	s := p.cfg.dbSettings()
+	s.exec = p.exec
+	return s
+}
+
+// dbSettings are the options of a config that apply to every database
+// endpoint.
+type dbSettings struct {
+	backups     BackupPolicy
+	snapshots   SnapshotSettings
+	compression CompressionSettings
+	// tables filters what Dump exports; backups and snapshots are always
+	// complete.
+	tables TableFilter
+	// rawFiles lets Dump copy file based databases as is, which is only
+	// possible when nothing rewrites the dump.
+	rawFiles bool
+	// exec runs the commands on this machine, including ssh.
+	exec Executor
+	// ssh runs the commands on SSH hosts; nil uses the ssh binary.
+	ssh *sshClients
+}
+
+func (c *Config) dbSettings() dbSettings {
+	return dbSettings{
+		backups:     c.Backups,
+		snapshots:   c.Snapshots,
+		compression: c.Compression,
+		tables:      c.Tables,
+		rawFiles:    len(c.DBReplace) == 0 && len(c.Anonymize) == 0,
+		exec:        systemExecutor{},
+		ssh:         c.sshClients(),
+	}
+}
+
+// remote returns the Executor running commands on env's SSH host.
+func (s dbSettings) remote(env *Environment) Executor {
+	if s.ssh != nil {
+		return s.ssh.executor(env.sshHost())
+	}
+	return sshExecutor{local: s.exec, host: env.sshHost()}
+}
+
+// sshDB is a database reached by running its client tools over ssh.
+type sshDB struct {
+	exec        Executor // runs commands on the SSH host
+	db          HostSettings
+	policy      BackupPolicy // applied after every backup
+	compression CompressionSettings
+	tables      TableFilter
+	rawFiles    bool
+}
+
+func newSSHDB(env *Environment, s dbSettings) *sshDB {
+	return &sshDB{
+		exec:        s.remote(env),
+		db:          env.DB,
+		policy:      s.backups,
+		compression: s.compression,
+		tables:      s.tables,
+		rawFiles:    s.rawFiles,
+	}
+}
+
+// Dump streams the database to w. It is compressed on the SSH host when a
+// codec is available there and decompressed here.
+func (d *sshDB) Dump(ctx context.Context, w io.Writer) error {
+	wrap, err := d.compression.outputWrapper()
+	if err != nil {
+		return err
+	}
+	script, preamble, err := dumpScript(d.db.driver(), d.rawFiles, d.tables, func() ([]string, error) { return d.listTables(ctx) }, wrap)
+	if err != nil {
+		return err
 	}
 
-	cmd := exec.CommandContext(ctx, "ssh", args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	return d.stream(ctx, d.command(script, bytes.NewReader(preamble)), w)
+}
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("ssh command failed: %s: %w", stderr.String(), err)
+func (d *sshDB) listTables(ctx context.Context) ([]string, error) {
+	drv := d.db.driver()
+	script, preamble, err := drv.queryScript(drv.listTablesQuery())
+	if err != nil {
+		return nil, err
 	}
 
-	return stdout.String(), nil
+	stdout, stderr, err := output(ctx, d.exec, d.command(script, bytes.NewReader(preamble)))
+	if err != nil {
+		return nil, fmt.Errorf("ssh command failed: %s: %w", stderr, err)
+	}
+	return parseTableList(string(stdout)), nil
 }
 
-func (p *RealDBProvider) DumpLocal(ctx context.Context) (string, error) {
-	composeFile := getComposeFilePath()
+// Write loads SQL (or an SQLite file) from r into the database, compressing
+// it on the way when the SSH host can decompress it.
+func (d *sshDB) Write(ctx context.Context, r io.Reader) error {
+	codec, err := d.codec(ctx)
+	if err != nil {
+		return err
+	}
+	level, err := d.compression.level(codec)
+	if err != nil {
+		return err
+	}
 
-	// Try mariadb-dump first (modern MariaDB containers)
-	args := []string{
-		"compose",
-		"-f", composeFile,
-		"exec", "-T",
-		"mariadb", "mariadb-dump",
-		"-uroot", "-psecret",
-		p.cfg.Local.DB,
+	script, preamble, r, err := loadScript(d.db.driver(), r, inputWrapper(codec))
+	if err != nil {
+		return err
 	}
 
-	cmd := exec.CommandContext(ctx, "docker", args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	compressed := compressedReader(r, codec, level)
+	defer compressed.Close()
 
-	if err := cmd.Run(); err == nil {
-		return stdout.String(), nil
+	out, err := combinedOutput(ctx, d.exec, d.command(script, io.MultiReader(bytes.NewReader(preamble), compressed)))
+	if err != nil {
+		return fmt.Errorf("ssh command failed: %s: %w", out, err)
 	}
 
-	// Fallback to mysqldump (older containers or MySQL)
-	args[6] = "mysqldump"
-	cmd = exec.CommandContext(ctx, "docker", args...)
-	stdout.Reset()
-	stderr.Reset()
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	return nil
+}
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("docker command failed (stderr: %s): %w", stderr.String(), err)
+// codec returns the codec to send SQL to the SSH host with.
+func (d *sshDB) codec(ctx context.Context) (string, error) {
+	script, err := d.compression.detectCodecScript()
+	if err != nil {
+		return "", err
 	}
+	output, err := d.output(ctx, script)
+	if err != nil {
+		return "", fmt.Errorf("failed to detect compression support: %w", err)
+	}
+	return d.compression.chooseCodec(string(output))
+}
 
-	return stdout.String(), nil
+// stream runs c, whose output may be compressed, and copies it to w
+// decompressed.
+func (d *sshDB) stream(ctx context.Context, c Command, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	copied := make(chan error, 1)
+	go func() {
+		r, closeReader, err := decompressReader(pr)
+		if err == nil {
+			_, err = io.Copy(w, r)
+			closeReader()
+		}
+		if err != nil {
+			// The command may be blocked writing to us
+			cancel()
+		}
+		pr.CloseWithError(err)
+		copied <- err
+	}()
+
+	var stderr bytes.Buffer
+	c.Stdout, c.Stderr = pw, &stderr
+	err := d.exec.Run(ctx, c)
+	pw.CloseWithError(err)
+
+	if copyErr := <-copied; copyErr != nil && copyErr != err {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("ssh command failed: %s: %w", stderr.String(), copyErr)
+		}
+		return copyErr
+	}
+	if err != nil {
+		return fmt.Errorf("ssh command failed: %s: %w", stderr.String(), err)
+	}
+	return nil
 }
 
-func (p *RealDBProvider) WriteRemote(ctx context.Context, sqlDump string) error {
-	args := []string{
-		p.cfg.SSHHost,
-		"-p", p.cfg.Port,
-		"mysql", "-uroot", p.cfg.Remote.DB,
+// Backup dumps the database to a timestamped file in the SSH user's home
+// directory, then prunes old backups according to the retention policy.
+func (d *sshDB) Backup(ctx context.Context) error {
+	backupFile := remoteBackupName(d.db.name(), time.Now())
+
+	// Always a complete dump, whatever the table filters
+	script, preamble, err := d.db.driver().dumpScript(TableFilter{}, nil, func(run string) string {
+		return run + " > " + shellQuote(backupFile)
+	})
+	if err != nil {
+		return err
 	}
 
-	cmd := exec.CommandContext(ctx, "ssh", args...)
-	cmd.Stdin = strings.NewReader(sqlDump)
-	output, err := cmd.CombinedOutput()
+	out, err := combinedOutput(ctx, d.exec, d.command(script, bytes.NewReader(preamble)))
 	if err != nil {
-		return fmt.Errorf("ssh command failed: %s: %w", string(output), err)
+		return fmt.Errorf("ssh backup command failed: %s: %w", out, err)
 	}
 
+	if _, err := d.Prune(ctx, d.policy); err != nil {
+		return fmt.Errorf("backup %s was created, but pruning old backups failed: %w", backupFile, err)
+	}
 	return nil
 }
 
-func (p *RealDBProvider) WriteLocal(ctx context.Context, sqlDump string) error {
-	composeFile := getComposeFilePath()
+// command runs a shell script on the SSH host, reading stdin (which may be
+// nil).
+func (d *sshDB) command(script string, stdin io.Reader) Command {
+	c := shellCommand(script)
+	c.Stdin = stdin
+	return c
+}
+
+// localDB is the database on this machine, reached through a container
+// runtime or directly (see LocalExec).
+type localDB struct {
+	exec      Executor
+	db        HostSettings
+	snapshots SnapshotSettings
+	tables    TableFilter
+	rawFiles  bool
+}
+
+func newLocalDB(db HostSettings, s dbSettings) *localDB {
+	return &localDB{exec: s.exec, db: db, snapshots: s.snapshots, tables: s.tables, rawFiles: s.rawFiles}
+}
 
-	if err := ensureUserAndDB(ctx, p.cfg.Local.DB, composeFile); err != nil {
+func (d *localDB) Dump(ctx context.Context, w io.Writer) error {
+	return d.dump(ctx, w, d.rawFiles, d.tables)
+}
+
+func (d *localDB) dump(ctx context.Context, w io.Writer, raw bool, filter TableFilter) error {
+	script, preamble, err := dumpScript(d.db.driver(), raw, filter, func() ([]string, error) { return d.listTables(ctx) }, identity)
+	if err != nil {
 		return err
 	}
 
-	args := []string{
-		"compose",
-		"-f", composeFile,
-		"exec", "-T",
-		"mariadb", "mariadb",
-		"-uroot", "-psecret",
-		p.cfg.Local.DB,
+	var stderr bytes.Buffer
+	c := d.command(script, bytes.NewReader(preamble))
+	c.Stdout, c.Stderr = w, &stderr
+	if err := d.exec.Run(ctx, c); err != nil {
+		return d.commandError(stderr.Bytes(), err)
 	}
 
-	cmd := exec.CommandContext(ctx, "docker", args...)
-	cmd.Stdin = strings.NewReader(sqlDump)
-	output, err := cmd.CombinedOutput()
+	return nil
+}
+
+func (d *localDB) Write(ctx context.Context, r io.Reader) error {
+	if err := d.ensureUserAndDB(ctx); err != nil {
+		return err
+	}
+
+	script, preamble, r, err := loadScript(d.db.driver(), r, identity)
 	if err != nil {
-		return fmt.Errorf("docker command failed: %s: %w", string(output), err)
+		return err
+	}
+
+	out, err := combinedOutput(ctx, d.exec, d.command(script, io.MultiReader(bytes.NewReader(preamble), r)))
+	if err != nil {
+		return d.commandError(out, err)
 	}
 
 	return nil
 }
 
-func (p *RealDBProvider) BackupRemote(ctx context.Context) error {
-	timestamp := time.Now().Format("20060102_150405")
-	backupFile := fmt.Sprintf("%s_backup_%s.sql", p.cfg.Remote.DB, timestamp)
+// Backup snapshots the database into the local snapshot directory, then
+// prunes old snapshots.
+func (d *localDB) Backup(ctx context.Context) error {
+	return d.snapshot(ctx, true)
+}
 
-	// Command: mysqldump -uroot dbname > backup_file.sql
-	remoteCmd := fmt.Sprintf("mysqldump -uroot %s > %s", p.cfg.Remote.DB, backupFile)
+// snapshot saves a snapshot of the database unless snapshots are disabled
+// or the database does not exist yet.
+func (d *localDB) snapshot(ctx context.Context, prune bool) error {
+	if d.snapshots.Disabled {
+		return nil
+	}
 
-	args := []string{
-		p.cfg.SSHHost,
-		"-p", p.cfg.Port,
-		remoteCmd,
+	exists, err := d.exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
 	}
 
-	cmd := exec.CommandContext(ctx, "ssh", args...)
-	output, err := cmd.CombinedOutput()
+	// Snapshots are always of the whole database, as SQL
+	path, err := d.snapshots.takeSnapshot(ctx, d.db.name(), func(ctx context.Context, w io.Writer) error {
+		return d.dump(ctx, w, false, TableFilter{})
+	})
 	if err != nil {
-		return fmt.Errorf("ssh backup command failed: %s: %w", string(output), err)
+		return fmt.Errorf("failed to snapshot local db: %w", err)
+	}
+	pterm.Info.Printf("Saved snapshot %s\n", path)
+
+	if !prune {
+		return nil
+	}
+	if err := d.snapshots.pruneSnapshots(d.db.name()); err != nil {
+		return fmt.Errorf("snapshot %s was created, but pruning old snapshots failed: %w", path, err)
 	}
 	return nil
 }
 
-func ensureUserAndDB(ctx context.Context, dbName, composeFile string) error {
-	query := fmt.Sprintf(
-		"CREATE USER IF NOT EXISTS `%[1]s`@'%%' IDENTIFIED BY 'secret'; "+
-			"CREATE DATABASE IF NOT EXISTS `%[1]s`; "+
-			"GRANT ALL PRIVILEGES ON `%[1]s`.* TO `%[1]s`@'%%';",
-		dbName,
-	)
+func (d *localDB) exists(ctx context.Context) (bool, error) {
+	script, preamble, err := d.db.driver().existsScript()
+	if err != nil {
+		return false, err
+	}
+	output, err := d.output(ctx, script, preamble)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for local db: %w", err)
+	}
+	return strings.TrimSpace(string(output)) == "1", nil
+}
 
-	args := []string{
-		"compose",
-		"-f", composeFile,
-		"exec", "-T",
-		"mariadb", "mariadb",
-		"-uroot", "-psecret",
-		"-e", query,
+func (d *localDB) listTables(ctx context.Context) ([]string, error) {
+	output, err := d.query(ctx, d.db.driver().listTablesQuery())
+	if err != nil {
+		return nil, err
 	}
+	return parseTableList(string(output)), nil
+}
 
-	cmd := exec.CommandContext(ctx, "docker", args...)
-	output, err := cmd.CombinedOutput()
+// query runs a statement with the client in batch mode and returns its
+// output without column names.
+func (d *localDB) query(ctx context.Context, query string) ([]byte, error) {
+	script, preamble, err := d.db.driver().queryScript(query)
 	if err != nil {
-		return fmt.Errorf("failed to create user/db: %s: %w", string(output), err)
+		return nil, err
 	}
-	return nil
+	return d.output(ctx, script, preamble)
 }
 
-func getComposeFilePath() string {
-	// Preserve original behavior but allow override
-	if path := os.Getenv("DSYNC_COMPOSE_FILE"); path != "" {
-		return path
+// output runs a script and returns what it prints.
+func (d *localDB) output(ctx context.Context, script string, preamble []byte) ([]byte, error) {
+	stdout, stderr, err := output(ctx, d.exec, d.command(script, bytes.NewReader(preamble)))
+	if err != nil {
+		return nil, d.commandError(stderr, err)
 	}
-	return os.Getenv("HOME") + "/www/dev/docker-compose.yml"
+	return stdout, nil
 }
 
-func ApplyDBReplacements(sql string, replacements []DBReplace) string {
-	for _, item := range replacements {
-		sql = strings.ReplaceAll(sql, item.From, item.To)
+func (d *localDB) ensureUserAndDB(ctx context.Context) error {
+	drv := d.db.driver()
+	query := drv.ensureUserAndDBSQL()
+	if query == "" {
+		return nil
+	}
 
-		// Handle JSON-escaped slashes (e.g. "http:\/\/")
-		fromJSON := strings.ReplaceAll(item.From, "/", `\/`)
-		toJSON := strings.ReplaceAll(item.To, "/", `\/`)
-		if fromJSON != item.From {
-			sql = strings.ReplaceAll(sql, fromJSON, toJSON)
-		}
+	script, preamble, err := drv.adminScript()
+	if err != nil {
+		return err
+	}
 
-		// Handle Double-escaped slashes (e.g. "http:\\/\\/")
-		fromDouble := strings.ReplaceAll(item.From, "/", `\\/`)
-		toDouble := strings.ReplaceAll(item.To, "/", `\\/`)
-		if fromDouble != item.From {
-			sql = strings.ReplaceAll(sql, fromDouble, toDouble)
-		}
+	out, err := combinedOutput(ctx, d.exec, d.command(script, io.MultiReader(bytes.NewReader(preamble), strings.NewReader(query))))
+	if err != nil {
+		return fmt.Errorf("failed to create user/db: %s: %w", out, err)
 	}
-	return sql
+	return nil
+}
+
+// command runs a shell script where the local database's client tools
+// are, as configured by its LocalExec, reading stdin.
+func (d *localDB) command(script string, stdin io.Reader) Command {
+	return Command{Args: d.db.localExec().commandLine(script), Stdin: stdin}
+}
+
+// commandError describes a failed command, with what it printed.
+func (d *localDB) commandError(output []byte, err error) error {
+	return fmt.Errorf("%s failed: %s: %w", d.db.localExec(), output, err)
 }
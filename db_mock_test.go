@@ -2,69 +2,103 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
 type MockDBProvider struct {
-	DumpRemoteFunc   func(ctx context.Context) (string, error)
-	DumpLocalFunc    func(ctx context.Context) (string, error)
-	WriteRemoteFunc  func(ctx context.Context, sql string) error
-	WriteLocalFunc   func(ctx context.Context, sql string) error
+	DumpRemoteFunc   func(ctx context.Context, w io.Writer) error
+	DumpLocalFunc    func(ctx context.Context, w io.Writer) error
+	WriteRemoteFunc  func(ctx context.Context, r io.Reader) error
+	WriteLocalFunc   func(ctx context.Context, r io.Reader) error
 	BackupRemoteFunc func(ctx context.Context) error
+	BackupLocalFunc  func(ctx context.Context) error
 
+	mu    sync.Mutex
 	Calls []string
 }
 
-func (m *MockDBProvider) DumpRemote(ctx context.Context) (string, error) {
-	m.Calls = append(m.Calls, "DumpRemote")
+func (m *MockDBProvider) record(call string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Calls = append(m.Calls, call)
+}
+
+func (m *MockDBProvider) DumpRemote(ctx context.Context, w io.Writer) error {
+	m.record("DumpRemote")
 	if m.DumpRemoteFunc != nil {
-		return m.DumpRemoteFunc(ctx)
+		return m.DumpRemoteFunc(ctx, w)
 	}
-	return "", nil
+	return nil
 }
 
-func (m *MockDBProvider) DumpLocal(ctx context.Context) (string, error) {
-	m.Calls = append(m.Calls, "DumpLocal")
+func (m *MockDBProvider) DumpLocal(ctx context.Context, w io.Writer) error {
+	m.record("DumpLocal")
 	if m.DumpLocalFunc != nil {
-		return m.DumpLocalFunc(ctx)
+		return m.DumpLocalFunc(ctx, w)
 	}
-	return "", nil
+	return nil
 }
 
-func (m *MockDBProvider) WriteRemote(ctx context.Context, sql string) error {
-	m.Calls = append(m.Calls, "WriteRemote")
+func (m *MockDBProvider) WriteRemote(ctx context.Context, r io.Reader) error {
+	m.record("WriteRemote")
 	if m.WriteRemoteFunc != nil {
-		return m.WriteRemoteFunc(ctx, sql)
+		return m.WriteRemoteFunc(ctx, r)
 	}
-	return nil
+	_, err := io.Copy(io.Discard, r)
+	return err
 }
 
-func (m *MockDBProvider) WriteLocal(ctx context.Context, sql string) error {
-	m.Calls = append(m.Calls, "WriteLocal")
+func (m *MockDBProvider) WriteLocal(ctx context.Context, r io.Reader) error {
+	m.record("WriteLocal")
 	if m.WriteLocalFunc != nil {
-		return m.WriteLocalFunc(ctx, sql)
+		return m.WriteLocalFunc(ctx, r)
 	}
-	return nil
+	_, err := io.Copy(io.Discard, r)
+	return err
 }
 
 func (m *MockDBProvider) BackupRemote(ctx context.Context) error {
-	m.Calls = append(m.Calls, "BackupRemote")
+	m.record("BackupRemote")
 	if m.BackupRemoteFunc != nil {
 		return m.BackupRemoteFunc(ctx)
 	}
 	return nil
 }
 
+func (m *MockDBProvider) BackupLocal(ctx context.Context) error {
+	m.record("BackupLocal")
+	if m.BackupLocalFunc != nil {
+		return m.BackupLocalFunc(ctx)
+	}
+	return nil
+}
+
+func (m *MockDBProvider) index(call string) int {
+	for i, c := range m.Calls {
+		if c == call {
+			return i
+		}
+	}
+	return -1
+}
+
 func TestSyncDB_Forward(t *testing.T) {
 	mock := &MockDBProvider{
-		DumpRemoteFunc: func(ctx context.Context) (string, error) {
-			return "INSERT INTO users VALUES ('remote');", nil
+		DumpRemoteFunc: func(ctx context.Context, w io.Writer) error {
+			_, err := io.WriteString(w, "INSERT INTO users VALUES ('remote');")
+			return err
 		},
-		WriteLocalFunc: func(ctx context.Context, sql string) error {
-			if sql != "INSERT INTO users VALUES ('remote');" {
+		WriteLocalFunc: func(ctx context.Context, r io.Reader) error {
+			sql, err := io.ReadAll(r)
+			if string(sql) != "INSERT INTO users VALUES ('remote');" {
 				t.Errorf("Unexpected SQL: %s", sql)
 			}
-			return nil
+			return err
 		},
 	}
 
@@ -73,30 +107,36 @@ func TestSyncDB_Forward(t *testing.T) {
 		Local:  HostSettings{DB: "local_db"},
 	}
 
-	err := SyncDB(context.Background(), mock, cfg, false, false)
+	err := SyncDB(context.Background(), mock, cfg, SyncOptions{})
 	if err != nil {
 		t.Fatalf("SyncDB failed: %v", err)
 	}
 
-	expectedCalls := []string{"DumpRemote", "WriteLocal"}
+	expectedCalls := []string{"BackupLocal", "DumpRemote", "WriteLocal"}
 	if len(mock.Calls) != len(expectedCalls) {
 		t.Errorf("Expected calls %v, got %v", expectedCalls, mock.Calls)
 	}
+
+	if mock.index("BackupLocal") > mock.index("DumpRemote") {
+		t.Error("BackupLocal must be called before the local db is written")
+	}
 }
 
 func TestSyncDB_Reverse(t *testing.T) {
 	mock := &MockDBProvider{
-		DumpLocalFunc: func(ctx context.Context) (string, error) {
-			return "INSERT INTO users VALUES ('local');", nil
+		DumpLocalFunc: func(ctx context.Context, w io.Writer) error {
+			_, err := io.WriteString(w, "INSERT INTO users VALUES ('local');")
+			return err
 		},
 		BackupRemoteFunc: func(ctx context.Context) error {
 			return nil
 		},
-		WriteRemoteFunc: func(ctx context.Context, sql string) error {
-			if sql != "INSERT INTO users VALUES ('local');" {
+		WriteRemoteFunc: func(ctx context.Context, r io.Reader) error {
+			sql, err := io.ReadAll(r)
+			if string(sql) != "INSERT INTO users VALUES ('local');" {
 				t.Errorf("Unexpected SQL: %s", sql)
 			}
-			return nil
+			return err
 		},
 	}
 
@@ -105,7 +145,7 @@ func TestSyncDB_Reverse(t *testing.T) {
 		Local:  HostSettings{DB: "local_db"},
 	}
 
-	err := SyncDB(context.Background(), mock, cfg, false, true)
+	err := SyncDB(context.Background(), mock, cfg, SyncOptions{Reverse: true})
 	if err != nil {
 		t.Fatalf("SyncDB failed: %v", err)
 	}
@@ -115,8 +155,176 @@ func TestSyncDB_Reverse(t *testing.T) {
 		t.Errorf("Expected calls %v, got %v", expectedCalls, mock.Calls)
 	}
 
-	// Verify order specifically
-	if mock.Calls[1] != "BackupRemote" {
+	// Verify order specifically: the backup must exist before anything is streamed
+	if mock.index("BackupRemote") > mock.index("WriteRemote") || mock.index("BackupRemote") > mock.index("DumpLocal") {
 		t.Error("BackupRemote must be called before WriteRemote")
 	}
 }
+
+func TestSyncDB_DumpFailureStopsWrite(t *testing.T) {
+	mock := &MockDBProvider{
+		DumpRemoteFunc: func(ctx context.Context, w io.Writer) error {
+			io.WriteString(w, "INSERT INTO users VALUES ('partial');\n")
+			return errors.New("connection reset")
+		},
+	}
+	var readErr error
+	mock.WriteLocalFunc = func(ctx context.Context, r io.Reader) error {
+		_, readErr = io.Copy(io.Discard, r)
+		return readErr
+	}
+
+	cfg := &Config{
+		Remote: HostSettings{DB: "remote_db"},
+		Local:  HostSettings{DB: "local_db"},
+	}
+
+	err := SyncDB(context.Background(), mock, cfg, SyncOptions{})
+	if err == nil || !strings.Contains(err.Error(), "failed to dump remote db") {
+		t.Fatalf("Expected dump error, got %v", err)
+	}
+	// The writer must see an error, not a clean EOF it could commit
+	if readErr == nil {
+		t.Error("WriteLocal read the partial dump to a clean EOF")
+	}
+}
+
+func TestSyncDB_WriteFailureDoesNotHang(t *testing.T) {
+	mock := &MockDBProvider{
+		DumpRemoteFunc: func(ctx context.Context, w io.Writer) error {
+			for i := 0; i < 100000; i++ {
+				if _, err := io.WriteString(w, "INSERT INTO users VALUES ('row');\n"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		WriteLocalFunc: func(ctx context.Context, r io.Reader) error {
+			return errors.New("access denied")
+		},
+	}
+
+	cfg := &Config{
+		Remote:    HostSettings{DB: "remote_db"},
+		Local:     HostSettings{DB: "local_db"},
+		DBReplace: []DBReplace{{From: "row", To: "col"}},
+	}
+
+	err := SyncDB(context.Background(), mock, cfg, SyncOptions{})
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Fatalf("Expected write error, got %v", err)
+	}
+}
+
+type MockDBEndpoint struct {
+	Name     string
+	DumpData string
+	Written  string
+	calls    *[]string
+}
+
+func (m *MockDBEndpoint) Dump(ctx context.Context, w io.Writer) error {
+	*m.calls = append(*m.calls, m.Name+".Dump")
+	_, err := io.WriteString(w, m.DumpData)
+	return err
+}
+
+func (m *MockDBEndpoint) Write(ctx context.Context, r io.Reader) error {
+	*m.calls = append(*m.calls, m.Name+".Write")
+	b, err := io.ReadAll(r)
+	m.Written = string(b)
+	return err
+}
+
+func (m *MockDBEndpoint) Backup(ctx context.Context) error {
+	*m.calls = append(*m.calls, m.Name+".Backup")
+	return nil
+}
+
+func TestSyncDBBetween(t *testing.T) {
+	pair, err := testEnvironmentsConfig().RemotePair("production", "staging")
+	if err != nil {
+		t.Fatalf("RemotePair() error: %v", err)
+	}
+
+	var calls []string
+	src := &MockDBEndpoint{Name: "production", DumpData: "INSERT INTO t VALUES ('https://example.com/x');", calls: &calls}
+	dst := &MockDBEndpoint{Name: "staging", calls: &calls}
+
+	if err := SyncDBBetween(context.Background(), src, dst, pair, SyncOptions{}); err != nil {
+		t.Fatalf("SyncDBBetween() error: %v", err)
+	}
+
+	if want := "INSERT INTO t VALUES ('https://staging.example.com/x');"; dst.Written != want {
+		t.Errorf("written = %s, want %s", dst.Written, want)
+	}
+	if len(calls) == 0 || calls[0] != "staging.Backup" {
+		t.Errorf("target must be backed up before streaming, calls: %v", calls)
+	}
+}
+
+func TestSyncDB_DryRunSkipsWrites(t *testing.T) {
+	mock := &MockDBProvider{
+		DumpLocalFunc: func(ctx context.Context, w io.Writer) error {
+			_, err := io.WriteString(w, "INSERT INTO `users` VALUES ('host.test');\n")
+			return err
+		},
+	}
+
+	cfg := &Config{
+		Remote:    HostSettings{DB: "remote_db"},
+		Local:     HostSettings{DB: "local_db"},
+		DBReplace: []DBReplace{{From: "host.com", To: "host.test"}},
+	}
+
+	if err := SyncDB(context.Background(), mock, cfg, SyncOptions{Reverse: true, DryRun: true}); err != nil {
+		t.Fatalf("SyncDB failed: %v", err)
+	}
+
+	if len(mock.Calls) != 1 || mock.Calls[0] != "DumpLocal" {
+		t.Errorf("Expected only DumpLocal in a dry run, got %v", mock.Calls)
+	}
+}
+
+func TestSyncDB_UnmatchedRules(t *testing.T) {
+	cfg := &Config{
+		Remote:    HostSettings{DB: "remote_db"},
+		Local:     HostSettings{DB: "local_db"},
+		DBReplace: []DBReplace{{From: "host.com", To: "host.test"}, {From: "tpyo.com", To: "host.test"}},
+	}
+	dump := func(ctx context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, "INSERT INTO `users` VALUES ('host.com');\n")
+		return err
+	}
+
+	if err := SyncDB(context.Background(), &MockDBProvider{DumpRemoteFunc: dump}, cfg, SyncOptions{}); err != nil {
+		t.Errorf("unmatched rules must only warn by default, got %v", err)
+	}
+
+	mock := &MockDBProvider{DumpRemoteFunc: dump}
+	err := SyncDB(context.Background(), mock, cfg, SyncOptions{FailOnUnmatched: true})
+	if err == nil || !strings.Contains(err.Error(), "'tpyo.com'") {
+		t.Errorf("expected an error naming the unmatched rule, got %v", err)
+	}
+	if len(mock.Calls) != 1 || mock.Calls[0] != "DumpRemote" {
+		t.Errorf("the local db must not be backed up or written, got %v", mock.Calls)
+	}
+
+	// Once every rule matches, the staged dump is written
+	cfg.DBReplace = cfg.DBReplace[:1]
+	var written string
+	mock = &MockDBProvider{DumpRemoteFunc: dump, WriteLocalFunc: func(ctx context.Context, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		written = string(data)
+		return err
+	}}
+	if err := SyncDB(context.Background(), mock, cfg, SyncOptions{FailOnUnmatched: true}); err != nil {
+		t.Fatalf("SyncDB failed: %v", err)
+	}
+	if want := []string{"DumpRemote", "BackupLocal", "WriteLocal"}; !reflect.DeepEqual(mock.Calls, want) {
+		t.Errorf("calls = %v, want %v", mock.Calls, want)
+	}
+	if written != "INSERT INTO `users` VALUES ('host.test');\n" {
+		t.Errorf("wrote %q", written)
+	}
+}
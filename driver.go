@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Database drivers selectable with HostSettings.Driver.
+const (
+	driverMySQL    = "mysql"
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite"
+)
+
+// dbDriver builds the shell scripts that run a database engine's client
+// tools, wherever they run (over ssh or in the local container). Scripts
+// read their credentials from the first bytes of stdin: the returned
+// preamble must be sent ahead of any payload.
+type dbDriver interface {
+	// dumpScript prints the database as SQL, restricted to filter.
+	// listTables is called for drivers that expand filters themselves.
+	dumpScript(filter TableFilter, listTables func() ([]string, error), wrap func(run string) string) (script string, preamble []byte, err error)
+	// loadScript runs the SQL read from stdin against the database.
+	loadScript(wrap func(run string) string) (script string, preamble []byte, err error)
+	// queryScript runs a query against the server, printing rows tab
+	// separated without a header.
+	queryScript(query string) (script string, preamble []byte, err error)
+	// adminScript runs the statements read from stdin against the server
+	// rather than the database, which may not exist yet.
+	adminScript() (script string, preamble []byte, err error)
+
+	listTablesQuery() string
+	// existsScript prints 1 if the database exists and nothing otherwise.
+	existsScript() (script string, preamble []byte, err error)
+	// ensureUserAndDBSQL creates the database and the app user, for
+	// adminScript.
+	ensureUserAndDBSQL() string
+
+	// composeService is the default compose service running the server,
+	// or "" if the local database is used directly on this machine.
+	composeService() string
+}
+
+// fileDriver is implemented by drivers of file based databases, which are
+// copied as is rather than as SQL when nothing rewrites the dump.
+type fileDriver interface {
+	// fileDumpScript prints a consistent copy of the database file.
+	fileDumpScript(wrap func(run string) string) (script string, preamble []byte, err error)
+	// fileLoadScript replaces the database with the file read from stdin.
+	fileLoadScript(wrap func(run string) string) (script string, preamble []byte, err error)
+}
+
+// dumpScript returns the script dumping the database of drv: a copy of the
+// file itself for file drivers when raw is set, SQL restricted to filter
+// otherwise.
+func dumpScript(drv dbDriver, raw bool, filter TableFilter, listTables func() ([]string, error), wrap func(run string) string) (string, []byte, error) {
+	if fd, ok := drv.(fileDriver); ok && raw && filter.IsZero() {
+		return fd.fileDumpScript(wrap)
+	}
+	return drv.dumpScript(filter, listTables, wrap)
+}
+
+// loadScript returns the script loading r into the database of drv. File
+// drivers accept either a database file or SQL, told apart by the file's
+// header; the returned reader must be read instead of r.
+func loadScript(drv dbDriver, r io.Reader, wrap func(run string) string) (string, []byte, io.Reader, error) {
+	fd, ok := drv.(fileDriver)
+	if !ok {
+		script, preamble, err := drv.loadScript(wrap)
+		return script, preamble, r, err
+	}
+
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(sqliteMagic))
+	load := drv.loadScript
+	if bytes.Equal(head, sqliteMagic) {
+		load = fd.fileLoadScript
+	}
+	script, preamble, err := load(wrap)
+	return script, preamble, br, err
+}
+
+// driver returns the driver for h's database engine.
+func (h HostSettings) driver() dbDriver {
+	switch h.driverName() {
+	case driverPostgres:
+		return postgresDriver{h}
+	case driverSQLite:
+		return sqliteDriver{h}
+	}
+	return mysqlDriver{h}
+}
+
+// driverName normalizes Driver, which defaults to MySQL.
+func (h HostSettings) driverName() string {
+	switch h.Driver {
+	case "", "mariadb":
+		return driverMySQL
+	case "postgresql", "pgsql":
+		return driverPostgres
+	case "sqlite3":
+		return driverSQLite
+	}
+	return h.Driver
+}
+
+func (h HostSettings) validateDriver() error {
+	switch h.driverName() {
+	case driverMySQL, driverPostgres, driverSQLite:
+		return nil
+	}
+	return fmt.Errorf("unknown database driver '%s' (use mysql, postgres or sqlite)", h.Driver)
+}
+
+// name identifies the database in file names and messages: the database
+// name, or the base name of an SQLite file without its extension.
+func (h HostSettings) name() string {
+	if h.driverName() != driverSQLite {
+		return h.DB
+	}
+	base := filepath.Base(h.DB)
+	if name := strings.TrimSuffix(base, filepath.Ext(base)); name != "" {
+		return name
+	}
+	return base
+}
+
+// checkSameDriver refuses transfers between different database engines,
+// whose dumps the other side cannot load.
+func checkSameDriver(src, dst HostSettings) error {
+	if src.driverName() != dst.driverName() {
+		return fmt.Errorf("cannot copy a %s database into a %s one", src.driverName(), dst.driverName())
+	}
+	return nil
+}
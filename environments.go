@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Names of the environments a config without an "environments" section is
+// treated as having.
+const (
+	legacyRemoteEnv = "remote"
+	legacyLocalEnv  = "local"
+)
+
+func (e *Environment) IsLocal() bool {
+	return e.SSHHost == ""
+}
+
+// EnvironmentNames returns the configured environment names in sorted order.
+func (c *Config) EnvironmentNames() []string {
+	if len(c.Environments) == 0 {
+		return []string{legacyLocalEnv, legacyRemoteEnv}
+	}
+	names := make([]string, 0, len(c.Environments))
+	for name := range c.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Config) environment(name string) (*Environment, error) {
+	if len(c.Environments) == 0 {
+		switch name {
+		case legacyRemoteEnv:
+			return &Environment{SSHHost: c.SSHHost, Port: c.Port, SSH: c.SSH, DB: c.Remote}, nil
+		case legacyLocalEnv:
+			return &Environment{DB: c.Local}, nil
+		}
+	} else if env := c.Environments[name]; env != nil {
+		// A copy, with the top-level SSH options under its own
+		resolved := *env
+		resolved.SSH = c.SSH.merge(env.SSH)
+		return &resolved, nil
+	}
+	return nil, fmt.Errorf("unknown environment '%s' (available: %s)", name, strings.Join(c.EnvironmentNames(), ", "))
+}
+
+// DefaultEnvironment picks the environment to use when --from or --to is
+// omitted: the only local one, or the only remote one.
+func (c *Config) DefaultEnvironment(local bool) (string, error) {
+	var matches []string
+	for _, name := range c.EnvironmentNames() {
+		env, err := c.environment(name)
+		if err != nil {
+			return "", err
+		}
+		if env.IsLocal() == local {
+			matches = append(matches, name)
+		}
+	}
+
+	kind := "remote"
+	if local {
+		kind = "local"
+	}
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		return "", fmt.Errorf("no %s environment is configured", kind)
+	}
+	return "", fmt.Errorf("several %s environments are configured (%s), choose one explicitly", kind, strings.Join(matches, ", "))
+}
+
+// ForPair narrows the config to a sync from one environment to another. The
+// result uses the single SSHHost/Remote/Local layout the sync code works
+// with; reverse reports whether data flows from the local side to the
+// remote one.
+func (c *Config) ForPair(from, to string) (pair *Config, reverse bool, err error) {
+	if from == to {
+		return nil, false, fmt.Errorf("cannot sync environment '%s' with itself", from)
+	}
+
+	src, err := c.environment(from)
+	if err != nil {
+		return nil, false, err
+	}
+	dst, err := c.environment(to)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if src.IsLocal() == dst.IsLocal() {
+		return nil, false, fmt.Errorf("one of '%s' and '%s' must be a local environment (without sshHost)", from, to)
+	}
+
+	remote, local := src, dst
+	remoteName, localName := from, to
+	if src.IsLocal() {
+		remote, local = dst, src
+		remoteName, localName = to, from
+		reverse = true
+	}
+
+	pair = &Config{
+		SSHHost:     remote.SSHHost,
+		Port:        remote.Port,
+		Remote:      remote.DB,
+		Local:       local.DB,
+		Backups:     c.Backups,
+		Snapshots:   c.Snapshots,
+		Compression: c.Compression,
+		Anonymize:   c.Anonymize,
+		SSH:         remote.SSH,
+		clients:     c.sshClients(),
+		// Only the source side is dumped
+		Tables: c.Tables.merge(src.Tables),
+	}
+
+	if len(c.Environments) == 0 {
+		pair.DBReplace = c.DBReplace
+		pair.Sync = c.Sync
+		return pair, reverse, nil
+	}
+
+	// SyncDB reverses the rules for local -> remote, so derive them in the
+	// direction of travel and orient them remote -> local.
+	rules := deriveReplacements(src, dst)
+	if reverse {
+		rules = reverseReplacements(rules)
+	}
+	pair.DBReplace = rules
+	pair.derivedReplace = true
+
+	pair.Sync, err = c.pairSyncPaths(remote, local, remoteName, localName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return pair, reverse, nil
+}
+
+// RemotePair is a sync between two SSH environments, neither of which is on
+// this machine.
+type RemotePair struct {
+	FromName, ToName string
+	From, To         *Environment
+
+	// DBReplace holds the rules in the direction of travel.
+	DBReplace []DBReplace
+	// Sync holds resolved paths; Remote is the directory on From and Local
+	// the directory on To.
+	Sync []SyncPath
+
+	settings dbSettings
+}
+
+// IsRemotePair reports whether both environments are reached over SSH.
+func (c *Config) IsRemotePair(from, to string) bool {
+	src, err := c.environment(from)
+	if err != nil {
+		return false
+	}
+	dst, err := c.environment(to)
+	if err != nil {
+		return false
+	}
+	return !src.IsLocal() && !dst.IsLocal()
+}
+
+// RemotePair resolves a sync between two SSH environments.
+func (c *Config) RemotePair(from, to string) (*RemotePair, error) {
+	if from == to {
+		return nil, fmt.Errorf("cannot sync environment '%s' with itself", from)
+	}
+	if !c.IsRemotePair(from, to) {
+		return nil, fmt.Errorf("'%s' and '%s' must both be remote environments", from, to)
+	}
+
+	src, err := c.environment(from)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := c.environment(to)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := c.pairSyncPaths(src, dst, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	replacements := deriveReplacements(src, dst)
+	settings := c.dbSettings()
+	settings.tables = c.Tables.merge(src.Tables)
+	settings.rawFiles = len(replacements) == 0
+
+	return &RemotePair{
+		FromName:  from,
+		ToName:    to,
+		From:      src,
+		To:        dst,
+		DBReplace: replacements,
+		Sync:      paths,
+		settings:  settings,
+	}, nil
+}
+
+// deriveReplacements builds a rule for every replacement name both
+// environments define. Longer values are replaced first so that e.g. a full
+// URL wins over the bare domain it contains.
+func deriveReplacements(src, dst *Environment) []DBReplace {
+	var rules []DBReplace
+	for name, from := range src.Replace {
+		to, ok := dst.Replace[name]
+		if !ok || from == to || from == "" {
+			continue
+		}
+		rules = append(rules, DBReplace{From: from, To: to})
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		if len(rules[i].From) != len(rules[j].From) {
+			return len(rules[i].From) > len(rules[j].From)
+		}
+		return rules[i].From < rules[j].From
+	})
+	return rules
+}
+
+// reverseReplacements inverts rules so that applying the result undoes them.
+func reverseReplacements(rules []DBReplace) []DBReplace {
+	var reversed []DBReplace
+	// Iterate backwards to ensure correct order of operations (e.g. protocol replacement before domain replacement)
+	for i := len(rules) - 1; i >= 0; i-- {
+		r := rules[i]
+		reversed = append(reversed, DBReplace{From: r.To, To: r.From})
+	}
+	return reversed
+}
+
+// pairSyncPaths resolves named sync entries to directories on both sides,
+// returned as Remote (directory on a) and Local (directory on b). Without
+// explicit entries every path name both environments define is synced.
+func (c *Config) pairSyncPaths(a, b *Environment, aName, bName string) ([]SyncPath, error) {
+	entries := c.Sync
+	if len(entries) == 0 {
+		var names []string
+		for name := range a.Paths {
+			if _, ok := b.Paths[name]; ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			entries = append(entries, SyncPath{Path: name})
+		}
+	}
+
+	var paths []SyncPath
+	for _, entry := range entries {
+		if entry.Path == "" {
+			return nil, fmt.Errorf("sync entries must name a path when environments are configured")
+		}
+		aPath, ok := a.Paths[entry.Path]
+		if !ok {
+			return nil, fmt.Errorf("environment '%s' has no path '%s'", aName, entry.Path)
+		}
+		bPath, ok := b.Paths[entry.Path]
+		if !ok {
+			return nil, fmt.Errorf("environment '%s' has no path '%s'", bName, entry.Path)
+		}
+		if a.IsLocal() {
+			aPath = expandHome(aPath)
+		}
+		if b.IsLocal() {
+			bPath = expandHome(bPath)
+		}
+		paths = append(paths, SyncPath{
+			Remote:  aPath,
+			Local:   bPath,
+			Exclude: entry.Exclude,
+			Path:    entry.Path,
+		})
+	}
+	return paths, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testEnvironmentsConfig() *Config {
+	return &Config{
+		Environments: map[string]*Environment{
+			"production": {
+				SSHHost: "deploy@example.com",
+				Port:    "2222",
+				DB:      HostSettings{DB: "prod"},
+				Paths:   map[string]string{"uploads": "/srv/prod/uploads", "plugins": "/srv/prod/plugins"},
+				Replace: map[string]string{"url": "https://example.com", "domain": "example.com"},
+			},
+			"staging": {
+				SSHHost: "deploy@staging.example.com",
+				DB:      HostSettings{DB: "staging"},
+				Paths:   map[string]string{"uploads": "/srv/staging/uploads"},
+				Replace: map[string]string{"url": "https://staging.example.com", "domain": "staging.example.com"},
+			},
+			"local": {
+				DB:      HostSettings{DB: "site"},
+				Paths:   map[string]string{"uploads": "/home/me/site/uploads", "plugins": "/home/me/site/plugins"},
+				Replace: map[string]string{"url": "http://example.test", "domain": "example.test"},
+			},
+		},
+	}
+}
+
+func TestForPairPull(t *testing.T) {
+	pair, reverse, err := testEnvironmentsConfig().ForPair("production", "local")
+	if err != nil {
+		t.Fatalf("ForPair() error: %v", err)
+	}
+	if reverse {
+		t.Error("pull into local must not be reverse")
+	}
+	if pair.SSHHost != "deploy@example.com" || pair.Port != "2222" || pair.Remote.DB != "prod" || pair.Local.DB != "site" {
+		t.Errorf("unexpected pair: %+v", pair)
+	}
+
+	wantRules := []DBReplace{
+		{From: "https://example.com", To: "http://example.test"},
+		{From: "example.com", To: "example.test"},
+	}
+	if !reflect.DeepEqual(pair.DBReplace, wantRules) {
+		t.Errorf("DBReplace = %v, want %v", pair.DBReplace, wantRules)
+	}
+
+	wantSync := []SyncPath{
+		{Remote: "/srv/prod/plugins", Local: "/home/me/site/plugins", Path: "plugins"},
+		{Remote: "/srv/prod/uploads", Local: "/home/me/site/uploads", Path: "uploads"},
+	}
+	if !reflect.DeepEqual(pair.Sync, wantSync) {
+		t.Errorf("Sync = %v, want %v", pair.Sync, wantSync)
+	}
+}
+
+func TestForPairPushAppliesRulesInDirectionOfTravel(t *testing.T) {
+	pair, reverse, err := testEnvironmentsConfig().ForPair("local", "staging")
+	if err != nil {
+		t.Fatalf("ForPair() error: %v", err)
+	}
+	if !reverse {
+		t.Fatal("push from local must be reverse")
+	}
+
+	var written string
+	mock := &MockDBProvider{
+		DumpLocalFunc: func(ctx context.Context, w io.Writer) error {
+			_, err := io.WriteString(w, "INSERT INTO t VALUES ('http://example.test/a','example.test');")
+			return err
+		},
+		WriteRemoteFunc: func(ctx context.Context, r io.Reader) error {
+			b, err := io.ReadAll(r)
+			written = string(b)
+			return err
+		},
+	}
+
+	if err := SyncDB(context.Background(), mock, pair, SyncOptions{Reverse: reverse}); err != nil {
+		t.Fatalf("SyncDB() error: %v", err)
+	}
+
+	want := "INSERT INTO t VALUES ('https://staging.example.com/a','staging.example.com');"
+	if written != want {
+		t.Errorf("written = %s, want %s", written, want)
+	}
+}
+
+func TestForPairErrors(t *testing.T) {
+	cfg := testEnvironmentsConfig()
+
+	tests := []struct {
+		name, from, to, want string
+	}{
+		{"unknown", "prod", "local", "unknown environment 'prod'"},
+		{"same", "local", "local", "with itself"},
+		{"two remotes", "production", "staging", "must be a local environment"},
+		{"missing path", "staging", "local", "environment 'staging' has no path 'plugins'"},
+	}
+
+	cfg.Sync = []SyncPath{{Path: "uploads"}, {Path: "plugins"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := cfg.ForPair(tt.from, tt.to)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ForPair(%s, %s) error = %v, want %q", tt.from, tt.to, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestForPairLegacyConfig(t *testing.T) {
+	cfg := &Config{
+		SSHHost:   "user@host.com",
+		Port:      "22",
+		Remote:    HostSettings{DB: "remote_db"},
+		Local:     HostSettings{DB: "local_db"},
+		DBReplace: []DBReplace{{From: "host.com", To: "host.test"}},
+		Sync:      []SyncPath{{Remote: "/r", Local: "/l"}},
+	}
+
+	pair, reverse, err := cfg.ForPair("local", "remote")
+	if err != nil {
+		t.Fatalf("ForPair() error: %v", err)
+	}
+	if !reverse || pair.SSHHost != cfg.SSHHost || !reflect.DeepEqual(pair.DBReplace, cfg.DBReplace) || !reflect.DeepEqual(pair.Sync, cfg.Sync) {
+		t.Errorf("legacy config was not passed through: %+v (reverse=%v)", pair, reverse)
+	}
+}
+
+func TestDefaultEnvironment(t *testing.T) {
+	cfg := testEnvironmentsConfig()
+
+	if got, err := cfg.DefaultEnvironment(true); err != nil || got != "local" {
+		t.Errorf("DefaultEnvironment(local) = %q, %v", got, err)
+	}
+	if _, err := cfg.DefaultEnvironment(false); err == nil || !strings.Contains(err.Error(), "production, staging") {
+		t.Errorf("DefaultEnvironment(remote) error = %v", err)
+	}
+}
+
+func TestRemotePair(t *testing.T) {
+	cfg := testEnvironmentsConfig()
+
+	if !cfg.IsRemotePair("production", "staging") || cfg.IsRemotePair("production", "local") {
+		t.Fatal("IsRemotePair() misclassified environments")
+	}
+
+	pair, err := cfg.RemotePair("staging", "production")
+	if err != nil {
+		t.Fatalf("RemotePair() error: %v", err)
+	}
+
+	wantRules := []DBReplace{
+		{From: "https://staging.example.com", To: "https://example.com"},
+		{From: "staging.example.com", To: "example.com"},
+	}
+	if !reflect.DeepEqual(pair.DBReplace, wantRules) {
+		t.Errorf("DBReplace = %v, want %v", pair.DBReplace, wantRules)
+	}
+
+	wantSync := []SyncPath{{Remote: "/srv/staging/uploads", Local: "/srv/prod/uploads", Path: "uploads"}}
+	if !reflect.DeepEqual(pair.Sync, wantSync) {
+		t.Errorf("Sync = %v, want %v", pair.Sync, wantSync)
+	}
+
+	if _, err := cfg.RemotePair("production", "local"); err == nil {
+		t.Error("RemotePair() accepted a local environment")
+	}
+}
+
+func TestEnvironmentSSHSettings(t *testing.T) {
+	cfg := testEnvironmentsConfig()
+	cfg.SSH = SSHSettings{IdentityFile: "~/.ssh/deploy", Options: []string{"ServerAliveInterval=30"}}
+	cfg.Environments["production"].SSH = SSHSettings{
+		JumpHosts:             []string{"bastion"},
+		StrictHostKeyChecking: "yes",
+		Options:               []string{"ServerAliveInterval=10"},
+	}
+
+	pair, _, err := cfg.ForPair("production", "local")
+	if err != nil {
+		t.Fatalf("ForPair() error: %v", err)
+	}
+	want := SSHSettings{
+		IdentityFile:          "~/.ssh/deploy",
+		JumpHosts:             []string{"bastion"},
+		StrictHostKeyChecking: "yes",
+		Options:               []string{"ServerAliveInterval=10", "ServerAliveInterval=30"},
+	}
+	if !reflect.DeepEqual(pair.SSH, want) {
+		t.Errorf("SSH = %+v, want %+v", pair.SSH, want)
+	}
+
+	remote, err := cfg.RemotePair("staging", "production")
+	if err != nil {
+		t.Fatalf("RemotePair() error: %v", err)
+	}
+	if !reflect.DeepEqual(remote.From.SSH, cfg.SSH) || !reflect.DeepEqual(remote.To.SSH, want) {
+		t.Errorf("RemotePair() SSH = %+v and %+v", remote.From.SSH, remote.To.SSH)
+	}
+	if len(cfg.Environments["production"].SSH.Options) != 1 {
+		t.Error("resolving an environment changed the config")
+	}
+}
+
+func TestValidateSSH(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		top  SSHSettings
+		env  SSHSettings
+		want string
+	}{
+		{name: "client", top: SSHSettings{Client: "putty"}, want: "ssh: unknown client"},
+		{name: "policy", top: SSHSettings{StrictHostKeyChecking: "maybe"}, want: "ssh: unknown strictHostKeyChecking"},
+		{name: "option", env: SSHSettings{Options: []string{"Compression"}}, want: "environments.production.ssh: option"},
+		{name: "client per environment", env: SSHSettings{Client: sshClientSystem}, want: "environments.production.ssh: client"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testEnvironmentsConfig()
+			cfg.SSH = tt.top
+			cfg.Environments["production"].SSH = tt.env
+			if err := cfg.validateSSH(); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("validateSSH() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Command is an external command and the streams connected to it. Unset
+// streams are discarded (or, for Stdin, empty).
+type Command struct {
+	Args   []string // the program and its arguments
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// String renders the command line as a shell would read it.
+func (c Command) String() string {
+	quoted := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Executor runs commands somewhere: on this machine or on an SSH host.
+// Every external command dsync starts goes through one, so tests can
+// record the command lines instead of running them.
+type Executor interface {
+	// Run runs the command to completion. A command that ran but failed
+	// returns an error with an ExitCode method, like *exec.ExitError.
+	Run(ctx context.Context, cmd Command) error
+}
+
+// systemExecutor runs commands on this machine.
+type systemExecutor struct{}
+
+func (systemExecutor) Run(ctx context.Context, c Command) error {
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = c.Stdin, c.Stdout, c.Stderr
+	return cmd.Run()
+}
+
+// sshExecutor runs commands on an SSH host with the ssh client, which is
+// itself started by local.
+type sshExecutor struct {
+	local Executor
+	host  sshHost
+	// forwardAgent lets the command authenticate to further hosts with the
+	// caller's keys.
+	forwardAgent bool
+}
+
+func (s sshExecutor) Run(ctx context.Context, c Command) error {
+	c.Args = s.commandLine(c)
+	return s.local.Run(ctx, c)
+}
+
+// commandLine returns the local ssh command running c on the host. ssh
+// hands its arguments to the remote login shell as one string, so they are
+// quoted for it.
+func (s sshExecutor) commandLine(c Command) []string {
+	args := append([]string{"ssh"}, s.host.args()...)
+	if s.forwardAgent {
+		args = append(args, "-A")
+	}
+	return append(args, s.host.Host, c.String())
+}
+
+// shellCommand runs a script with sh, whatever the login shell is.
+func shellCommand(script string) Command {
+	return Command{Args: []string{"sh", "-c", script}}
+}
+
+// output runs c and returns its stdout and stderr.
+func output(ctx context.Context, x Executor, c Command) (stdout, stderr []byte, err error) {
+	var out, errOut bytes.Buffer
+	c.Stdout, c.Stderr = &out, &errOut
+	err = x.Run(ctx, c)
+	return out.Bytes(), errOut.Bytes(), err
+}
+
+// combinedOutput runs c and returns what it printed on stdout and stderr,
+// interleaved.
+func combinedOutput(ctx context.Context, x Executor, c Command) ([]byte, error) {
+	var out bytes.Buffer
+	c.Stdout, c.Stderr = &out, &out
+	err := x.Run(ctx, c)
+	return out.Bytes(), err
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingExecutor records the commands it is asked to run instead of
+// running them. respond, if set, returns what a command prints and how it
+// fails.
+type recordingExecutor struct {
+	mu       sync.Mutex
+	commands []recordedCommand
+	respond  func(c recordedCommand) (string, error)
+}
+
+type recordedCommand struct {
+	Args  []string
+	Stdin string
+}
+
+func (r *recordingExecutor) Run(ctx context.Context, c Command) error {
+	rec := recordedCommand{Args: c.Args}
+	if c.Stdin != nil {
+		stdin, err := io.ReadAll(c.Stdin)
+		if err != nil {
+			return err
+		}
+		rec.Stdin = string(stdin)
+	}
+
+	r.mu.Lock()
+	r.commands = append(r.commands, rec)
+	r.mu.Unlock()
+
+	var (
+		out string
+		err error
+	)
+	if r.respond != nil {
+		out, err = r.respond(rec)
+	}
+	if c.Stdout != nil {
+		io.WriteString(c.Stdout, out)
+	}
+	return err
+}
+
+// exitError is a command that ran and exited with a status.
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
+
+func TestSyncFilesCommandLines(t *testing.T) {
+	item := SyncPath{Remote: "/srv/www", Local: "/home/me/www", Exclude: []string{"cache/", "*.log"}}
+
+	tests := []struct {
+		name string
+		port string
+		ssh  SSHSettings
+		opts SyncOptions
+		want []string
+	}{
+		{
+			name: "pull",
+			want: []string{"rsync", "-azr", "-e", "ssh", "--info=progress2", "--exclude=cache/", "--exclude=*.log", "user@host:/srv/www/", "/home/me/www/"},
+		},
+		{
+			name: "pull with port",
+			port: "2222",
+			want: []string{"rsync", "-azr", "-e", "ssh -p 2222", "--info=progress2", "--exclude=cache/", "--exclude=*.log", "user@host:/srv/www/", "/home/me/www/"},
+		},
+		{
+			name: "push",
+			port: "2222",
+			opts: SyncOptions{Reverse: true},
+			want: []string{"rsync", "-azr", "-e", "ssh -p 2222", "--info=progress2", "--exclude=cache/", "--exclude=*.log", "/home/me/www/", "user@host:/srv/www/"},
+		},
+		{
+			name: "ssh options",
+			ssh: SSHSettings{
+				IdentityFile:          "/keys/deploy key",
+				JumpHosts:             []string{"bastion", "admin@gate:2200"},
+				StrictHostKeyChecking: "accept-new",
+				Options:               []string{"ServerAliveInterval=30"},
+			},
+			want: []string{"rsync", "-azr", "-e",
+				"ssh -i '/keys/deploy key' -J bastion,admin@gate:2200 -o StrictHostKeyChecking=accept-new -o ServerAliveInterval=30",
+				"--info=progress2", "--exclude=cache/", "--exclude=*.log", "user@host:/srv/www/", "/home/me/www/"},
+		},
+		{
+			name: "dry run",
+			opts: SyncOptions{DryRun: true},
+			want: []string{"rsync", "-azr", "-e", "ssh", "--dry-run", "--itemize-changes", "--exclude=cache/", "--exclude=*.log", "user@host:/srv/www/", "/home/me/www/"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := &recordingExecutor{}
+			cfg := &Config{SSHHost: "user@host", Port: tt.port, SSH: tt.ssh, Sync: []SyncPath{item}}
+			if err := SyncFiles(context.Background(), x, cfg, tt.opts); err != nil {
+				t.Fatalf("SyncFiles() error: %v", err)
+			}
+			if len(x.commands) != 1 || !slices.Equal(x.commands[0].Args, tt.want) {
+				t.Errorf("ran %q\nwant %q", x.commands, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncFilesBetweenCommandLine(t *testing.T) {
+	x := &recordingExecutor{respond: func(recordedCommand) (string, error) {
+		return "rsync: link_stat failed\n", exitError(23)
+	}}
+	pair := &RemotePair{
+		FromName: "production",
+		ToName:   "staging",
+		From:     &Environment{SSHHost: "deploy@prod", Port: "2200"},
+		To: &Environment{SSHHost: "deploy@stage", Port: "2201", SSH: SSHSettings{
+			IdentityFile: "~/.ssh/stage",
+			Options:      []string{"ConnectTimeout=5"},
+		}},
+		Sync: []SyncPath{{Remote: "/srv/prod", Local: "/srv/stage", Exclude: []string{"*.log"}}},
+	}
+
+	err := SyncFilesBetween(context.Background(), x, pair, SyncOptions{})
+	var rsyncErr *RsyncError
+	if !errors.As(err, &rsyncErr) || rsyncErr.Code != 23 {
+		t.Errorf("expected an *RsyncError with code 23, got %v", err)
+	}
+
+	want := []string{"ssh", "-p", "2200", "-A", "deploy@prod",
+		"rsync -azr -e 'ssh -p 2201 -o ConnectTimeout=5' --info=progress2 '--exclude=*.log' /srv/prod/ deploy@stage:/srv/stage/"}
+	if len(x.commands) != 1 || !slices.Equal(x.commands[0].Args, want) {
+		t.Errorf("ran %q\nwant %q", x.commands, want)
+	}
+}
+
+func TestRealDBProviderCommands(t *testing.T) {
+	cfg := &Config{
+		SSHHost:     "user@host",
+		Port:        "2222",
+		Remote:      HostSettings{DB: "shop", Password: "pw"},
+		Local:       HostSettings{DB: "shop_local", Exec: &LocalExec{Type: execDocker, Container: "db"}},
+		Compression: CompressionSettings{Codec: codecNone},
+		Snapshots:   SnapshotSettings{Disabled: true},
+		SSH:         SSHSettings{Client: sshClientSystem},
+	}
+	cfg.applyDefaults()
+
+	x := &recordingExecutor{respond: func(c recordedCommand) (string, error) {
+		if strings.Contains(c.Args[len(c.Args)-1], "mariadb-dump") {
+			return "INSERT INTO `t` VALUES ('http://host.com');\n", nil
+		}
+		if strings.Contains(c.Args[len(c.Args)-1], "echo none") {
+			return "none\n", nil
+		}
+		return "", nil
+	}}
+	p := &RealDBProvider{cfg: cfg, exec: x}
+
+	var dump strings.Builder
+	if err := p.DumpRemote(context.Background(), &dump); err != nil {
+		t.Fatalf("DumpRemote() error: %v", err)
+	}
+	if err := p.WriteLocal(context.Background(), strings.NewReader("SELECT 1;\n")); err != nil {
+		t.Fatalf("WriteLocal() error: %v", err)
+	}
+	if err := p.BackupRemote(context.Background()); err != nil {
+		t.Fatalf("BackupRemote() error: %v", err)
+	}
+	if err := p.WriteRemote(context.Background(), strings.NewReader("SELECT 2;\n")); err != nil {
+		t.Fatalf("WriteRemote() error: %v", err)
+	}
+
+	if !strings.HasPrefix(dump.String(), "INSERT INTO") {
+		t.Errorf("DumpRemote() wrote %q", dump.String())
+	}
+
+	tests := []struct {
+		prefix []string
+		script string // in the last argument
+		stdin  string
+	}{
+		{[]string{"ssh", "-p", "2222", "user@host"}, "mariadb-dump", "password=\"pw\""},
+		{[]string{"docker", "exec", "-i", "db", "sh", "-c"}, "", "CREATE DATABASE IF NOT EXISTS `shop_local`"},
+		{[]string{"docker", "exec", "-i", "db", "sh", "-c"}, "mariadb", "SELECT 1;\n"},
+		{[]string{"ssh", "-p", "2222", "user@host"}, "> shop_backup_", "[client]"},
+		{[]string{"ssh", "-p", "2222", "user@host"}, "echo none", ""},
+		{[]string{"ssh", "-p", "2222", "user@host"}, "mariadb", "SELECT 2;\n"},
+	}
+	if len(x.commands) != len(tests) {
+		t.Fatalf("ran %d commands, want %d: %q", len(x.commands), len(tests), x.commands)
+	}
+	for i, tt := range tests {
+		c := x.commands[i]
+		if len(c.Args) != len(tt.prefix)+1 || !slices.Equal(c.Args[:len(tt.prefix)], tt.prefix) {
+			t.Errorf("command %d = %q, want it to start with %q", i, c.Args, tt.prefix)
+			continue
+		}
+		if !strings.Contains(c.Args[len(c.Args)-1], tt.script) || !strings.Contains(c.Stdin, tt.stdin) {
+			t.Errorf("command %d = %q with stdin %q, want %q and stdin %q", i, c.Args, c.Stdin, tt.script, tt.stdin)
+		}
+	}
+	if ssh := x.commands[0].Args[4]; !strings.HasPrefix(ssh, "sh -c '") {
+		t.Errorf("remote command not run with sh: %s", ssh)
+	}
+}
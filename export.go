@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pterm/pterm"
+)
+
+// dbFileOptions are the options of db export and db import, which move a
+// database between an environment and a file instead of another
+// environment.
+type dbFileOptions struct {
+	// Env is the environment exported, or imported into.
+	Env string
+	// Peer selects the replacements: an export applies those of a sync
+	// from Env into Peer, an import those of a sync from Peer into Env.
+	Peer string
+	// Replace are rules applied instead of a Peer's, in order.
+	Replace []DBReplace
+	// Tables filters what is exported, on top of the configured filters.
+	Tables TableFilter
+	// NoAnonymize exports personal data as is. Exports are anonymized by
+	// default, since the file ends up on this machine.
+	NoAnonymize     bool
+	DryRun          bool
+	FailOnUnmatched bool
+}
+
+// parseReplaceFlags parses rules given on the command line as from=to.
+func parseReplaceFlags(values []string) ([]DBReplace, error) {
+	var rules []DBReplace
+	for _, v := range values {
+		from, to, ok := strings.Cut(v, "=")
+		if !ok || from == "" {
+			return nil, fmt.Errorf("replacement '%s' is not of the form from=to", v)
+		}
+		rules = append(rules, DBReplace{From: from, To: to})
+	}
+	return rules, nil
+}
+
+// fileReplacer returns the replacer for a dump of environment from loaded
+// into environment to, where one of them is a file: the explicit rules if
+// any, otherwise those of a sync between the two, or none without a peer.
+func (c *Config) fileReplacer(opts dbFileOptions, from, to string) (*Replacer, error) {
+	if len(opts.Replace) > 0 {
+		if opts.Peer != "" {
+			return nil, errors.New("replacements cannot be given together with an environment to take them from")
+		}
+		return NewReplacer(opts.Replace), nil
+	}
+	if opts.Peer == "" {
+		return NewReplacer(nil), nil
+	}
+	return c.restoreReplacer(from, to)
+}
+
+// exportDB streams the database of opts.Env, with the replacements applied,
+// into w, which label names in messages. Nothing is backed up or imported.
+func (c *Config) exportDB(ctx context.Context, opts dbFileOptions, w io.Writer, label string) error {
+	env, err := c.environment(opts.Env)
+	if err != nil {
+		return err
+	}
+	replacer, err := c.fileReplacer(opts, opts.Env, opts.Peer)
+	if err != nil {
+		return err
+	}
+
+	if opts.Peer != "" {
+		peer, err := c.environment(opts.Peer)
+		if err != nil {
+			return err
+		}
+		if err := checkSameDriver(env.DB, peer.DB); err != nil {
+			return err
+		}
+	}
+
+	// The file is written on this machine, so it is anonymized like a
+	// pull into it, whatever the replacements are for
+	var anonymizer *Anonymizer
+	if !opts.NoAnonymize {
+		if anonymizer, err = c.anonymizer(); err != nil {
+			return err
+		}
+	}
+	driver := env.DB.driverName()
+	if anonymizer != nil && driver == driverSQLite {
+		return errors.New("anonymization is not supported for SQLite databases; pass --no-anonymize to export it as is")
+	}
+	replacer.useDialect(driver)
+	if anonymizer != nil {
+		anonymizer.useDialect(driver)
+	}
+
+	settings := c.dbSettings()
+	settings.tables = settings.tables.merge(env.Tables).merge(opts.Tables)
+	// The file is always SQL, even for file based databases
+	settings.rawFiles = false
+	var src DBEndpoint
+	if env.IsLocal() {
+		src = newLocalDB(env.DB, settings)
+	} else {
+		src = newSSHDB(env, settings)
+	}
+
+	spinner, _ := pterm.DefaultSpinner.Start(fmt.Sprintf("Exporting %s database '%s' to %s...", opts.Env, env.DB.DB, label))
+	err = streamDB(ctx, dbPipeline{
+		dump:       src.Dump,
+		dumpErr:    fmt.Sprintf("failed to dump %s db", opts.Env),
+		replacer:   replacer,
+		anonymizer: anonymizer,
+		write: func(ctx context.Context, r io.Reader) error {
+			_, err := io.Copy(w, r)
+			return err
+		},
+		writeErr: fmt.Sprintf("failed to write %s", label),
+	})
+	if err != nil {
+		spinner.Fail(err.Error())
+		return err
+	}
+	spinner.Success(fmt.Sprintf("Exported %s database '%s' to %s", opts.Env, env.DB.DB, label))
+
+	if anonymizer != nil {
+		reportAnonymization(anonymizer.Stats())
+	}
+	return reportReplacements(replacer.Stats(), SyncOptions{FailOnUnmatched: opts.FailOnUnmatched})
+}
+
+// importDB loads the SQL read from r, which label names in messages, into
+// the database of opts.Env with the replacements applied. The target is
+// backed up first, like in any other sync into it.
+func (c *Config) importDB(ctx context.Context, opts dbFileOptions, r io.Reader, label string) error {
+	env, err := c.environment(opts.Env)
+	if err != nil {
+		return err
+	}
+	if opts.Peer != "" {
+		peer, err := c.environment(opts.Peer)
+		if err != nil {
+			return err
+		}
+		if err := checkSameDriver(peer.DB, env.DB); err != nil {
+			return err
+		}
+	}
+	replacer, err := c.fileReplacer(opts, opts.Peer, opts.Env)
+	if err != nil {
+		return err
+	}
+
+	t := dbTransfer{
+		source:   "file",
+		target:   opts.Env,
+		driver:   env.DB.driverName(),
+		sourceDB: label,
+		targetDB: env.DB.DB,
+		dump: func(ctx context.Context, w io.Writer) error {
+			sql, closeReader, err := decompressReader(r)
+			if err != nil {
+				return fmt.Errorf("failed to decompress %s: %w", label, err)
+			}
+			defer closeReader()
+			_, err = io.Copy(w, sql)
+			return err
+		},
+		replacer: replacer,
+		dumpPath: "db.sql",
+	}
+	if env.IsLocal() {
+		dst := newLocalDB(env.DB, c.dbSettings())
+		t.write, t.backup = dst.Write, dst.Backup
+		if t.anonymizer, err = c.anonymizer(); err != nil {
+			return err
+		}
+	} else {
+		dst := newSSHDB(env, c.dbSettings())
+		t.write, t.backup = dst.Write, dst.Backup
+	}
+
+	return transferDB(ctx, t, SyncOptions{DryRun: opts.DryRun, FailOnUnmatched: opts.FailOnUnmatched})
+}
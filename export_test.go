@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReplaceFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    []DBReplace
+		wantErr bool
+	}{
+		{name: "none"},
+		{
+			name:   "rules in order",
+			values: []string{"https://example.com=http://example.test", "shop@example.com="},
+			want:   []DBReplace{{From: "https://example.com", To: "http://example.test"}, {From: "shop@example.com", To: ""}},
+		},
+		{name: "only the first = splits", values: []string{"a=b=c"}, want: []DBReplace{{From: "a", To: "b=c"}}},
+		{name: "no separator", values: []string{"example.com"}, wantErr: true},
+		{name: "empty from", values: []string{"=example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseReplaceFlags(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseReplaceFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseReplaceFlags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportImportSQLite(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 not installed")
+	}
+
+	// ssh runs the remote command locally, in dir like in a home directory
+	dir, bin := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte("#!/bin/sh\nfor a; do cmd=$a; done\ncd "+shellQuote(dir)+" && eval \"$cmd\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	remote, local := filepath.Join(dir, "remote.db"), filepath.Join(dir, "local.db")
+	sqlite(t, remote, "CREATE TABLE options (name TEXT, value TEXT); INSERT INTO options VALUES ('siteurl', 'http://host.com');")
+
+	cfg := &Config{
+		SSHHost:   "user@host",
+		Remote:    HostSettings{Driver: driverSQLite, DB: remote},
+		Local:     HostSettings{Driver: driverSQLite, DB: local},
+		DBReplace: []DBReplace{{From: "http://host.com", To: "http://host.test"}},
+		Snapshots: SnapshotSettings{Disabled: true},
+		// The fake ssh above stands in for the host
+		SSH: SSHSettings{Client: sshClientSystem},
+	}
+	ctx := context.Background()
+
+	// Exported with the rules of a pull, compressed by extension
+	path := filepath.Join(t.TempDir(), "export.sql.gz")
+	f, err := createSQLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.exportDB(ctx, dbFileOptions{Env: legacyRemoteEnv, Peer: legacyLocalEnv}, f, path); err != nil {
+		t.Fatalf("exportDB() error: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var sql strings.Builder
+	if err := readSQLFile(path, &sql); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sql.String(), "http://host.test") || strings.Contains(sql.String(), "http://host.com") {
+		t.Errorf("export is missing the replacements:\n%s", sql.String())
+	}
+
+	// Imported with explicit rules instead
+	opts := dbFileOptions{Env: legacyLocalEnv, Replace: []DBReplace{{From: "http://host.test", To: "http://local.test"}}}
+	in, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if err := cfg.importDB(ctx, opts, in, filepath.Base(path)); err != nil {
+		t.Fatalf("importDB() error: %v", err)
+	}
+	if got := sqlite(t, local, "SELECT value FROM options"); got != "http://local.test\n" {
+		t.Errorf("imported database holds %q", got)
+	}
+
+	// Without a peer or rules the dump is taken as is
+	var plain bytes.Buffer
+	if err := cfg.exportDB(ctx, dbFileOptions{Env: legacyRemoteEnv}, &plain, "stdout"); err != nil {
+		t.Fatalf("exportDB() error: %v", err)
+	}
+	if !strings.Contains(plain.String(), "http://host.com") {
+		t.Errorf("plain export was rewritten:\n%s", plain.String())
+	}
+
+	// Both sources of rules at once are ambiguous
+	opts = dbFileOptions{Env: legacyRemoteEnv, Peer: legacyLocalEnv, Replace: cfg.DBReplace}
+	if err := cfg.exportDB(ctx, opts, &plain, "stdout"); err == nil {
+		t.Error("exportDB() with both --to and --replace succeeded")
+	}
+}
+
+func TestExportAnonymizes(t *testing.T) {
+	// ssh runs the remote command locally, where mariadb-dump prints a row
+	bin := t.TempDir()
+	for name, script := range map[string]string{
+		"ssh":          "#!/bin/sh\nfor a; do cmd=$a; done\neval \"$cmd\"\n",
+		"mariadb-dump": "#!/bin/sh\necho \"INSERT INTO \\`users\\` (\\`id\\`, \\`email\\`) VALUES (1,'jane@host.com');\"\n",
+	} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := &Config{
+		SSHHost:   "user@host",
+		Remote:    HostSettings{DB: "shop"},
+		Local:     HostSettings{DB: "dev"},
+		Anonymize: []AnonymizeRule{{Table: "users", Column: "email", Strategy: anonymizeNull}},
+		SSH:       SSHSettings{Client: sshClientSystem},
+	}
+
+	tests := []struct {
+		name string
+		opts dbFileOptions
+		want string
+	}{
+		{name: "by default", opts: dbFileOptions{Env: legacyRemoteEnv}, want: "(1,NULL)"},
+		{name: "with explicit rules", opts: dbFileOptions{Env: legacyRemoteEnv, Replace: []DBReplace{{From: "host.com", To: "host.test"}}}, want: "(1,NULL)"},
+		{name: "opted out", opts: dbFileOptions{Env: legacyRemoteEnv, NoAnonymize: true}, want: "(1,'jane@host.com')"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := cfg.exportDB(context.Background(), tt.opts, &out, "stdout"); err != nil {
+				t.Fatalf("exportDB() error: %v", err)
+			}
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("export = %q, want it to contain %q", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Prefixes of secret references, config values read from somewhere else.
+const (
+	secretFile = "file:" // the contents of a file
+	secretCmd  = "cmd:"  // the output of a shell command
+)
+
+// secretMask replaces secrets in printed configs.
+const secretMask = "********"
+
+// configResolver expands ${VAR} and ${VAR:-default} in the string values of
+// a config and then resolves the secret fields that are secret references.
+type configResolver struct {
+	lookupEnv func(key string) (string, bool)
+	exec      Executor
+}
+
+func newConfigResolver() *configResolver {
+	return &configResolver{lookupEnv: os.LookupEnv, exec: systemExecutor{}}
+}
+
+// resolve rewrites every string value of c in place.
+func (r *configResolver) resolve(c *Config) error {
+	var e ConfigError
+	walkStrings(reflect.ValueOf(c).Elem(), "", func(at, s string) (string, error) {
+		s, err := r.expand(s)
+		if err != nil || !isSecretKey(at) {
+			// Anything else may well start with file: or cmd:, like a URL
+			// in dbReplace, and must not be read or run
+			return s, err
+		}
+		return r.secret(s)
+	}, &e)
+	return e.err()
+}
+
+// expand replaces ${VAR} with the value of the environment variable VAR,
+// and ${VAR:-default} with default if VAR is unset or empty. $${ stands for
+// a literal ${.
+func (r *configResolver) expand(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in '%s'", s)
+		}
+		name, def, hasDef := strings.Cut(s[i+2:i+end], ":-")
+		if !isEnvName(name) {
+			return "", fmt.Errorf("invalid variable name '%s'", name)
+		}
+		value, ok := r.lookupEnv(name)
+		switch {
+		case hasDef && value == "":
+			value = def
+		case !ok:
+			return "", fmt.Errorf("environment variable %s is not set (use ${%s:-default} for a default)", name, name)
+		}
+		b.WriteString(s[:i] + value)
+		s = s[i+end+1:]
+	}
+}
+
+func isEnvName(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for _, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// secret returns the value s points to if it is a secret reference, and s
+// otherwise. Like password files, a trailing newline is dropped.
+func (r *configResolver) secret(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, secretFile):
+		file := expandHome(strings.TrimPrefix(s, secretFile))
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(s, secretCmd):
+		script := strings.TrimPrefix(s, secretCmd)
+		stdout, stderr, err := output(context.Background(), r.exec, shellCommand(script))
+		if err != nil {
+			return "", fmt.Errorf("secret command '%s' failed: %s: %w", script, strings.TrimSpace(string(stderr)), err)
+		}
+		return strings.TrimRight(string(stdout), "\r\n"), nil
+	}
+	return s, nil
+}
+
+// isSecretKey reports whether the value at the JSON path at is a credential,
+// the only kind of value that may be a secret reference.
+func isSecretKey(at string) bool {
+	// The last key of the path, e.g. password for remote.password
+	switch at[strings.LastIndexByte(at, '.')+1:] {
+	case "password", "appPassword":
+		return true
+	}
+	return false
+}
+
+// masked returns a copy of c for printing, with passwords, which include
+// every value read from a secret reference, replaced by secretMask.
+func (c *Config) masked() (*Config, error) {
+	// Copied through JSON, which is all that is printed
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var out Config
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	var e ConfigError
+	walkStrings(reflect.ValueOf(&out).Elem(), "", func(at, s string) (string, error) {
+		if s != "" && isSecretKey(at) {
+			return secretMask, nil
+		}
+		return s, nil
+	}, &e)
+	return &out, e.err()
+}
+
+// walkStrings calls fn with the JSON path and value of every string in v,
+// which must be addressable, and stores what fn returns. The errors of fn
+// are collected in e under the path.
+func walkStrings(v reflect.Value, at string, fn func(at, s string) (string, error), e *ConfigError) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			walkStrings(v.Elem(), at, fn, e)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			key, ok := jsonKey(t.Field(i))
+			if !ok {
+				continue
+			}
+			fieldAt := at
+			if key != "" {
+				fieldAt = joinPath(at, key)
+			}
+			walkStrings(v.Field(i), fieldAt, fn, e)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkStrings(v.Index(i), fmt.Sprintf("%s[%d]", at, i), fn, e)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, k := range keys {
+			// Map values cannot be set in place
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(k))
+			walkStrings(elem, joinPath(at, k.String()), fn, e)
+			v.SetMapIndex(k, elem)
+		}
+	case reflect.String:
+		s, err := fn(at, v.String())
+		if err != nil {
+			e.add(at, "%v", err)
+			return
+		}
+		v.SetString(s)
+	}
+}
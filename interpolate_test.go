@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigResolverExpand(t *testing.T) {
+	env := map[string]string{"USER": "alice", "EMPTY": ""}
+	r := &configResolver{lookupEnv: func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}}
+
+	tests := []struct {
+		in, want string
+		wantErr  string
+	}{
+		{in: "/home/${USER}/www", want: "/home/alice/www"},
+		{in: "${USER}@${USER}", want: "alice@alice"},
+		{in: "${MISSING:-deploy}@host", want: "deploy@host"},
+		{in: "${EMPTY:-fallback}", want: "fallback"},
+		{in: "${EMPTY}", want: ""},
+		{in: "${MISSING:-}", want: ""},
+		{in: "$${USER} and ${USER}", want: "${USER} and alice"},
+		{in: "$HOME stays", want: "$HOME stays"},
+		{in: "${MISSING}", wantErr: "environment variable MISSING is not set"},
+		{in: "${USER", wantErr: "unterminated ${"},
+		{in: "${1X}", wantErr: "invalid variable name '1X'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := r.expand(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expand() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("expand() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigResolvesReferences(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("DSYNC_TEST_DB", "dev")
+	if err := os.WriteFile(filepath.Join(dir, "db-password"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "dsync-config.json")
+	data := `{"sshHost": "${DSYNC_TEST_USER:-deploy}@example.com",
+		"remote": {"db": "prod", "password": "file:~/db-password"},
+		"local": {"db": "${DSYNC_TEST_DB}", "appPassword": "cmd:printf 's3cret\n'"},
+		"sync": [{"remote": "/var/www/uploads", "local": "${HOME}/www/uploads", "exclude": ["cmd:touch ${HOME}/ran"]}],
+		"dbReplace": [{"from": "file:///srv/old", "to": "file:///srv/new"}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error: %v", err)
+	}
+	for _, check := range []struct{ name, got, want string }{
+		{"sshHost", cfg.SSHHost, "deploy@example.com"},
+		{"remote.password", cfg.Remote.Password, "hunter2"},
+		{"local.db", cfg.Local.DB, "dev"},
+		{"local.appPassword", cfg.Local.AppPassword, "s3cret"},
+		{"sync[0].local", cfg.Sync[0].Local, dir + "/www/uploads"},
+		// Only credentials are secret references
+		{"sync[0].exclude[0]", cfg.Sync[0].Exclude[0], "cmd:touch " + dir + "/ran"},
+		{"dbReplace[0].from", cfg.DBReplace[0].From, "file:///srv/old"},
+	} {
+		if check.got != check.want {
+			t.Errorf("%s = %q, want %q", check.name, check.got, check.want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "ran")); err == nil {
+		t.Error("a cmd: exclude was run")
+	}
+
+	masked, err := cfg.masked()
+	if err != nil {
+		t.Fatalf("masked() error: %v", err)
+	}
+	if masked.Remote.Password != secretMask || masked.Local.AppPassword != secretMask || masked.Local.DB != "dev" {
+		t.Errorf("masked() = %+v and %+v", masked.Remote, masked.Local)
+	}
+	if cfg.Remote.Password != "hunter2" {
+		t.Error("masked() changed the config")
+	}
+
+	// Left as written when not resolved
+	raw, err := loadConfigFiles([]string{path}, false)
+	if err != nil {
+		t.Fatalf("loadConfigFiles() error: %v", err)
+	}
+	if raw.Remote.Password != "file:~/db-password" {
+		t.Errorf("unresolved remote.password = %q", raw.Remote.Password)
+	}
+}
+
+func TestLoadConfigReferenceErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dsync-config.json")
+	data := `{"sshHost": "user@example.com",
+		"remote": {"db": "${DSYNC_TEST_UNSET}", "password": "file:` + dir + `/missing"},
+		"local": {"db": "dev", "password": "cmd:exit 3"}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadConfig(path)
+	if err == nil {
+		t.Fatal("LoadConfig() succeeded")
+	}
+	for _, want := range []string{
+		"3 problems",
+		"local.password: secret command 'exit 3' failed",
+		"remote.db: environment variable DSYNC_TEST_UNSET is not set",
+		"remote.password: failed to read secret",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadConfig() error = %v, want it to mention %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Ways of reaching the local database's client tools, selected with
+// LocalExec.Type.
+const (
+	execDockerCompose = "docker-compose"
+	execPodmanCompose = "podman-compose"
+	execDocker        = "docker"
+	execPodman        = "podman"
+	execHost          = "host"
+)
+
+// LocalExec configures where the client tools of a local database run: in
+// a compose service, in a container, or directly on this machine.
+type LocalExec struct {
+	// Type is docker-compose (the default), podman-compose, docker, podman
+	// or host. SQLite databases default to host.
+	Type string `json:"type,omitempty"`
+
+	// File and Project select the compose stack. File defaults to
+	// $DSYNC_COMPOSE_FILE, then ~/www/dev/docker-compose.yml.
+	File    string `json:"file,omitempty"`
+	Project string `json:"project,omitempty"`
+	// Service defaults to the driver's usual one, mariadb or postgres.
+	Service string `json:"service,omitempty"`
+
+	// Container is the container docker and podman exec into.
+	Container string `json:"container,omitempty"`
+}
+
+// localExec returns h's executor with the defaults filled in.
+func (h HostSettings) localExec() LocalExec {
+	var e LocalExec
+	if h.Exec != nil {
+		e = *h.Exec
+	}
+	service := h.driver().composeService()
+	if e.Type == "" {
+		e.Type = execDockerCompose
+		if service == "" && e.Service == "" {
+			e.Type = execHost
+		}
+	}
+	if e.Type != execDockerCompose && e.Type != execPodmanCompose {
+		return e
+	}
+	if e.File == "" {
+		e.File = getComposeFilePath()
+	}
+	if e.Service == "" {
+		e.Service = service
+	}
+	return e
+}
+
+// validateExec checks the executor of a local database.
+func (h HostSettings) validateExec() error {
+	e := h.localExec()
+	switch e.Type {
+	case execDockerCompose, execPodmanCompose:
+		if e.Service == "" {
+			return fmt.Errorf("exec type '%s' needs a service", e.Type)
+		}
+		return nil
+	case execHost:
+		return nil
+	case execDocker, execPodman:
+		if e.Container == "" {
+			return fmt.Errorf("exec type '%s' needs a container", e.Type)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown exec type '%s' (use docker-compose, podman-compose, docker, podman or host)", e.Type)
+}
+
+// commandLine returns the command running a shell script with e.
+func (e LocalExec) commandLine(script string) []string {
+	switch e.Type {
+	case execHost:
+		return []string{"sh", "-c", script}
+	case execDocker, execPodman:
+		return []string{e.Type, "exec", "-i", e.Container, "sh", "-c", script}
+	}
+
+	args := []string{"docker", "compose"}
+	if e.Type == execPodmanCompose {
+		args = []string{"podman-compose"}
+	}
+	args = append(args, "-f", expandHome(e.File))
+	if e.Project != "" {
+		args = append(args, "-p", e.Project)
+	}
+	return append(args, "exec", "-T", e.Service, "sh", "-c", script)
+}
+
+// String describes where e runs commands, for error messages.
+func (e LocalExec) String() string {
+	switch e.Type {
+	case execHost:
+		return "local command"
+	case execDocker, execPodman:
+		return e.Type + " exec"
+	}
+	return e.Type
+}
+
+func getComposeFilePath() string {
+	// Preserve original behavior but allow override
+	if path := os.Getenv("DSYNC_COMPOSE_FILE"); path != "" {
+		return path
+	}
+	return os.Getenv("HOME") + "/www/dev/docker-compose.yml"
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLocalExecCommandLine(t *testing.T) {
+	t.Setenv("DSYNC_COMPOSE_FILE", "/srv/compose.yml")
+
+	tests := []struct {
+		name string
+		db   HostSettings
+		want string
+	}{
+		{
+			name: "default",
+			db:   HostSettings{},
+			want: "docker compose -f /srv/compose.yml exec -T mariadb sh -c SCRIPT",
+		},
+		{
+			name: "postgres service",
+			db:   HostSettings{Driver: driverPostgres},
+			want: "docker compose -f /srv/compose.yml exec -T postgres sh -c SCRIPT",
+		},
+		{
+			name: "compose file, project and service",
+			db:   HostSettings{Exec: &LocalExec{File: "/app/compose.yml", Project: "shop", Service: "db"}},
+			want: "docker compose -f /app/compose.yml -p shop exec -T db sh -c SCRIPT",
+		},
+		{
+			name: "podman-compose",
+			db:   HostSettings{Exec: &LocalExec{Type: execPodmanCompose, Service: "db"}},
+			want: "podman-compose -f /srv/compose.yml exec -T db sh -c SCRIPT",
+		},
+		{
+			name: "docker exec",
+			db:   HostSettings{Exec: &LocalExec{Type: execDocker, Container: "shop-db-1"}},
+			want: "docker exec -i shop-db-1 sh -c SCRIPT",
+		},
+		{
+			name: "podman exec",
+			db:   HostSettings{Exec: &LocalExec{Type: execPodman, Container: "db"}},
+			want: "podman exec -i db sh -c SCRIPT",
+		},
+		{
+			name: "host",
+			db:   HostSettings{Exec: &LocalExec{Type: execHost}},
+			want: "sh -c SCRIPT",
+		},
+		{
+			name: "sqlite defaults to host",
+			db:   HostSettings{Driver: driverSQLite, DB: "app.db"},
+			want: "sh -c SCRIPT",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.db.validate(true); err != nil {
+				t.Fatalf("validate() error: %v", err)
+			}
+			if got := strings.Join(tt.db.localExec().commandLine("SCRIPT"), " "); got != tt.want {
+				t.Errorf("commandLine()\nGot:  %s\nWant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalExecValidate(t *testing.T) {
+	for _, db := range []HostSettings{
+		{Exec: &LocalExec{Type: "lxc"}},
+		{Exec: &LocalExec{Type: execDocker}},
+		{Driver: driverSQLite, Exec: &LocalExec{Type: execDockerCompose}},
+	} {
+		if err := db.validate(true); err == nil {
+			t.Errorf("invalid exec %+v accepted", *db.Exec)
+		}
+	}
+	if err := (HostSettings{Exec: &LocalExec{Type: execHost}}).validate(false); err == nil {
+		t.Error("exec accepted on a remote database")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MySQL client tools, in order of preference. MariaDB ships both names but
+// newer releases warn when the mysql* aliases are used.
+var (
+	mysqlDumpTools   = []string{"mariadb-dump", "mysqldump"}
+	mysqlClientTools = []string{"mariadb", "mysql"}
+)
+
+// mysqlDriver runs the MySQL/MariaDB client tools.
+type mysqlDriver struct {
+	h HostSettings
+}
+
+func (m mysqlDriver) dumpScript(filter TableFilter, listTables func() ([]string, error), wrap func(run string) string) (string, []byte, error) {
+	argSets := [][]string{{m.h.DB}}
+	if !filter.IsZero() {
+		tables, err := listTables()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to list tables: %w", err)
+		}
+		if argSets, err = filter.dumpArgs(m.h.DB, tables); err != nil {
+			return "", nil, err
+		}
+	}
+	return mysqlSequenceScript(m.h, mysqlDumpTools, argSets, wrap)
+}
+
+func (m mysqlDriver) loadScript(wrap func(run string) string) (string, []byte, error) {
+	return mysqlWrappedScript(m.h, mysqlClientTools, []string{m.h.DB}, wrap)
+}
+
+func (m mysqlDriver) queryScript(query string) (string, []byte, error) {
+	return mysqlScript(m.h, mysqlClientTools, []string{"-N", "-B", "-e", query}, "")
+}
+
+func (m mysqlDriver) adminScript() (string, []byte, error) {
+	return mysqlScript(m.h, mysqlClientTools, nil, "")
+}
+
+func (m mysqlDriver) listTablesQuery() string {
+	return "SHOW TABLES FROM `" + escapeIdentifier(m.h.DB) + "`"
+}
+
+func (m mysqlDriver) existsScript() (string, []byte, error) {
+	return m.queryScript(databaseExistsQuery(m.h.DB))
+}
+
+func (m mysqlDriver) ensureUserAndDBSQL() string {
+	return ensureUserAndDBQuery(m.h.DB, m.h.AppUser, m.h.AppPassword)
+}
+
+func (m mysqlDriver) composeService() string {
+	return "mariadb"
+}
+
+// mysqlScript builds a POSIX shell script that runs one of tools with the
+// connection settings from h. The settings are written to a private option
+// file which the script reads from the first bytes of its stdin, so
+// passwords never appear on a command line or in the process list. The
+// returned preamble must be sent on stdin ahead of any SQL payload.
+//
+// If stdoutPath is set, the tool's output is redirected to that file on the
+// host running the script.
+func mysqlScript(h HostSettings, tools []string, args []string, stdoutPath string) (script string, preamble []byte, err error) {
+	return mysqlWrappedScript(h, tools, args, func(run string) string {
+		if stdoutPath != "" {
+			return run + " > " + shellQuote(stdoutPath)
+		}
+		return run
+	})
+}
+
+// mysqlWrappedScript is mysqlScript with the tool's command line passed
+// through wrap, e.g. to compress what it prints.
+func mysqlWrappedScript(h HostSettings, tools []string, args []string, wrap func(run string) string) (script string, preamble []byte, err error) {
+	return mysqlSequenceScript(h, tools, [][]string{args}, wrap)
+}
+
+// mysqlSequenceScript runs the tool once per argument set, one after the
+// other, stopping at the first failure. wrap sees the whole sequence as a
+// single command.
+func mysqlSequenceScript(h HostSettings, tools []string, argSets [][]string, wrap func(run string) string) (script string, preamble []byte, err error) {
+	preamble, err = mysqlOptionFile(h)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var lookup []string
+	for _, t := range tools {
+		lookup = append(lookup, "command -v "+t)
+	}
+
+	var runs []string
+	for _, args := range argSets {
+		run := `"$tool" --defaults-extra-file="$f"`
+		for _, a := range args {
+			run += " " + shellQuote(a)
+		}
+		runs = append(runs, run)
+	}
+	run := runs[0]
+	if len(runs) > 1 {
+		run = "{ " + strings.Join(runs, " && ") + "; }"
+	}
+
+	script = strings.Join([]string{
+		"umask 077",
+		`f=$(mktemp) || exit 1`,
+		`trap 'rm -f "$f"' EXIT`,
+		fmt.Sprintf(`dd bs=1 count=%d of="$f" 2>/dev/null`, len(preamble)),
+		fmt.Sprintf(`tool=$(%s) || { echo "%s not found" >&2; exit 127; }`, strings.Join(lookup, " || "), tools[0]),
+		wrap(run),
+	}, "\n")
+
+	return script, preamble, nil
+}
+
+// mysqlOptionFile renders the [client] option group for h.
+func mysqlOptionFile(h HostSettings) ([]byte, error) {
+	password, err := h.ResolvePassword()
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	b.WriteString("[client]\n")
+	for _, opt := range []struct{ key, value string }{
+		{"user", h.User},
+		{"password", password},
+		{"host", h.Host},
+		{"port", h.Port},
+		{"socket", h.Socket},
+	} {
+		if opt.value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", opt.key, optionFileQuote(opt.value))
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+// optionFileQuote quotes a value for a MySQL option file.
+func optionFileQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// ensureUserAndDBQuery creates the database and, when appUser is set, the
+// account the site connects with.
+func ensureUserAndDBQuery(dbName, appUser, appPassword string) string {
+	query := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`;", escapeIdentifier(dbName))
+	if appUser != "" {
+		query += fmt.Sprintf(
+			" CREATE USER IF NOT EXISTS '%[1]s'@'%%' IDENTIFIED BY '%[2]s';"+
+				" GRANT ALL PRIVILEGES ON `%[3]s`.* TO '%[1]s'@'%%';",
+			escapeSQLString(appUser), escapeSQLString(appPassword), escapeIdentifier(dbName),
+		)
+	}
+	return query + "\n"
+}
+
+// databaseExistsQuery prints 1 if dbName exists and nothing otherwise.
+func databaseExistsQuery(dbName string) string {
+	return fmt.Sprintf("SELECT 1 FROM information_schema.SCHEMATA WHERE SCHEMA_NAME = '%s'", escapeSQLString(dbName))
+}
+
+func escapeIdentifier(s string) string {
+	return strings.ReplaceAll(s, "`", "``")
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-./=:@,+%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
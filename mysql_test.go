@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMySQLOptionFile(t *testing.T) {
+	t.Setenv("DSYNC_TEST_PASSWORD", `p"a\ss`)
+
+	got, err := mysqlOptionFile(HostSettings{
+		User:        "wp",
+		PasswordEnv: "DSYNC_TEST_PASSWORD",
+		Host:        "db.internal",
+		Port:        "3307",
+	})
+	if err != nil {
+		t.Fatalf("mysqlOptionFile() error: %v", err)
+	}
+
+	want := "[client]\nuser=\"wp\"\npassword=\"p\\\"a\\\\ss\"\nhost=\"db.internal\"\nport=\"3307\"\n"
+	if string(got) != want {
+		t.Errorf("mysqlOptionFile()\nGot:  %q\nWant: %q", got, want)
+	}
+}
+
+func TestResolvePassword(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pw")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		host    HostSettings
+		want    string
+		wantErr bool
+	}{
+		{"literal", HostSettings{Password: "lit", PasswordFile: file}, "lit", false},
+		{"file", HostSettings{PasswordFile: file}, "from-file", false},
+		{"missing env", HostSettings{PasswordEnv: "DSYNC_TEST_UNSET_VAR"}, "", true},
+		{"none", HostSettings{}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.host.ResolvePassword()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolvePassword() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ResolvePassword() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMySQLScriptKeepsPasswordOffCommandLine(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+
+	// A fake dump tool that prints its arguments and the option file it was given
+	bin := t.TempDir()
+	fake := "#!/bin/sh\necho \"args: $*\"\ncat \"${1#--defaults-extra-file=}\"\necho \"stdin: $(cat)\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "mariadb-dump"), []byte(fake), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	host := HostSettings{User: "admin", Password: "s3cr'et", DB: "shop db"}
+	script, preamble, err := mysqlScript(host, mysqlDumpTools, []string{host.DB}, "")
+	if err != nil {
+		t.Fatalf("mysqlScript() error: %v", err)
+	}
+	if strings.Contains(script, "s3cr") {
+		t.Fatalf("password leaked into script: %s", script)
+	}
+
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Stdin = io.MultiReader(bytes.NewReader(preamble), strings.NewReader("payload"))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("script failed: %v: %s", err, out)
+	}
+
+	for _, want := range []string{"shop db", `password="s3cr'et"`, `user="admin"`, "stdin: payload"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestEnsureUserAndDBQuery(t *testing.T) {
+	got := ensureUserAndDBQuery("my`db", "o'brien", "pw")
+	want := "CREATE DATABASE IF NOT EXISTS `my``db`; CREATE USER IF NOT EXISTS 'o\\'brien'@'%' IDENTIFIED BY 'pw'; GRANT ALL PRIVILEGES ON `my``db`.* TO 'o\\'brien'@'%';\n"
+	if got != want {
+		t.Errorf("ensureUserAndDBQuery()\nGot:  %s\nWant: %s", got, want)
+	}
+}
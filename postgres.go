@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// postgresDriver runs the PostgreSQL client tools, pg_dump and psql.
+type postgresDriver struct {
+	h HostSettings
+}
+
+// pgDumpArgs make dumps that load cleanly into a database owned by another
+// role: existing objects are dropped first and ownership and grants of the
+// source are left out.
+var pgDumpArgs = []string{"--clean", "--if-exists", "--no-owner", "--no-privileges"}
+
+// pgClientArgs make psql quiet, ignore ~/.psqlrc and stop at the first
+// error.
+var pgClientArgs = []string{"-X", "-q", "-v", "ON_ERROR_STOP=1"}
+
+func (p postgresDriver) dumpScript(filter TableFilter, listTables func() ([]string, error), wrap func(run string) string) (string, []byte, error) {
+	if err := filter.validate(); err != nil {
+		return "", nil, err
+	}
+
+	// pg_dump matches table patterns itself
+	args := append([]string(nil), pgDumpArgs...)
+	for _, t := range filter.Include {
+		args = append(args, "--table="+t)
+	}
+	for _, t := range filter.Exclude {
+		args = append(args, "--exclude-table="+t)
+	}
+	for _, t := range filter.StructureOnly {
+		args = append(args, "--exclude-table-data="+t)
+	}
+	return pgScript(p.h, "pg_dump", append(args, p.h.DB), wrap)
+}
+
+func (p postgresDriver) loadScript(wrap func(run string) string) (string, []byte, error) {
+	args := append([]string(nil), pgClientArgs...)
+	if p.h.AppUser != "" && p.h.AppUser != p.h.User {
+		// Objects are created as the app user, who then owns them
+		args = append(args, "-c", "SET ROLE "+pgQuoteIdentifier(p.h.AppUser))
+	}
+	return pgScript(p.h, "psql", append(args, "-f", "-", p.h.DB), wrap)
+}
+
+func (p postgresDriver) queryScript(query string) (string, []byte, error) {
+	args := append(append([]string(nil), pgClientArgs...), "-A", "-t", "-F", "\t", "-c", query, "postgres")
+	return pgScript(p.h, "psql", args, identity)
+}
+
+func (p postgresDriver) adminScript() (string, []byte, error) {
+	args := append(append([]string(nil), pgClientArgs...), "-f", "-", "postgres")
+	return pgScript(p.h, "psql", args, identity)
+}
+
+func (p postgresDriver) listTablesQuery() string {
+	return "SELECT tablename FROM pg_tables WHERE schemaname NOT IN ('pg_catalog', 'information_schema')"
+}
+
+func (p postgresDriver) existsScript() (string, []byte, error) {
+	return p.queryScript("SELECT 1 FROM pg_database WHERE datname = " + pgQuoteLiteral(p.h.DB))
+}
+
+// ensureUserAndDBSQL creates the app role and the database it owns. CREATE
+// DATABASE cannot run conditionally inside a statement, so the statements
+// are generated by queries and executed with psql's \gexec.
+func (p postgresDriver) ensureUserAndDBSQL() string {
+	db := pgQuoteLiteral(p.h.DB)
+	if p.h.AppUser == "" {
+		return fmt.Sprintf("SELECT format('CREATE DATABASE %%I', %[1]s) WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = %[1]s)\\gexec\n", db)
+	}
+
+	user, password := pgQuoteLiteral(p.h.AppUser), pgQuoteLiteral(p.h.AppPassword)
+	return strings.Join([]string{
+		fmt.Sprintf("SELECT format('CREATE ROLE %%I LOGIN PASSWORD %%L', %[1]s, %[2]s) WHERE NOT EXISTS (SELECT FROM pg_roles WHERE rolname = %[1]s)\\gexec", user, password),
+		fmt.Sprintf("SELECT format('CREATE DATABASE %%I OWNER %%I', %[1]s, %[2]s) WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = %[1]s)\\gexec", db, user),
+		fmt.Sprintf("SELECT format('ALTER DATABASE %%I OWNER TO %%I', %[1]s, %[2]s)\\gexec", db, user),
+		fmt.Sprintf("SELECT format('GRANT %%I TO CURRENT_USER', %[1]s) WHERE NOT pg_has_role(%[1]s, 'MEMBER')\\gexec", user),
+	}, "\n") + "\n"
+}
+
+func (p postgresDriver) composeService() string {
+	return "postgres"
+}
+
+// pgScript builds a POSIX shell script that runs tool with the connection
+// settings from h. Like mysqlScript, the password travels in a private
+// file read from the first bytes of stdin (a pgpass file here); the other
+// settings are not secret and are passed as PG* environment variables.
+func pgScript(h HostSettings, tool string, args []string, wrap func(run string) string) (script string, preamble []byte, err error) {
+	password, err := h.ResolvePassword()
+	if err != nil {
+		return "", nil, err
+	}
+	preamble = []byte("*:*:*:*:" + pgPassQuote(password) + "\n")
+
+	env := []string{`PGPASSFILE="$f"`}
+	host := h.Host
+	if host == "" {
+		// A directory in PGHOST is where the server's socket lives
+		host = h.Socket
+	}
+	for _, v := range []struct{ key, value string }{
+		{"PGHOST", host},
+		{"PGPORT", h.Port},
+		{"PGUSER", h.User},
+	} {
+		if v.value != "" {
+			env = append(env, v.key+"="+shellQuote(v.value))
+		}
+	}
+
+	run := tool
+	for _, a := range args {
+		run += " " + shellQuote(a)
+	}
+
+	script = strings.Join([]string{
+		"umask 077",
+		`f=$(mktemp) || exit 1`,
+		`trap 'rm -f "$f"' EXIT`,
+		fmt.Sprintf(`dd bs=1 count=%d of="$f" 2>/dev/null`, len(preamble)),
+		"export " + strings.Join(env, " "),
+		fmt.Sprintf(`command -v %s >/dev/null || { echo "%[1]s not found" >&2; exit 127; }`, tool),
+		wrap(run),
+	}, "\n")
+
+	return script, preamble, nil
+}
+
+// pgPassQuote escapes a field of a pgpass file.
+func pgPassQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace(s)
+}
+
+// pgQuoteLiteral quotes s as a standard conforming SQL string literal.
+func pgQuoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func pgQuoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func identity(run string) string {
+	return run
+}
+
+// parseCopyHeader reports whether the last line of sql starts a COPY block
+// as written by pg_dump, "COPY schema.table (col, ...) FROM stdin;", and
+// returns the table name without its schema and the column names.
+func parseCopyHeader(sql string) (table string, columns []string, ok bool) {
+	line := strings.TrimSuffix(sql, "\n")
+	line = line[strings.LastIndexByte(line, '\n')+1:]
+	spec, ok := strings.CutPrefix(line, "COPY ")
+	if !ok {
+		return "", nil, false
+	}
+	if spec, ok = strings.CutSuffix(spec, " FROM stdin;"); !ok {
+		return "", nil, false
+	}
+
+	name, cols, _ := strings.Cut(spec, " (")
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	for _, col := range strings.Split(strings.TrimSuffix(cols, ")"), ", ") {
+		if col != "" {
+			columns = append(columns, pgUnquoteIdentifier(col))
+		}
+	}
+	return pgUnquoteIdentifier(name), columns, true
+}
+
+// findCopyHeader returns the end of the first COPY header line in sql and
+// its table, or len(sql) if there is none.
+func findCopyHeader(sql string) (end int, table string, ok bool) {
+	for pos := 0; pos < len(sql); {
+		next := pos + lineEnd(sql[pos:])
+		if strings.HasPrefix(sql[pos:], "COPY ") {
+			if table, _, ok := parseCopyHeader(sql[pos:next]); ok {
+				return next, table, true
+			}
+		}
+		pos = next
+	}
+	return len(sql), "", false
+}
+
+// isCopyEnd reports whether line is the "\." terminating a COPY block.
+func isCopyEnd(line string) bool {
+	return strings.TrimRight(line, "\r\n") == `\.`
+}
+
+// lineEnd returns the index just past the first newline in s, or len(s).
+func lineEnd(s string) int {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return i + 1
+	}
+	return len(s)
+}
+
+// decodeCopyField decodes a field of COPY's text format, where \N is NULL.
+func decodeCopyField(f string) (value string, null bool) {
+	if f == `\N` {
+		return "", true
+	}
+	if !strings.Contains(f, `\`) {
+		return f, false
+	}
+
+	var b strings.Builder
+	b.Grow(len(f))
+	for i := 0; i < len(f); i++ {
+		c := f[i]
+		if c != '\\' || i+1 == len(f) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = f[i]; {
+		case c == 'b':
+			b.WriteByte('\b')
+		case c == 'f':
+			b.WriteByte('\f')
+		case c == 'n':
+			b.WriteByte('\n')
+		case c == 'r':
+			b.WriteByte('\r')
+		case c == 't':
+			b.WriteByte('\t')
+		case c == 'v':
+			b.WriteByte('\v')
+		case c >= '0' && c <= '7':
+			// Up to three octal digits
+			n, j := 0, i
+			for ; j < len(f) && j < i+3 && f[j] >= '0' && f[j] <= '7'; j++ {
+				n = n*8 + int(f[j]-'0')
+			}
+			b.WriteByte(byte(n))
+			i = j - 1
+		case c == 'x' && i+1 < len(f) && isHexDigit(f[i+1]):
+			// Up to two hex digits
+			n, j := 0, i+1
+			for ; j < len(f) && j < i+3 && isHexDigit(f[j]); j++ {
+				n = n*16 + hexValue(f[j])
+			}
+			b.WriteByte(byte(n))
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), false
+}
+
+// encodeCopyField encodes a value for COPY's text format the way pg_dump
+// does.
+func encodeCopyField(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + len(s)/8)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\v':
+			b.WriteString(`\v`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func hexValue(c byte) int {
+	switch {
+	case c >= 'a':
+		return int(c-'a') + 10
+	case c >= 'A':
+		return int(c-'A') + 10
+	}
+	return int(c - '0')
+}
+
+// pgUnquoteIdentifier removes the double quotes pg_dump puts around
+// identifiers that need them.
+func pgUnquoteIdentifier(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.ReplaceAll(s[1:len(s)-1], `""`, `"`)
+	}
+	return s
+}
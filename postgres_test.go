@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const pgDump = "SET standard_conforming_strings = on;\n" +
+	"CREATE TABLE public.options (\n" +
+	"    id integer NOT NULL,\n" +
+	"    name text,\n" +
+	"    value text\n" +
+	");\n" +
+	"COPY public.options (id, name, value) FROM stdin;\n" +
+	"1\tsiteurl\thttp://host.com\n" +
+	"2\twidget\ta:1:{s:3:\"url\";s:15:\"http://host.com\";}\n" +
+	"3\tit's\tline one\\nhttp:\\\\/\\\\/host.com\\tend\n" +
+	"4\t\\N\thost.com's\n" +
+	"\\.\n" +
+	"\n" +
+	"COPY public.\"Users\" (id, \"E-mail\") FROM stdin;\n" +
+	"1\tjane@host.com\n" +
+	"\\.\n"
+
+func TestReplacerCopyBlocks(t *testing.T) {
+	r := NewReplacer([]DBReplace{{From: "http://host.com", To: "https://example.test"}})
+
+	var out strings.Builder
+	if err := r.Stream(&out, strings.NewReader(pgDump)); err != nil {
+		t.Fatalf("Stream() error: %v", err)
+	}
+
+	want := strings.NewReplacer(
+		"1\tsiteurl\thttp://host.com\n", "1\tsiteurl\thttps://example.test\n",
+		`s:15:"http://host.com"`, `s:20:"https://example.test"`,
+		`http:\\/\\/host.com`, `https:\\/\\/example.test`,
+	).Replace(pgDump)
+	if got := out.String(); got != want {
+		t.Errorf("Stream()\nGot:  %q\nWant: %q", got, want)
+	}
+
+	stats := r.Stats().Rules[0]
+	if stats.Matches != 3 || stats.Tables["options"] != 3 || stats.Escaped != 1 {
+		t.Errorf("stats = %+v, want 3 matches in options, 1 escaped", stats)
+	}
+}
+
+func TestCopyFieldRoundTrip(t *testing.T) {
+	tests := []struct {
+		field string
+		value string
+	}{
+		{`plain`, "plain"},
+		{`a\tb\nc\\d`, "a\tb\nc\\d"},
+		{`\101\x42\q`, "ABq"},
+		{`\b\f\v\r`, "\b\f\v\r"},
+	}
+	for _, tt := range tests {
+		got, null := decodeCopyField(tt.field)
+		if got != tt.value || null {
+			t.Errorf("decodeCopyField(%q) = %q, %v, want %q", tt.field, got, null, tt.value)
+		}
+		if enc, _ := decodeCopyField(encodeCopyField(got)); enc != got {
+			t.Errorf("encodeCopyField(%q) does not round trip", got)
+		}
+	}
+	if _, null := decodeCopyField(`\N`); !null {
+		t.Error(`\N not decoded as NULL`)
+	}
+}
+
+func TestParseCopyHeader(t *testing.T) {
+	table, columns, ok := parseCopyHeader("SET x;\nCOPY public.\"Users\" (id, \"E-mail\") FROM stdin;\n")
+	if !ok || table != "Users" || strings.Join(columns, "|") != "id|E-mail" {
+		t.Errorf("parseCopyHeader() = %q, %q, %v", table, columns, ok)
+	}
+	if _, _, ok := parseCopyHeader("COPY public.users TO '/tmp/x';\n"); ok {
+		t.Error("COPY TO parsed as a data block")
+	}
+}
+
+func TestAnonymizerCopyBlocks(t *testing.T) {
+	a, err := NewAnonymizer([]AnonymizeRule{
+		{Table: "options", Column: "value", Strategy: anonymizeFixed, Value: "x\ty"},
+		{Table: "Users", Strategy: anonymizeTruncate},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.useDialect(driverPostgres)
+
+	var out strings.Builder
+	if err := streamStatements(&out, strings.NewReader(pgDump), true, a.Rewrite); err != nil {
+		t.Fatalf("Rewrite() error: %v", err)
+	}
+	got := out.String()
+
+	if !strings.Contains(got, "1\tsiteurl\tx\\ty\n") || strings.Count(got, "x\\ty") != 4 {
+		t.Errorf("options.value not anonymized:\n%s", got)
+	}
+	if strings.Contains(got, "jane@host.com") || !strings.Contains(got, "COPY public.\"Users\" (id, \"E-mail\") FROM stdin;\n\\.\n") {
+		t.Errorf("Users rows not dropped:\n%s", got)
+	}
+
+	a, _ = NewAnonymizer([]AnonymizeRule{{Table: "options", Column: "email", Strategy: anonymizeNull}})
+	a.useDialect(driverPostgres)
+	if err := streamStatements(&out, strings.NewReader(pgDump), true, a.Rewrite); err == nil {
+		t.Error("missing column not reported")
+	}
+}
+
+func TestAnonymizerCopyBlocksGlob(t *testing.T) {
+	// The CREATE TABLE of a schema qualified table must not be taken for
+	// one without columns
+	a, err := NewAnonymizer([]AnonymizeRule{{Table: "*", Column: "value", Strategy: anonymizeFixed, Value: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.useDialect(driverPostgres)
+	// Up to the Users table, which has no value column
+	dump := pgDump[:strings.Index(pgDump, "\n\n")+1]
+
+	var out strings.Builder
+	if err := streamStatements(&out, strings.NewReader(dump), true, a.Rewrite); err != nil {
+		t.Fatalf("Rewrite() error: %v", err)
+	}
+	if got := out.String(); strings.Count(got, "\tx\n") != 4 {
+		t.Errorf("options.value not anonymized:\n%s", got)
+	}
+	if tables := a.Stats().Rules[0].TableNames(); len(tables) != 1 || tables[0] != "options" {
+		t.Errorf("matched tables %v, want [options]", tables)
+	}
+}
+
+func TestPostgresScripts(t *testing.T) {
+	h := HostSettings{Driver: driverPostgres, Host: "db", User: "admin", Password: `p:w\d`, DB: "shop", AppUser: "shop", AppPassword: "s'cret"}
+	drv := h.driver()
+
+	script, preamble, err := drv.dumpScript(TableFilter{Include: []string{"wp_*"}, StructureOnly: []string{"wp_sessions"}}, nil, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(preamble) != "*:*:*:*:p\\:w\\\\d\n" {
+		t.Errorf("preamble = %q", preamble)
+	}
+	for _, want := range []string{
+		`export PGPASSFILE="$f" PGHOST=db PGUSER=admin`,
+		`pg_dump --clean --if-exists --no-owner --no-privileges '--table=wp_*' --exclude-table-data=wp_sessions shop`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("dump script lacks %q:\n%s", want, script)
+		}
+	}
+
+	script, _, _ = drv.loadScript(identity)
+	if !strings.Contains(script, `psql -X -q -v ON_ERROR_STOP=1 -c 'SET ROLE "shop"' -f - shop`) {
+		t.Errorf("load script:\n%s", script)
+	}
+
+	sql := drv.ensureUserAndDBSQL()
+	for _, want := range []string{
+		"format('CREATE ROLE %I LOGIN PASSWORD %L', 'shop', 's''cret')",
+		"format('CREATE DATABASE %I OWNER %I', 'shop', 'shop') WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = 'shop')\\gexec",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("ensureUserAndDBSQL() lacks %q:\n%s", want, sql)
+		}
+	}
+}
+
+func TestSSHDBPostgres(t *testing.T) {
+	// ssh runs the remote command locally; pg_dump prints a dump and psql
+	// records its input and the password file it was given
+	bin := t.TempDir()
+	out := filepath.Join(bin, "written.sql")
+	for name, script := range map[string]string{
+		"ssh":     "#!/bin/sh\nfor a; do cmd=$a; done\neval \"$cmd\"\n",
+		"pg_dump": "#!/bin/sh\nprintf 'COPY public.t (v) FROM stdin;\\ndump\\n\\\\.\\n'\n",
+		"psql":    "#!/bin/sh\n{ cat \"$PGPASSFILE\"; cat; } > " + shellQuote(out) + "\n",
+	} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	env := &Environment{SSHHost: "user@host", DB: HostSettings{Driver: driverPostgres, Password: "pw", DB: "shop"}}
+	db := newSSHDB(env, dbSettings{compression: CompressionSettings{Codec: codecNone}, exec: systemExecutor{}})
+
+	var dump strings.Builder
+	if err := db.Dump(context.Background(), &dump); err != nil {
+		t.Fatalf("Dump() error: %v", err)
+	}
+	if dump.String() != "COPY public.t (v) FROM stdin;\ndump\n\\.\n" {
+		t.Errorf("Dump() wrote %q", dump.String())
+	}
+
+	if err := db.Write(context.Background(), strings.NewReader("SELECT 1;\n")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != "*:*:*:*:pw\nSELECT 1;\n" {
+		t.Errorf("Write() delivered %q", got)
+	}
+}
+
+func TestStreamStatementsDollarQuotes(t *testing.T) {
+	fn := []string{
+		"CREATE FUNCTION public.touch() RETURNS trigger\n",
+		"    LANGUAGE plpgsql\n",
+		"    AS $_$\n" +
+			"BEGIN\n" +
+			"  --don't touch rows of $$ or 'x'\n" +
+			"  NEW.note := $tag$it's\n$tag$ || $1; # not a comment\n" +
+			"  RETURN NEW;\n" +
+			"END;\n" +
+			"$_$;\n",
+	}
+	rest := []string{
+		"--no space, it's a comment\n",
+		"COPY public.options (id, name, value) FROM stdin;\n",
+		"1\tit's\tx\n",
+		"\\.\n",
+		"INSERT INTO public.t VALUES ('a$b', 'c');\n",
+		"INSERT INTO public.t VALUES (1);\n",
+	}
+
+	var chunks []string
+	err := streamStatements(io.Discard, strings.NewReader(strings.Join(append(fn, rest...), "")), true, func(sql string) (string, error) {
+		chunks = append(chunks, sql)
+		return sql, nil
+	})
+	if err != nil {
+		t.Fatalf("streamStatements() error: %v", err)
+	}
+	// The function body is kept in one piece, and every line after it is
+	// flushed on its own rather than held in memory
+	if want := append(fn, rest...); !reflect.DeepEqual(chunks, want) {
+		t.Errorf("chunks:\n%q\nwant:\n%q", chunks, want)
+	}
+}
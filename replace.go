@@ -0,0 +1,823 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Replacer applies DBReplace rules to a SQL dump. Values inside quoted SQL
+// string literals are unescaped first so that serialized PHP and JSON
+// payloads can be rewritten structurally instead of byte-for-byte.
+type Replacer struct {
+	rules      []DBReplace
+	pairs      []replacePair
+	singlePass bool
+
+	// Match bookkeeping: matches are held in pending until the enclosing
+	// literal or statement fragment is done, then added to stats under the
+	// table being inserted into.
+	stats   ReplaceStats
+	pending []pendingMatch
+	table   string
+	// jsonSlashes counts the enclosing JSON strings that escape slashes,
+	// each of which adds a level of escaping to what was matched.
+	jsonSlashes int
+
+	copying bool // inside the rows of a COPY ... FROM stdin block
+
+	// standardStrings is set for dumps whose string literals have no
+	// backslash escapes, only doubled quotes (PostgreSQL, SQLite).
+	standardStrings bool
+}
+
+// replacePair is one literal substitution: a rule or one of its escaped
+// variants.
+type replacePair struct {
+	old, new string
+	rule     int
+	variant  replaceVariant
+}
+
+// replaceVariant identifies which escaped form of a rule a pair matches.
+type replaceVariant int
+
+const (
+	variantPlain   replaceVariant = iota // http://
+	variantEscaped                       // http:\/\/
+	variantDouble                        // http:\\/\\/
+)
+
+type pendingMatch struct {
+	pair, n int
+	variant replaceVariant // the form found in the dump
+}
+
+// ReplaceStats reports how often each rule matched.
+type ReplaceStats struct {
+	Rules []RuleStats
+}
+
+type RuleStats struct {
+	Rule    DBReplace
+	Matches int
+	// Matches split by the form found in the dump: the value as written,
+	// with JSON-escaped slashes (\/) and with double-escaped slashes (\\/).
+	// A match inside a JSON string that escapes its slashes counts as one
+	// level more escaped than the rule variant that matched the decoded
+	// string.
+	Plain, Escaped, DoubleEscaped int
+	// Tables counts matches per table; matches outside INSERT statements
+	// are counted under "".
+	Tables map[string]int
+}
+
+// Total returns the number of matches across all rules.
+func (s ReplaceStats) Total() int {
+	total := 0
+	for _, r := range s.Rules {
+		total += r.Matches
+	}
+	return total
+}
+
+// Unmatched returns the rules that did not match anything.
+func (s ReplaceStats) Unmatched() []DBReplace {
+	var rules []DBReplace
+	for _, r := range s.Rules {
+		if r.Matches == 0 {
+			rules = append(rules, r.Rule)
+		}
+	}
+	return rules
+}
+
+// TableNames returns every table with at least one match, sorted.
+func (r RuleStats) TableNames() []string {
+	var names []string
+	for name := range r.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewReplacer returns a Replacer that applies rules one after another, so a
+// later rule also sees the output of earlier ones.
+func NewReplacer(rules []DBReplace) *Replacer {
+	r := &Replacer{rules: rules, pairs: replacePairs(rules)}
+	for _, rule := range rules {
+		r.stats.Rules = append(r.stats.Rules, RuleStats{Rule: rule, Tables: map[string]int{}})
+	}
+	return r
+}
+
+// useDialect sets how the string literals of dumps made by driver are
+// escaped.
+func (r *Replacer) useDialect(driver string) {
+	r.standardStrings = driver == driverPostgres || driver == driverSQLite
+}
+
+// Stats returns the matches counted so far.
+func (r *Replacer) Stats() ReplaceStats {
+	return r.stats
+}
+
+// NewSinglePassReplacer returns a Replacer that applies all rules in one
+// pass: text produced by one rule is never matched again, and where several
+// rules match at the same position the longest one wins. This is what
+// replacement values derived from environments need, where one value is
+// often contained in another (a domain and the site URL).
+func NewSinglePassReplacer(rules []DBReplace) *Replacer {
+	r := NewReplacer(rules)
+	r.singlePass = true
+	sort.SliceStable(r.pairs, func(i, j int) bool {
+		return len(r.pairs[i].old) > len(r.pairs[j].old)
+	})
+	return r
+}
+
+// replacePairs expands rules into the plain, JSON-escaped (e.g.
+// "http:\/\/") and double-escaped (e.g. "http:\\/\\/") forms of each.
+func replacePairs(rules []DBReplace) []replacePair {
+	var pairs []replacePair
+	for i, item := range rules {
+		if item.From == "" {
+			continue
+		}
+
+		pairs = append(pairs, replacePair{item.From, item.To, i, variantPlain})
+
+		// Handle JSON-escaped slashes (e.g. "http:\/\/")
+		fromJSON := strings.ReplaceAll(item.From, "/", `\/`)
+		toJSON := strings.ReplaceAll(item.To, "/", `\/`)
+		if fromJSON != item.From {
+			pairs = append(pairs, replacePair{fromJSON, toJSON, i, variantEscaped})
+		}
+
+		// Handle Double-escaped slashes (e.g. "http:\\/\\/")
+		fromDouble := strings.ReplaceAll(item.From, "/", `\\/`)
+		toDouble := strings.ReplaceAll(item.To, "/", `\\/`)
+		if fromDouble != item.From {
+			pairs = append(pairs, replacePair{fromDouble, toDouble, i, variantDouble})
+		}
+	}
+	return pairs
+}
+
+func ApplyDBReplacements(sql string, replacements []DBReplace) string {
+	return NewReplacer(replacements).Replace(sql)
+}
+
+// Replace rewrites a chunk of SQL. Text outside string literals (comments,
+// identifiers, keywords) only receives plain replacements. The rows of
+// PostgreSQL COPY blocks are rewritten field by field.
+func (r *Replacer) Replace(sql string) string {
+	if len(r.rules) == 0 {
+		return sql
+	}
+
+	var b strings.Builder
+	b.Grow(len(sql))
+	for sql != "" {
+		if r.copying {
+			line := sql[:lineEnd(sql)]
+			sql = sql[len(line):]
+			if isCopyEnd(line) {
+				r.copying = false
+				b.WriteString(line)
+			} else {
+				b.WriteString(r.replaceCopyRow(line))
+			}
+			continue
+		}
+
+		end, table, ok := findCopyHeader(sql)
+		b.WriteString(r.replaceSQL(sql[:end]))
+		sql = sql[end:]
+		if ok {
+			r.copying, r.table = true, table
+		}
+	}
+	return b.String()
+}
+
+// replaceSQL rewrites SQL statements, descending into string literals.
+func (r *Replacer) replaceSQL(sql string) string {
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	last := 0
+	for i := 0; i < len(sql); {
+		switch {
+		case sql[i] == '\'':
+			end := r.scanString(sql, i)
+			if end < 0 {
+				// Unterminated literal: leave the remainder to plain replacement
+				i = len(sql)
+				continue
+			}
+			b.WriteString(r.replaceCode(sql[last:i]))
+			b.WriteString(r.replaceLiteral(sql[i:end]))
+			r.commit()
+			last, i = end, end
+		case sql[i] == '`':
+			i = skipPast(sql, i+1, "`")
+		case sql[i] == '#', strings.HasPrefix(sql[i:], "-- "):
+			i = skipPast(sql, i, "\n")
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipPast(sql, i+2, "*/")
+		default:
+			i++
+		}
+	}
+	b.WriteString(r.replaceCode(sql[last:]))
+
+	return b.String()
+}
+
+// replaceCode rewrites SQL outside string literals, noting which table the
+// statement in it inserts into.
+func (r *Replacer) replaceCode(sql string) string {
+	if i := strings.LastIndex(sql, "INSERT INTO "); i >= 0 {
+		r.table = parseTableName(sql[i+len("INSERT INTO "):])
+	} else if strings.Contains(sql, ";\n") {
+		r.table = ""
+	}
+	out := r.replacePlain(sql)
+	r.commit()
+	return out
+}
+
+// parseTableName reads a possibly quoted table name from the start of s.
+func parseTableName(s string) string {
+	if s != "" && (s[0] == '`' || s[0] == '"') {
+		if end := strings.IndexByte(s[1:], s[0]); end >= 0 {
+			return s[1 : end+1]
+		}
+	}
+	if end := strings.IndexAny(s, " (\n"); end >= 0 {
+		return s[:end]
+	}
+	return s
+}
+
+// commit moves pending matches into the stats.
+func (r *Replacer) commit() {
+	for _, m := range r.pending {
+		pair := r.pairs[m.pair]
+		rule := &r.stats.Rules[pair.rule]
+		rule.Matches += m.n
+		rule.Tables[r.table] += m.n
+		switch m.variant {
+		case variantPlain:
+			rule.Plain += m.n
+		case variantEscaped:
+			rule.Escaped += m.n
+		case variantDouble:
+			rule.DoubleEscaped += m.n
+		}
+	}
+	r.pending = r.pending[:0]
+}
+
+// replaceLiteral rewrites a quoted literal, including its quotes. The literal
+// is only re-escaped when its value actually changed.
+func (r *Replacer) replaceLiteral(lit string) string {
+	if r.standardStrings {
+		value := strings.ReplaceAll(lit[1:len(lit)-1], "''", "'")
+		replaced := r.replaceValue(value)
+		if replaced == value {
+			return lit
+		}
+		return pgQuoteLiteral(replaced)
+	}
+
+	value := unescapeSQLString(lit[1 : len(lit)-1])
+	replaced := r.replaceValue(value)
+	if replaced == value {
+		return lit
+	}
+	return "'" + escapeSQLString(replaced) + "'"
+}
+
+// scanString is scanSQLString or scanStandardString, depending on the
+// dialect.
+func (r *Replacer) scanString(s string, start int) int {
+	if r.standardStrings {
+		return scanStandardString(s, start)
+	}
+	return scanSQLString(s, start)
+}
+
+// replaceCopyRow rewrites the fields of a COPY data row.
+func (r *Replacer) replaceCopyRow(line string) string {
+	body := strings.TrimSuffix(line, "\n")
+	fields := strings.Split(body, "\t")
+	changed := false
+	for i, f := range fields {
+		value, null := decodeCopyField(f)
+		if null {
+			continue
+		}
+		if replaced := r.replaceValue(value); replaced != value {
+			fields[i] = encodeCopyField(replaced)
+			changed = true
+		}
+		r.commit()
+	}
+	if !changed {
+		return line
+	}
+	return strings.Join(fields, "\t") + line[len(body):]
+}
+
+// replaceValue rewrites a single unescaped value, descending into serialized
+// PHP and JSON documents so length prefixes and escaping stay consistent.
+func (r *Replacer) replaceValue(s string) string {
+	// Matches made while a structured parse fails part-way are counted again
+	// by the fallback, so drop them
+	mark := len(r.pending)
+	if out, ok := rewriteSerialized(s, r.replaceValue); ok {
+		return out
+	}
+	r.pending = r.pending[:mark]
+	if out, ok := rewriteJSON(s, r.replaceJSONString); ok {
+		return out
+	}
+	r.pending = r.pending[:mark]
+	return r.replacePlain(s)
+}
+
+// replaceJSONString rewrites the decoded value of token, a JSON string.
+func (r *Replacer) replaceJSONString(value, token string) string {
+	if strings.Contains(token, `\/`) {
+		r.jsonSlashes++
+		defer func() { r.jsonSlashes-- }()
+	}
+	return r.replaceValue(value)
+}
+
+// found records n matches of pair i, by the form they have in the dump.
+func (r *Replacer) found(i, n int) {
+	variant := r.pairs[i].variant
+	if strings.Contains(r.pairs[i].old, "/") {
+		variant = min(variant+replaceVariant(r.jsonSlashes), variantDouble)
+	}
+	r.pending = append(r.pending, pendingMatch{i, n, variant})
+}
+
+func (r *Replacer) replacePlain(s string) string {
+	if r.singlePass {
+		return r.replaceSinglePass(s)
+	}
+	for i, p := range r.pairs {
+		if n := strings.Count(s, p.old); n > 0 {
+			r.found(i, n)
+			s = strings.ReplaceAll(s, p.old, p.new)
+		}
+	}
+	return s
+}
+
+// replaceSinglePass replaces the leftmost match of any pair, preferring the
+// longest at equal positions, and continues after the replaced text.
+func (r *Replacer) replaceSinglePass(s string) string {
+	next := make([]int, len(r.pairs))
+	found := false
+	for i, p := range r.pairs {
+		next[i] = strings.Index(s, p.old)
+		found = found || next[i] >= 0
+	}
+	if !found {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	pos := 0
+	for {
+		best := -1
+		for i, p := range r.pairs {
+			if next[i] < 0 {
+				continue
+			}
+			if next[i] < pos {
+				// The previous match overlapped this one; look further on
+				n := strings.Index(s[pos:], p.old)
+				if n < 0 {
+					next[i] = -1
+					continue
+				}
+				next[i] = pos + n
+			}
+			// Pairs are sorted longest first, so the first at a position wins
+			if best < 0 || next[i] < next[best] {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		r.found(best, 1)
+		b.WriteString(s[pos:next[best]])
+		b.WriteString(r.pairs[best].new)
+		pos = next[best] + len(r.pairs[best].old)
+	}
+	b.WriteString(s[pos:])
+
+	return b.String()
+}
+
+// scanSQLString returns the index just past the literal starting at the
+// quote at start, or -1 if the literal is not terminated.
+func scanSQLString(s string, start int) int {
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '\'':
+			if i+1 < len(s) && s[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// scanStandardString is scanSQLString for literals where a backslash is
+// an ordinary character.
+func scanStandardString(s string, start int) int {
+	for i := start + 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\'' {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return -1
+}
+
+func skipPast(s string, from int, delim string) int {
+	end := strings.Index(s[from:], delim)
+	if end < 0 {
+		return len(s)
+	}
+	return from + end + len(delim)
+}
+
+// unescapeSQLString decodes MySQL string literal escapes.
+func unescapeSQLString(s string) string {
+	if !strings.ContainsAny(s, `\'`) {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case '0':
+				b.WriteByte(0)
+			case 'b':
+				b.WriteByte('\b')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'Z':
+				b.WriteByte(0x1a)
+			case '%', '_':
+				// MySQL keeps the backslash for LIKE wildcards
+				b.WriteByte('\\')
+				b.WriteByte(s[i])
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// escapeSQLString encodes a value the same way mysqldump does.
+func escapeSQLString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + len(s)/8)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0:
+			b.WriteString(`\0`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case 0x1a:
+			b.WriteString(`\Z`)
+		case '\\', '\'', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// rewriteJSON rewrites every string token of a JSON document through replace,
+// which is given the decoded value and the token as written, keeping the
+// rest of the document byte-for-byte.
+func rewriteJSON(s string, replace func(value, token string) string) (string, bool) {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" || (trimmed[0] != '{' && trimmed[0] != '[') || !json.Valid([]byte(s)) {
+		return "", false
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	last := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != '"' {
+			continue
+		}
+
+		end := i + 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		token := s[i : end+1]
+
+		var value string
+		if err := json.Unmarshal([]byte(token), &value); err != nil {
+			return "", false
+		}
+		if replaced := replace(value, token); replaced != value {
+			b.WriteString(s[last:i])
+			b.WriteString(encodeJSONString(replaced, token))
+			last = end + 1
+		}
+		i = end
+	}
+	b.WriteString(s[last:])
+
+	return b.String(), true
+}
+
+// encodeJSONString encodes s as a JSON string, mimicking the escaping style
+// of original: escaped slashes and \u escapes are kept if original used them,
+// which is what PHP's json_encode produces by default.
+func encodeJSONString(s, original string) string {
+	escapeSlash := strings.Contains(original, `\/`)
+	escapeUnicode := strings.Contains(original, `\u`)
+
+	const hex = "0123456789abcdef"
+
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c == '/' && escapeSlash:
+			b.WriteString(`\/`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20, c > 0x7e && escapeUnicode:
+			for _, u := range utf16Units(c) {
+				b.WriteString(`\u`)
+				b.WriteByte(hex[u>>12&0xf])
+				b.WriteByte(hex[u>>8&0xf])
+				b.WriteByte(hex[u>>4&0xf])
+				b.WriteByte(hex[u&0xf])
+			}
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func utf16Units(c rune) []rune {
+	if c == utf8.RuneError || c < 0x10000 {
+		return []rune{c}
+	}
+	c -= 0x10000
+	return []rune{0xd800 + (c>>10)&0x3ff, 0xdc00 + c&0x3ff}
+}
+
+// Stream copies SQL from src to dst, applying the rules as it goes; see
+// streamStatements.
+func (r *Replacer) Stream(dst io.Writer, src io.Reader) error {
+	if len(r.rules) == 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	return streamStatements(dst, src, r.standardStrings, func(sql string) (string, error) {
+		return r.Replace(sql), nil
+	})
+}
+
+// streamStatements copies SQL from src to dst through rewrite, one statement
+// line at a time. Lines are only cut at newlines outside string literals and
+// comments, so matches never straddle a read boundary and memory use is
+// bounded by the longest line rather than the size of the dump. Each row of
+// a COPY block is handed over on its own. standardStrings is as in
+// Replacer.
+func streamStatements(dst io.Writer, src io.Reader, standardStrings bool, rewrite func(sql string) (string, error)) error {
+	br := bufio.NewReaderSize(src, 1<<20)
+	bw := bufio.NewWriterSize(dst, 1<<20)
+
+	var (
+		lex     = sqlLexer{standard: standardStrings}
+		pending []byte
+	)
+	flush := func() error {
+		out, err := rewrite(string(pending))
+		if err != nil {
+			return err
+		}
+		pending = pending[:0]
+		_, err = bw.WriteString(out)
+		return err
+	}
+	copying := false
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			pending = append(pending, line...)
+			if copying {
+				// Rows of a PostgreSQL COPY block are not SQL; each is
+				// complete at its newline
+				if line[len(line)-1] == '\n' {
+					copying = !isCopyEnd(string(pending))
+					if ferr := flush(); ferr != nil {
+						return ferr
+					}
+				}
+			} else {
+				lex.feed(line)
+				if !lex.open() {
+					_, _, copying = parseCopyHeader(string(pending))
+					if ferr := flush(); ferr != nil {
+						return ferr
+					}
+				}
+			}
+		}
+
+		switch err {
+		case nil, bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(pending) > 0 {
+				if ferr := flush(); ferr != nil {
+					return ferr
+				}
+			}
+			return bw.Flush()
+		default:
+			return err
+		}
+	}
+}
+
+// sqlLexer tracks just enough SQL lexical state to know whether a position
+// in the stream is inside a string literal, quoted identifier or comment.
+type sqlLexer struct {
+	// standard selects the PostgreSQL and SQLite rules: no backslash escapes
+	// in string literals, -- comments without a following space, no #
+	// comments and dollar-quoted strings
+	standard bool
+	state    int
+	escape   bool
+	prev     byte
+	prevPrev byte
+	dollar   []byte // the $tag$ closing the dollar-quoted string
+	matched  int    // how much of dollar was seen so far
+}
+
+const (
+	lexCode = iota
+	lexString
+	lexIdent
+	lexLineComment
+	lexBlockComment
+	lexDollarTag
+	lexDollar
+)
+
+func (l *sqlLexer) open() bool {
+	return l.state != lexCode || l.prev != '\n'
+}
+
+func (l *sqlLexer) feed(b []byte) {
+	for _, c := range b {
+		l.step(c)
+	}
+}
+
+func (l *sqlLexer) step(c byte) {
+	switch l.state {
+	case lexCode:
+		switch {
+		case c == '\'':
+			l.state = lexString
+		case c == '`':
+			l.state = lexIdent
+		case l.standard && c == '-' && l.prev == '-':
+			l.state = lexLineComment
+		case !l.standard && (c == '#' || c == ' ' && l.prev == '-' && l.prevPrev == '-'):
+			l.state = lexLineComment
+		case c == '*' && l.prev == '/':
+			l.state = lexBlockComment
+			c = 0
+		case l.standard && c == '$' && !isIdentByte(l.prev):
+			// $ within a name, like a$b, does not start a string
+			l.state = lexDollarTag
+			l.dollar = append(l.dollar[:0], c)
+		}
+	case lexString:
+		switch {
+		case l.escape:
+			l.escape = false
+		case c == '\\' && !l.standard:
+			l.escape = true
+		case c == '\'':
+			l.state = lexCode
+		}
+	case lexIdent:
+		if c == '`' {
+			l.state = lexCode
+		}
+	case lexLineComment:
+		if c == '\n' {
+			l.state = lexCode
+		}
+	case lexBlockComment:
+		if c == '/' && l.prev == '*' {
+			l.state = lexCode
+			c = 0
+		}
+	case lexDollarTag:
+		l.dollar = append(l.dollar, c)
+		switch {
+		case c == '$':
+			l.state = lexDollar
+			l.matched = 0
+		case !isIdentByte(c) || c >= '0' && c <= '9' && len(l.dollar) == 2:
+			// Not a tag after all, like the parameter $1
+			l.state = lexCode
+			l.prev = '$'
+			l.step(c)
+			return
+		}
+	case lexDollar:
+		if c != l.dollar[l.matched] {
+			l.matched = 0
+		}
+		if c == l.dollar[l.matched] {
+			l.matched++
+		}
+		if l.matched == len(l.dollar) {
+			l.state = lexCode
+			c = 0
+		}
+	}
+	l.prevPrev, l.prev = l.prev, c
+}
+
+// isIdentByte reports whether c can be part of an unquoted SQL name.
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReplacerSerializedPHP(t *testing.T) {
+	rules := []DBReplace{{From: "https://host.com", To: "http://host.test"}}
+
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{
+			name: "string length recomputed",
+			sql:  `INSERT INTO wp_options VALUES (1,'home','s:18:\"https://host.com/x\";','yes');`,
+			want: `INSERT INTO wp_options VALUES (1,'home','s:18:\"http://host.test/x\";','yes');`,
+		},
+		{
+			name: "nested array",
+			sql:  `('a:2:{s:3:\"url\";s:16:\"https://host.com\";s:4:\"list\";a:1:{i:0;s:20:\"https://host.com/img\";}}')`,
+			want: `('a:2:{s:3:\"url\";s:16:\"http://host.test\";s:4:\"list\";a:1:{i:0;s:20:\"http://host.test/img\";}}')`,
+		},
+		{
+			name: "object",
+			sql:  `('O:8:\"stdClass\":1:{s:3:\"url\";s:16:\"https://host.com\";}')`,
+			want: `('O:8:\"stdClass\":1:{s:3:\"url\";s:16:\"http://host.test\";}')`,
+		},
+		{
+			name: "broken length falls back to plain replacement",
+			sql:  `('s:99:\"https://host.com\";')`,
+			want: `('s:99:\"http://host.test\";')`,
+		},
+		{
+			name: "outside literals",
+			sql:  "-- Host: https://host.com\nINSERT INTO `t` VALUES ('https://host.com');",
+			want: "-- Host: http://host.test\nINSERT INTO `t` VALUES ('http://host.test');",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ApplyDBReplacements(tt.sql, rules); got != tt.want {
+				t.Errorf("ApplyDBReplacements()\nGot:  %s\nWant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplacerLengthChange(t *testing.T) {
+	rules := []DBReplace{{From: "https://host.com", To: "http://example.co.uk"}}
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{
+			name:  "plain serialized",
+			value: `a:1:{s:4:"home";s:18:"https://host.com/x";}`,
+			want:  `a:1:{s:4:"home";s:22:"http://example.co.uk/x";}`,
+		},
+		{
+			name:  "json escaped slashes inside serialized",
+			value: `a:1:{i:0;s:20:"https:\/\/host.com/x";}`,
+			want:  `a:1:{i:0;s:24:"http:\/\/example.co.uk/x";}`,
+		},
+		{
+			name:  "serialized inside json",
+			value: `{"opt":"a:1:{i:0;s:16:\"https:\/\/host.com\";}"}`,
+			want:  `{"opt":"a:1:{i:0;s:20:\"http:\/\/example.co.uk\";}"}`,
+		},
+		{
+			name:  "serialized inside serialized string",
+			value: `s:34:"a:1:{i:0;s:16:"https://host.com";}";`,
+			want:  `s:38:"a:1:{i:0;s:20:"http://example.co.uk";}";`,
+		},
+		{
+			name:  "json inside serialized",
+			value: `a:1:{i:0;s:26:"{"u":"https:\/\/host.com"}";}`,
+			want:  `a:1:{i:0;s:30:"{"u":"http:\/\/example.co.uk"}";}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql := "('" + escapeSQLString(tt.value) + "')"
+			want := "('" + escapeSQLString(tt.want) + "')"
+			if got := ApplyDBReplacements(sql, rules); got != want {
+				t.Errorf("ApplyDBReplacements()\nGot:  %s\nWant: %s", got, want)
+			}
+		})
+	}
+}
+
+func TestRewriteSerializedMultibyte(t *testing.T) {
+	replace := func(s string) string {
+		if s == "ä" {
+			return "abc"
+		}
+		return s
+	}
+
+	got, ok := rewriteSerialized(`a:1:{i:0;s:2:"ä";}`, replace)
+	if !ok {
+		t.Fatal("rewriteSerialized() did not recognise serialized value")
+	}
+	if want := `a:1:{i:0;s:3:"abc";}`; got != want {
+		t.Errorf("rewriteSerialized() = %s, want %s", got, want)
+	}
+}
+
+func TestRewriteSerializedRejects(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"hello",
+		`s:5:"abc";`,
+		`a:2:{i:0;s:1:"x";}`,
+		`s:3:"abc";trailing`,
+	} {
+		if _, ok := rewriteSerialized(s, func(v string) string { return v }); ok {
+			t.Errorf("rewriteSerialized(%q) unexpectedly succeeded", s)
+		}
+	}
+}
+
+func TestSQLStringEscapingRoundTrip(t *testing.T) {
+	value := "it's a \"quote\"\\ with\nnewline\r\x00\x1a"
+	if got := unescapeSQLString(escapeSQLString(value)); got != value {
+		t.Errorf("round trip = %q, want %q", got, value)
+	}
+}
+
+func TestEncodeJSONStringKeepsStyle(t *testing.T) {
+	if got := encodeJSONString("http://a/ü", `"x\/yü"`); got != `"http:\/\/a\/ü"` {
+		t.Errorf("encodeJSONString() = %s", got)
+	}
+	if got := encodeJSONString("http://a/ü", `"x/y"`); got != `"http://a/ü"` {
+		t.Errorf("encodeJSONString() = %s", got)
+	}
+}
+
+func TestReplacerStream(t *testing.T) {
+	rules := []DBReplace{{From: "https://host.com", To: "http://host.test"}}
+
+	dump := "-- it's a comment with https://host.com\n" +
+		"INSERT INTO `t` VALUES ('line\nbreak https://host.com','s:16:\\\"https://host.com\\\";');\n" +
+		"/* multi\nline 'comment' */\n" +
+		"INSERT INTO `t` VALUES ('https://host.com')"
+
+	want := ApplyDBReplacements(dump, rules)
+
+	var out strings.Builder
+	// One byte at a time forces every possible buffer boundary
+	if err := NewReplacer(rules).Stream(&out, iotest.OneByteReader(strings.NewReader(dump))); err != nil {
+		t.Fatalf("Stream() error: %v", err)
+	}
+	if out.String() != want {
+		t.Errorf("Stream()\nGot:  %q\nWant: %q", out.String(), want)
+	}
+	if strings.Contains(out.String(), "host.com") {
+		t.Errorf("Stream() left unreplaced values: %q", out.String())
+	}
+}
+
+func TestReplacerStreamLongLine(t *testing.T) {
+	rules := []DBReplace{{From: "host.com", To: "host.test"}}
+
+	// Longer than the reader buffer so lines arrive in several pieces
+	value := strings.Repeat("x", 3<<20) + "host.com"
+	dump := "INSERT INTO `t` VALUES ('" + value + "');\n"
+
+	var out strings.Builder
+	if err := NewReplacer(rules).Stream(&out, strings.NewReader(dump)); err != nil {
+		t.Fatalf("Stream() error: %v", err)
+	}
+	if !strings.HasSuffix(out.String(), "host.test');\n") {
+		t.Errorf("Stream() did not replace value split across reads")
+	}
+}
+
+func TestSinglePassReplacerDoesNotChain(t *testing.T) {
+	rules := []DBReplace{
+		{From: "example.com", To: "staging.example.com"},
+		{From: "https://example.com", To: "https://staging.example.com"},
+	}
+
+	sql := `('https://example.com/a','example.com','https:\\/\\/example.com')`
+	want := `('https://staging.example.com/a','staging.example.com','https:\\/\\/staging.example.com')`
+
+	if got := NewSinglePassReplacer(rules).Replace(sql); got != want {
+		t.Errorf("Replace()\nGot:  %s\nWant: %s", got, want)
+	}
+}
+
+func TestReplacerStats(t *testing.T) {
+	rules := []DBReplace{
+		{From: "https://host.com", To: "http://host.test"},
+		{From: "typo.com", To: "host.test"},
+	}
+
+	dump := "INSERT INTO `wp_options` VALUES ('https://host.com','s:16:\\\"https://host.com\\\";');\n" +
+		"INSERT INTO `wp_posts` VALUES ('https:\\\\/\\\\/host.com/a');\n" +
+		"INSERT INTO `wp_posts` VALUES ('{\\\"url\\\":\\\"https:\\\\/\\\\/host.com\\\"}');\n"
+
+	r := NewReplacer(rules)
+	var out strings.Builder
+	if err := r.Stream(&out, strings.NewReader(dump)); err != nil {
+		t.Fatalf("Stream() error: %v", err)
+	}
+
+	stats := r.Stats()
+	if got := stats.Rules[0].Matches; got != 4 {
+		t.Errorf("rule 0 matches = %d, want 4", got)
+	}
+	if got := stats.Rules[0].Tables; got["wp_options"] != 2 || got["wp_posts"] != 2 {
+		t.Errorf("rule 0 tables = %v", got)
+	}
+	// The JSON string matches decoded, but its slashes are escaped in the dump
+	if r := stats.Rules[0]; r.Plain != 2 || r.Escaped != 2 || r.DoubleEscaped != 0 {
+		t.Errorf("rule 0 variants = plain %d, escaped %d, double %d", r.Plain, r.Escaped, r.DoubleEscaped)
+	}
+	if got := stats.Rules[1].Matches; got != 0 {
+		t.Errorf("rule 1 matches = %d, want 0", got)
+	}
+	if got := stats.Total(); got != 4 {
+		t.Errorf("Total() = %d, want 4", got)
+	}
+	if got := stats.Unmatched(); len(got) != 1 || got[0] != rules[1] {
+		t.Errorf("Unmatched() = %v, want %v", got, rules[1:])
+	}
+}
+
+func TestReplacerStatsIgnoreFailedParse(t *testing.T) {
+	rules := []DBReplace{{From: "host.com", To: "host.test"}}
+
+	// Valid prefix, broken length further on: parsing fails after matching
+	r := NewReplacer(rules)
+	r.Replace(`('a:2:{i:0;s:8:\"host.com\";i:1;s:99:\"host.com\";}')`)
+
+	if got := r.Stats().Rules[0].Matches; got != 2 {
+		t.Errorf("matches = %d, want 2", got)
+	}
+}
+
+func TestReplacerStandardStrings(t *testing.T) {
+	for _, driver := range []string{driverPostgres, driverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			r := NewReplacer([]DBReplace{{From: "http://host.com", To: "https://example.test"}})
+			r.useDialect(driver)
+
+			sql := "INSERT INTO options VALUES(1,'C:\\dir\\','it''s http://host.com');\n" +
+				"INSERT INTO options VALUES(2,'a:1:{s:3:\"url\";s:15:\"http://host.com\";}');\n"
+			var out strings.Builder
+			if err := r.Stream(&out, strings.NewReader(sql)); err != nil {
+				t.Fatalf("Stream() error: %v", err)
+			}
+
+			want := "INSERT INTO options VALUES(1,'C:\\dir\\','it''s https://example.test');\n" +
+				"INSERT INTO options VALUES(2,'a:1:{s:3:\"url\";s:20:\"https://example.test\";}');\n"
+			if got := out.String(); got != want {
+				t.Errorf("Stream()\nGot:  %q\nWant: %q", got, want)
+			}
+			if n := r.Stats().Rules[0].Tables["options"]; n != 2 {
+				t.Errorf("counted %d matches in options, want 2", n)
+			}
+		})
+	}
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
@@ -22,6 +25,40 @@ func Execute() {
 }
 
 func newRootCmd() *cobra.Command {
+	var configPath string
+
+	rootCmd := &cobra.Command{
+		Use:   "dsync",
+		Short: fmt.Sprintf("A tool to sync files and databases between different environments version: %s", strings.TrimSpace(version)),
+		Args:  cobra.NoArgs,
+		// Sync failures are not usage errors
+		SilenceUsage: true,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if configPath == "" {
+				configPath = findConfig(".")
+			}
+		},
+	}
+	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "",
+		"Config file, JSON, JSONC, YAML or TOML by extension (default: dsync-config.json, .jsonc, .yaml, .yml or .toml, whichever exists)")
+	addLegacyFlags(rootCmd, &configPath)
+
+	rootCmd.AddCommand(newCompletionCmd())
+	rootCmd.AddCommand(newPairCmd("pull", &configPath))
+	rootCmd.AddCommand(newPairCmd("push", &configPath))
+	rootCmd.AddCommand(newDBCmd(&configPath))
+	rootCmd.AddCommand(newConfigCmd(&configPath))
+	rootCmd.AddCommand(newBackupsCmd(&configPath))
+	rootCmd.AddCommand(newRestoreLocalCmd(&configPath))
+	rootCmd.AddCommand(newVersionCmd())
+
+	return rootCmd
+}
+
+// addLegacyFlags gives the root command the flags dsync had before its
+// subcommands. They still work as they did, but are deprecated and hidden
+// from the help.
+func addLegacyFlags(rootCmd *cobra.Command, configPath *string) {
 	var (
 		syncFilesAndDB bool
 		syncFilesOnly  bool
@@ -30,69 +67,856 @@ func newRootCmd() *cobra.Command {
 		generateConfig bool
 		showVersion    bool
 		reverseSync    bool
-		configPath     string
+		dumpFile       string
 	)
 
-	rootCmd := &cobra.Command{
-		Use:   "dsync",
-		Short: fmt.Sprintf("A tool to sync files and databases between different environments version: %s", strings.TrimSpace(version)),
+	rootCmd.Flags().BoolVarP(&syncFilesAndDB, "all", "a", false, "Sync Files and Database")
+	rootCmd.Flags().BoolVarP(&syncFilesOnly, "files", "f", false, "Sync Files only")
+	rootCmd.Flags().BoolVarP(&syncDBOnly, "db", "d", false, "Sync Database only")
+	rootCmd.Flags().BoolVarP(&dumpDB, "dump", "", false, "Dump Database to file")
+	rootCmd.Flags().StringVar(&dumpFile, "dump-file", "", "File to dump the database to, compressed for .gz/.zst (implies --dump)")
+	rootCmd.Flags().BoolVarP(&generateConfig, "gen", "g", false, "Generate default config")
+	rootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "Get Version")
+	rootCmd.Flags().BoolVarP(&reverseSync, "reverse", "r", false, "Reverse sync (Local to Remote)")
+	sync := addSyncFlags(rootCmd)
+
+	for name, use := range map[string]string{
+		"all":               "use 'dsync pull' or 'dsync push'",
+		"files":             "use 'dsync pull files' or 'dsync push files'",
+		"db":                "use 'dsync pull db' or 'dsync push db'",
+		"reverse":           "use 'dsync push'",
+		"dump":              "use 'dsync db export --to <local environment> -o db.sql', or --dump with pull or push",
+		"dump-file":         "use 'dsync db export --to <local environment> -o <file>', or --dump-file with pull or push",
+		"gen":               "use 'dsync config init'",
+		"version":           "use 'dsync version'",
+		"dry-run":           "use it with pull or push",
+		"fail-unmatched":    "use it with pull or push",
+		"continue-on-error": "use it with pull or push",
+		"tables":            "use it with pull or push",
+		"exclude-tables":    "use it with pull or push",
+		"structure-only":    "use it with pull or push",
+	} {
+		rootCmd.Flags().MarkDeprecated(name, use)
+	}
+
+	rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if !(syncFilesAndDB || syncFilesOnly || syncDBOnly || dumpDB || generateConfig || showVersion) {
+			return cmd.Help()
+		}
+
+		if showVersion {
+			pterm.Println(strings.TrimSpace(version))
+			return nil
+		}
+
+		if generateConfig {
+			if err := GenerateConfig("dsync-config.json"); err != nil {
+				return err
+			}
+			pterm.Success.Println("Generated dsync-config.json")
+			return nil
+		}
+
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		defer cfg.Close()
+
+		if len(cfg.Environments) > 0 {
+			// Map the legacy flags onto the default remote/local environments
+			remote, err := cfg.DefaultEnvironment(false)
+			if err != nil {
+				return err
+			}
+			local, err := cfg.DefaultEnvironment(true)
+			if err != nil {
+				return err
+			}
+			from, to := remote, local
+			if reverseSync {
+				from, to = local, remote
+			}
+			if cfg, _, err = cfg.ForPair(from, to); err != nil {
+				return err
+			}
+		}
+
+		opts := sync.options()
+		opts.Reverse, opts.DumpDB, opts.DumpPath = reverseSync, dumpDB || dumpFile != "", dumpFile
+		cfg.Tables = cfg.Tables.merge(*sync.tables)
+		return runSync(cmd.Context(), cfg, syncFilesAndDB || syncFilesOnly, syncFilesAndDB || syncDBOnly, opts)
+	}
+}
+
+// loadConfig loads the config for a command, with the global config
+// under it, and tells which files were read.
+func loadConfig(path string) (*Config, error) {
+	files := configFiles(path)
+	cfg, err := loadConfigFiles(files, true)
+	if err != nil {
+		return nil, fmt.Errorf("error loading config file '%s': %w", describeConfigFiles(files), err)
+	}
+	pterm.Info.Printf("Using config %s\n", describeConfigFiles(files))
+	return cfg, nil
+}
+
+// describeConfigFiles names the files a config is read from for messages:
+// the project config, and the global one under it.
+func describeConfigFiles(files []string) string {
+	last := len(files) - 1
+	if last == 0 {
+		return files[0]
+	}
+	return fmt.Sprintf("%s (over %s)", files[last], strings.Join(files[:last], ", "))
+}
+
+// syncFlags are the flags shared by the commands that sync.
+type syncFlags struct {
+	dryRun        bool
+	failUnmatched bool
+	continueOnErr bool
+	tables        *TableFilter
+}
+
+func addSyncFlags(cmd *cobra.Command) *syncFlags {
+	var f syncFlags
+	cmd.Flags().BoolVarP(&f.dryRun, "dry-run", "n", false, "Show what would change without writing anything")
+	cmd.Flags().BoolVar(&f.failUnmatched, "fail-unmatched", false, "Fail when a replacement rule matches nothing")
+	cmd.Flags().BoolVar(&f.continueOnErr, "continue-on-error", false, "Keep syncing after a failed path and report all failures at the end")
+	f.tables = addTableFlags(cmd)
+	return &f
+}
+
+func (f *syncFlags) options() SyncOptions {
+	return SyncOptions{DryRun: f.dryRun, FailOnUnmatched: f.failUnmatched, ContinueOnError: f.continueOnErr}
+}
+
+// runSync syncs files and/or the database of a config in the single
+// SSHHost/Remote/Local layout. A failed file sync stops the run before the
+// database is touched unless opts.ContinueOnError is set.
+func runSync(ctx context.Context, cfg *Config, files, db bool, opts SyncOptions) error {
+	var errs []error
+
+	if files {
+		if err := SyncFiles(ctx, systemExecutor{}, cfg, opts); err != nil {
+			if !opts.ContinueOnError {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if db {
+		if err := SyncDB(ctx, NewRealDBProvider(cfg), cfg, opts); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// runRemoteSync syncs files and/or the database between two SSH
+// environments.
+func runRemoteSync(ctx context.Context, pair *RemotePair, files, db bool, opts SyncOptions) error {
+	var errs []error
+
+	if files {
+		if err := SyncFilesBetween(ctx, systemExecutor{}, pair, opts); err != nil {
+			if !opts.ContinueOnError {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if db {
+		if err := SyncDBBetween(ctx, newSSHDB(pair.From, pair.settings), newSSHDB(pair.To, pair.settings), pair, opts); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// runPair syncs between two named environments. When one of them is local,
+// command, if set, is the pull or push the direction must match.
+func runPair(ctx context.Context, cfg *Config, command, from, to string, files, db bool, tables TableFilter, opts SyncOptions) error {
+	if cfg.IsRemotePair(from, to) {
+		pair, err := cfg.RemotePair(from, to)
+		if err != nil {
+			return err
+		}
+		pair.settings.tables = pair.settings.tables.merge(tables)
+		return runRemoteSync(ctx, pair, files, db, opts)
+	}
+
+	pair, reverse, err := cfg.ForPair(from, to)
+	if err != nil {
+		return err
+	}
+	switch {
+	case command == "push" && !reverse:
+		return fmt.Errorf("push copies from a local environment, but '%s' is remote; use pull", from)
+	case command == "pull" && reverse:
+		return fmt.Errorf("pull copies into a local environment, but '%s' is remote; use push", to)
+	}
+
+	pair.Tables = pair.Tables.merge(tables)
+	opts.Reverse = reverse
+	return runSync(ctx, pair, files, db, opts)
+}
+
+// defaultPair fills in the environments a pull (or, with push, a push)
+// syncs when --from or --to is omitted.
+func defaultPair(cfg *Config, from, to *string, push bool) error {
+	var err error
+	if *from == "" {
+		if *from, err = cfg.DefaultEnvironment(push); err != nil {
+			return fmt.Errorf("--from: %w", err)
+		}
+	}
+	if *to == "" {
+		if *to, err = cfg.DefaultEnvironment(!push); err != nil {
+			return fmt.Errorf("--to: %w", err)
+		}
+	}
+	return nil
+}
+
+// newPairCmd builds the pull and push commands, which sync between two named
+// environments. pull copies into the local environment, push copies from it;
+// when both environments are remote either command copies directly between
+// them.
+func newPairCmd(name string, configPath *string) *cobra.Command {
+	var (
+		from, to string
+		dump     bool
+		dumpFile string
+		sync     *syncFlags
+	)
+
+	push := name == "push"
+	short := "Sync a remote environment into a local one"
+	if push {
+		short = "Sync a local environment to a remote one"
+	}
+
+	cmd := &cobra.Command{
+		Use:       name + " [files|db]",
+		Short:     short,
+		Long:      short + ": files and database, or only the files or only the database.",
+		Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+		ValidArgs: []string{"files", "db"},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Check if any flag is set
-			flagSet := syncFilesAndDB || syncFilesOnly || syncDBOnly || dumpDB || generateConfig || showVersion
+			cfg, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+			defer cfg.Close()
 
-			if len(args) == 0 && !flagSet {
-				return cmd.Help()
+			if err := defaultPair(cfg, &from, &to, push); err != nil {
+				return err
 			}
 
-			if showVersion {
-				pterm.Println(strings.TrimSpace(version))
-				return nil
+			// Without a selection, sync both files and database
+			files, db := true, true
+			if len(args) == 1 {
+				files, db = args[0] == "files", args[0] == "db"
 			}
 
-			if generateConfig {
-				if err := GenerateConfig("dsync-config.json"); err != nil {
+			opts := sync.options()
+			opts.DumpDB, opts.DumpPath = dump || dumpFile != "", dumpFile
+			return runPair(cmd.Context(), cfg, name, from, to, files, db, *sync.tables, opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&from, "from", "", "Environment to copy from")
+	cmd.Flags().StringVar(&to, "to", "", "Environment to copy to")
+	cmd.Flags().BoolVarP(&dump, "dump", "", false, "Also save the database dump, after replacements, to a file")
+	cmd.Flags().StringVar(&dumpFile, "dump-file", "", "File --dump saves to, compressed for .gz/.zst (implies --dump)")
+	sync = addSyncFlags(cmd)
+
+	return cmd
+}
+
+// newDBCmd builds the db command, which works with the databases of the
+// environments without syncing them.
+func newDBCmd(configPath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "db",
+		Short: "Work with environment databases",
+	}
+	cmd.AddCommand(newDBExportCmd(configPath), newDBDumpCmd(configPath), newDBImportCmd(configPath))
+	return cmd
+}
+
+// exportFlags are the flags db export shares with the deprecated db dump.
+type exportFlags struct {
+	output        string
+	failUnmatched bool
+	noAnonymize   bool
+	tables        *TableFilter
+}
+
+func addExportFlags(cmd *cobra.Command, output string) *exportFlags {
+	var f exportFlags
+	usage := "File to write, compressed for .gz/.zst (default: stdout)"
+	if output != "" {
+		usage = "File to write, compressed for .gz/.zst"
+	}
+	cmd.Flags().StringVarP(&f.output, "output", "o", output, usage)
+	cmd.Flags().BoolVar(&f.failUnmatched, "fail-unmatched", false, "Fail when a replacement rule matches nothing")
+	cmd.Flags().BoolVar(&f.noAnonymize, "no-anonymize", false, "Export personal data as is, without the anonymize rules")
+	f.tables = addTableFlags(cmd)
+	return &f
+}
+
+// toStdout reports whether the export is written to stdout.
+func (f *exportFlags) toStdout() bool {
+	return f.output == "" || f.output == "-"
+}
+
+// run exports the database opts describes to the output file, or stdout.
+func (f *exportFlags) run(cmd *cobra.Command, cfg *Config, opts dbFileOptions) error {
+	opts.Tables = *f.tables
+	opts.FailOnUnmatched = f.failUnmatched
+	opts.NoAnonymize = f.noAnonymize
+
+	if f.toStdout() {
+		return cfg.exportDB(cmd.Context(), opts, cmd.OutOrStdout(), "stdout")
+	}
+	file, err := createSQLFile(f.output)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", f.output, err)
+	}
+	if err := cfg.exportDB(cmd.Context(), opts, file, f.output); err != nil {
+		file.Close()
+		os.Remove(f.output)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.output, err)
+	}
+	return nil
+}
+
+func newDBExportCmd(configPath *string) *cobra.Command {
+	var (
+		envName, peer string
+		replace       []string
+		flags         *exportFlags
+	)
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write a database to a file or stdout",
+		Long: "Dumps the database of --env, the remote environment by default, and writes it to --output, " +
+			"compressed for .gz/.zst, or to stdout. Nothing is imported. --to applies the replacements " +
+			"of a sync into that environment; --replace gives the rules instead. The anonymize rules " +
+			"are applied unless --no-anonymize is given.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if flags.toStdout() {
+				printToStderr()
+			}
+			cfg, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+			defer cfg.Close()
+
+			rules, err := parseReplaceFlags(replace)
+			if err != nil {
+				return err
+			}
+			if envName == "" {
+				if envName, err = cfg.DefaultEnvironment(false); err != nil {
 					return err
 				}
-				pterm.Success.Println("Generated dsync-config.json")
-				return nil
 			}
+			return flags.run(cmd, cfg, dbFileOptions{Env: envName, Peer: peer, Replace: rules})
+		},
+	}
+	cmd.Flags().StringVar(&envName, "env", "", "Environment whose database is exported (default: the remote one)")
+	cmd.Flags().StringVar(&peer, "to", "", "Environment whose replacements are applied")
+	cmd.Flags().StringArrayVar(&replace, "replace", nil, "Replace from=to in the dump (repeatable)")
+	cmd.MarkFlagsMutuallyExclusive("to", "replace")
+	flags = addExportFlags(cmd, "")
+	return cmd
+}
 
-			cfg, err := LoadConfig(configPath)
+// newDBDumpCmd builds db dump, which is db export with the replacements of
+// a pull by default.
+func newDBDumpCmd(configPath *string) *cobra.Command {
+	var (
+		from, to string
+		flags    *exportFlags
+	)
+	cmd := &cobra.Command{
+		Use:        "dump",
+		Short:      "Save a database, as a sync would import it, to a file",
+		Deprecated: "use 'dsync db export --env <from> --to <to>'",
+		Args:       cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if flags.toStdout() {
+				printToStderr()
+			}
+			cfg, err := loadConfig(*configPath)
 			if err != nil {
-				return fmt.Errorf("error loading config file '%s': %w", configPath, err)
+				return err
 			}
+			defer cfg.Close()
 
-			ctx := context.Background()
-			dbProvider := NewRealDBProvider(cfg)
+			if err := defaultPair(cfg, &from, &to, false); err != nil {
+				return err
+			}
+			return flags.run(cmd, cfg, dbFileOptions{Env: from, Peer: to})
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "Environment whose database is dumped")
+	cmd.Flags().StringVar(&to, "to", "", "Environment whose replacements are applied")
+	flags = addExportFlags(cmd, "db.sql")
+	return cmd
+}
+
+func newDBImportCmd(configPath *string) *cobra.Command {
+	var (
+		envName, peer string
+		replace       []string
+		dryRun        bool
+		failUnmatched bool
+	)
+	cmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Load a .sql, .sql.gz or .sql.zst file into a database",
+		Long: "Loads a dump, or stdin for -, into the database of --env, the local environment by default, " +
+			"after backing it up. --from applies the replacements of a sync from that environment; " +
+			"--replace gives the rules instead. Local databases are anonymized like in a sync.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+			defer cfg.Close()
 
-			if syncFilesAndDB || syncFilesOnly {
-				if err := SyncFiles(ctx, cfg, reverseSync); err != nil {
+			rules, err := parseReplaceFlags(replace)
+			if err != nil {
+				return err
+			}
+			if envName == "" {
+				if envName, err = cfg.DefaultEnvironment(true); err != nil {
 					return err
 				}
 			}
+			opts := dbFileOptions{Env: envName, Peer: peer, Replace: rules, DryRun: dryRun, FailOnUnmatched: failUnmatched}
 
-			if syncFilesAndDB || syncDBOnly {
-				if err := SyncDB(ctx, dbProvider, cfg, dumpDB, reverseSync); err != nil {
+			if args[0] == "-" {
+				return cfg.importDB(cmd.Context(), opts, cmd.InOrStdin(), "stdin")
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return cfg.importDB(cmd.Context(), opts, f, filepath.Base(args[0]))
+		},
+	}
+	cmd.Flags().StringVar(&envName, "env", "", "Environment to import into (default: the local one)")
+	cmd.Flags().StringVar(&peer, "from", "", "Environment the dump was taken from, whose replacements are applied")
+	cmd.Flags().StringArrayVar(&replace, "replace", nil, "Replace from=to in the dump (repeatable)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only apply the replacements and report them")
+	cmd.Flags().BoolVar(&failUnmatched, "fail-unmatched", false, "Fail when a replacement rule matches nothing")
+	cmd.MarkFlagsMutuallyExclusive("from", "replace")
+	return cmd
+}
+
+// printToStderr sends messages to stderr, for commands writing data to
+// stdout. Spinners already do.
+func printToStderr() {
+	pterm.SetDefaultOutput(os.Stderr)
+	for _, p := range []*pterm.PrefixPrinter{&pterm.Info, &pterm.Success, &pterm.Warning, &pterm.Error} {
+		p.Writer = os.Stderr
+	}
+	pterm.DefaultSection.Writer = os.Stderr
+	pterm.DefaultTable.Writer = os.Stderr
+	pterm.DefaultBulletList.Writer = os.Stderr
+}
+
+// newConfigCmd builds the config command, which creates, checks and prints
+// the configuration file.
+func newConfigCmd(configPath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Create, validate and show the configuration",
+	}
+
+	var (
+		force  bool
+		format string
+	)
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Write a default configuration file to the --config path",
+		Long: "Writes a default configuration to the --config path, in the format of its extension. " +
+			"Without --config, --format picks the format and the file is named after it. " +
+			"JSONC, YAML and TOML files explain the settings in comments.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := *configPath
+			if format != "" {
+				name, err := configFileName(format)
+				if err != nil {
 					return err
 				}
+				if !cmd.Flags().Changed("config") {
+					path = name
+				} else if configFormat(path) != format {
+					return fmt.Errorf("--format %s does not match the extension of %s", format, path)
+				}
+			}
+			if _, err := os.Stat(path); err == nil && !force {
+				return fmt.Errorf("%s already exists; pass --force to overwrite it", path)
 			}
+			if err := GenerateConfig(path); err != nil {
+				return err
+			}
+			pterm.Success.Printf("Generated %s\n", path)
+			return nil
+		},
+	}
+	initCmd.Flags().BoolVar(&force, "force", false, "Overwrite an existing file")
+	initCmd.Flags().StringVar(&format, "format", "", "Format of the file: json, jsonc, yaml or toml (default: by the extension of --config)")
 
+	validate := &cobra.Command{
+		Use:   "validate",
+		Short: "Check the configuration file for errors",
+		Long: "Checks required fields, sync paths that would copy into the filesystem root or a home directory, " +
+			"unknown keys and replacement rules that do nothing or rewrite each other, and lists every problem " +
+			"with the path of the value in the config. Every command runs these checks when it loads the config.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			files := configFiles(*configPath)
+			cfg, err := loadConfigFiles(files, true)
+			var problems *ConfigError
+			if errors.As(err, &problems) {
+				for _, p := range problems.Problems {
+					pterm.Error.Println(p.String())
+				}
+				return fmt.Errorf("%s has %d problem(s)", describeConfigFiles(files), len(problems.Problems))
+			}
+			if err != nil {
+				return fmt.Errorf("error loading config file '%s': %w", describeConfigFiles(files), err)
+			}
+			defer cfg.Close()
+			pterm.Success.Printf("%s is valid\n", describeConfigFiles(files))
 			return nil
 		},
 	}
 
-	rootCmd.Flags().BoolVarP(&syncFilesAndDB, "all", "a", false, "Sync Files and Database")
-	rootCmd.Flags().BoolVarP(&syncFilesOnly, "files", "f", false, "Sync Files only")
-	rootCmd.Flags().BoolVarP(&syncDBOnly, "db", "d", false, "Sync Database only")
-	rootCmd.Flags().BoolVarP(&dumpDB, "dump", "", false, "Dump Database to file")
-	rootCmd.Flags().BoolVarP(&generateConfig, "gen", "g", false, "Generate default config")
-	rootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "Get Version")
-	rootCmd.Flags().BoolVarP(&reverseSync, "reverse", "r", false, "Reverse sync (Local to Remote)")
-	rootCmd.Flags().StringVarP(&configPath, "config", "c", "dsync-config.json", "Custom config path")
+	var resolved bool
+	show := &cobra.Command{
+		Use:   "show",
+		Short: "Print the configuration as dsync reads it, defaults included",
+		Long: "Prints the configuration with the defaults filled in. ${VAR} and secret references are printed " +
+			"as written unless --resolved is given, which prints their values with passwords masked.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			files := configFiles(*configPath)
+			cfg, err := loadConfigFiles(files, resolved)
+			if err != nil {
+				return fmt.Errorf("error loading config file '%s': %w", describeConfigFiles(files), err)
+			}
+			defer cfg.Close()
+			// Not on stdout, which may be redirected to a file
+			fmt.Fprintf(cmd.ErrOrStderr(), "Using config %s\n", describeConfigFiles(files))
+			if resolved {
+				if cfg, err = cfg.masked(); err != nil {
+					return fmt.Errorf("failed to mask secrets: %w", err)
+				}
+			}
+			data, err := json.MarshalIndent(cfg, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal config: %w", err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), string(data))
+			return nil
+		},
+	}
 
-	rootCmd.AddCommand(newCompletionCmd())
+	show.Flags().BoolVar(&resolved, "resolved", false, "Print the values of ${VAR} and secret references, with passwords masked")
 
-	return rootCmd
+	cmd.AddCommand(initCmd, validate, show)
+	return cmd
+}
+
+func newVersionCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Print the version",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			pterm.Println(strings.TrimSpace(version))
+		},
+	}
+}
+
+// addTableFlags registers the table filter flags on cmd. The returned filter
+// is layered over the configured one before syncing.
+func addTableFlags(cmd *cobra.Command) *TableFilter {
+	var f TableFilter
+	cmd.Flags().StringSliceVar(&f.Include, "tables", nil, "Only sync these tables (names or glob patterns)")
+	cmd.Flags().StringSliceVar(&f.Exclude, "exclude-tables", nil, "Do not sync these tables (names or glob patterns)")
+	cmd.Flags().StringSliceVar(&f.StructureOnly, "structure-only", nil, "Sync only the structure of these tables (names or glob patterns)")
+	return &f
+}
+
+// newBackupsCmd builds the backups command, which manages the backups taken
+// of remote databases before a sync overwrites them.
+func newBackupsCmd(configPath *string) *cobra.Command {
+	var envName string
+
+	cmd := &cobra.Command{
+		Use:   "backups",
+		Short: "List, restore, download and prune remote database backups",
+	}
+	cmd.PersistentFlags().StringVarP(&envName, "env", "e", "", "Remote environment the backups are on")
+
+	// load returns the config and the backup environment, by default the
+	// only remote one
+	load := func() (*Config, string, error) {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			return nil, "", err
+		}
+		name := envName
+		if name == "" {
+			if name, err = cfg.DefaultEnvironment(false); err != nil {
+				return nil, "", fmt.Errorf("--env: %w", err)
+			}
+		}
+		return cfg, name, nil
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List the backups on a remote environment",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, name, err := load()
+			if err != nil {
+				return err
+			}
+			defer cfg.Close()
+			host, err := cfg.backupHost(name)
+			if err != nil {
+				return err
+			}
+
+			backups, err := host.ListBackups(cmd.Context())
+			if err != nil {
+				return err
+			}
+			if len(backups) == 0 {
+				pterm.Info.Printf("No backups of '%s' on %s\n", host.db.DB, name)
+				return nil
+			}
+
+			_, remove := cfg.Backups.Apply(backups, time.Now())
+			pruned := map[string]bool{}
+			for _, b := range remove {
+				pruned[b.Name] = true
+			}
+
+			data := pterm.TableData{{"Backup", "Taken", "Size", "Retention"}}
+			for _, b := range backups {
+				retention := "keep"
+				if pruned[b.Name] {
+					retention = "prune"
+				}
+				data = append(data, []string{b.Name, b.Time.Format("2006-01-02 15:04:05"), formatSize(b.Size), retention})
+			}
+			return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+		},
+	}
+
+	var to string
+	restore := &cobra.Command{
+		Use:   "restore <backup>",
+		Short: "Restore a backup into its own or another environment's database",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, name, err := load()
+			if err != nil {
+				return err
+			}
+			defer cfg.Close()
+			target := to
+			if target == "" {
+				target = name
+			}
+			pterm.DefaultSection.Printf("Restoring %s into %s\n", args[0], target)
+			return cfg.restoreBackup(cmd.Context(), name, args[0], target, SyncOptions{})
+		},
+	}
+	restore.Flags().StringVar(&to, "to", "", "Environment to restore into (default: the environment the backup is on)")
+
+	var output string
+	download := &cobra.Command{
+		Use:   "download <backup>",
+		Short: "Download a backup to this machine",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, name, err := load()
+			if err != nil {
+				return err
+			}
+			defer cfg.Close()
+			host, err := cfg.backupHost(name)
+			if err != nil {
+				return err
+			}
+
+			path := output
+			if path == "" {
+				path = args[0]
+			}
+			f, err := os.Create(path)
+			if err != nil {
+				return fmt.Errorf("failed to create %s: %w", path, err)
+			}
+			defer f.Close()
+
+			spinner, _ := pterm.DefaultSpinner.Start(fmt.Sprintf("Downloading %s...", args[0]))
+			if err := host.ReadBackup(cmd.Context(), args[0], f); err != nil {
+				spinner.Fail(err.Error())
+				os.Remove(path)
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return fmt.Errorf("failed to write %s: %w", path, err)
+			}
+			spinner.Success(fmt.Sprintf("Saved %s", path))
+			return nil
+		},
+	}
+	download.Flags().StringVarP(&output, "output", "o", "", "File to save the backup to (default: the backup's name)")
+
+	var (
+		keepLast, maxAgeDays int
+		dryRun               bool
+	)
+	prune := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove backups outside the retention policy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, name, err := load()
+			if err != nil {
+				return err
+			}
+			defer cfg.Close()
+			host, err := cfg.backupHost(name)
+			if err != nil {
+				return err
+			}
+
+			policy := cfg.Backups
+			if cmd.Flags().Changed("keep-last") {
+				policy.KeepLast = keepLast
+			}
+			if cmd.Flags().Changed("max-age-days") {
+				policy.MaxAgeDays = maxAgeDays
+			}
+			if !policy.IsSet() {
+				return fmt.Errorf("no retention policy: set backups.keepLast or backups.maxAgeDays in the config, or pass --keep-last/--max-age-days")
+			}
+
+			backups, err := host.ListBackups(cmd.Context())
+			if err != nil {
+				return err
+			}
+			keep, remove := policy.Apply(backups, time.Now())
+			if len(remove) == 0 {
+				pterm.Info.Printf("Nothing to prune, keeping %d backups\n", len(keep))
+				return nil
+			}
+
+			var items []pterm.BulletListItem
+			for _, b := range remove {
+				items = append(items, pterm.BulletListItem{Level: 0, Text: b.Name, TextStyle: pterm.NewStyle(pterm.FgRed)})
+			}
+			pterm.DefaultBulletList.WithItems(items).Render()
+
+			if dryRun {
+				pterm.Info.Printf("Would remove %d backups and keep %d (dry run)\n", len(remove), len(keep))
+				return nil
+			}
+			if err := host.RemoveBackups(cmd.Context(), remove); err != nil {
+				return err
+			}
+			pterm.Success.Printf("Removed %d backups, kept %d\n", len(remove), len(keep))
+			return nil
+		},
+	}
+	prune.Flags().IntVar(&keepLast, "keep-last", 0, "Keep the newest N backups (overrides backups.keepLast)")
+	prune.Flags().IntVar(&maxAgeDays, "max-age-days", 0, "Keep backups newer than this many days (overrides backups.maxAgeDays)")
+	prune.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "Show what would be removed without removing it")
+
+	cmd.AddCommand(list, restore, download, prune)
+	return cmd
+}
+
+// newRestoreLocalCmd builds the restore-local command, which loads one of
+// the snapshots taken before the local database was overwritten.
+func newRestoreLocalCmd(configPath *string) *cobra.Command {
+	var envName string
+
+	cmd := &cobra.Command{
+		Use:   "restore-local [snapshot]",
+		Short: "Restore the local database from a snapshot, or list snapshots",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+			defer cfg.Close()
+			if envName == "" {
+				if envName, err = cfg.DefaultEnvironment(true); err != nil {
+					return fmt.Errorf("--env: %w", err)
+				}
+			}
+
+			if len(args) == 1 {
+				pterm.DefaultSection.Printf("Restoring %s into %s\n", args[0], envName)
+				return cfg.restoreSnapshot(cmd.Context(), envName, args[0])
+			}
+
+			env, err := cfg.environment(envName)
+			if err != nil {
+				return err
+			}
+			snapshots, err := cfg.Snapshots.listSnapshots(env.DB.name())
+			if err != nil {
+				return err
+			}
+			if len(snapshots) == 0 {
+				pterm.Info.Printf("No snapshots of '%s' in %s\n", env.DB.DB, cfg.Snapshots.dir())
+				return nil
+			}
+
+			data := pterm.TableData{{"Snapshot", "Taken", "Size"}}
+			for _, b := range snapshots {
+				data = append(data, []string{b.Name, b.Time.Format("2006-01-02 15:04:05"), formatSize(b.Size)})
+			}
+			pterm.Info.Printf("Snapshots in %s\n", cfg.Snapshots.dir())
+			return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+		},
+	}
+	cmd.Flags().StringVarP(&envName, "env", "e", "", "Local environment to restore into")
+
+	return cmd
 }
 
 func newCompletionCmd() *cobra.Command {
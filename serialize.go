@@ -0,0 +1,241 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// phpSerialRewriter walks a serialized PHP value and rebuilds it, passing
+// every string payload through replace and recomputing its s:N: length.
+type phpSerialRewriter struct {
+	src     string
+	pos     int
+	out     strings.Builder
+	replace func(string) string
+}
+
+// rewriteSerialized rewrites s if the whole string is a well-formed
+// serialized PHP value. It reports false when s is not serialized data or
+// when its length prefixes are already inconsistent.
+func rewriteSerialized(s string, replace func(string) string) (string, bool) {
+	if !looksSerialized(s) {
+		return "", false
+	}
+
+	p := &phpSerialRewriter{src: s, replace: replace}
+	p.out.Grow(len(s))
+	if !p.value() || p.pos != len(s) {
+		return "", false
+	}
+	return p.out.String(), true
+}
+
+func looksSerialized(s string) bool {
+	if s == "N;" {
+		return true
+	}
+	if len(s) < 4 || s[1] != ':' {
+		return false
+	}
+	switch s[0] {
+	case 'a', 'O', 'C', 's', 'i', 'd', 'b', 'E':
+		return true
+	}
+	return false
+}
+
+func (p *phpSerialRewriter) value() bool {
+	if p.pos >= len(p.src) {
+		return false
+	}
+
+	switch p.src[p.pos] {
+	case 'N':
+		return p.copyLiteral("N;")
+	case 'b', 'i', 'd', 'r', 'R':
+		return p.scalar()
+	case 's':
+		return p.str()
+	case 'E':
+		return p.enum()
+	case 'a':
+		return p.array()
+	case 'O':
+		return p.object()
+	case 'C':
+		return p.custom()
+	}
+	return false
+}
+
+// scalar copies b:, i:, d:, r: and R: values verbatim.
+func (p *phpSerialRewriter) scalar() bool {
+	if p.pos+2 > len(p.src) || p.src[p.pos+1] != ':' {
+		return false
+	}
+	end := strings.IndexByte(p.src[p.pos+2:], ';')
+	if end < 0 {
+		return false
+	}
+	end += p.pos + 2
+	p.out.WriteString(p.src[p.pos : end+1])
+	p.pos = end + 1
+	return true
+}
+
+// str rewrites s:N:"...";
+func (p *phpSerialRewriter) str() bool {
+	content, ok := p.lengthPrefixed('s', '"', '"')
+	if !ok || !p.expect(';') {
+		return false
+	}
+	p.writeString(p.replace(content))
+	return true
+}
+
+// enum copies E:N:"Class:Case"; verbatim; case names are identifiers, not data.
+func (p *phpSerialRewriter) enum() bool {
+	start := p.pos
+	if _, ok := p.lengthPrefixed('E', '"', '"'); !ok || !p.expect(';') {
+		return false
+	}
+	p.out.WriteString(p.src[start:p.pos])
+	return true
+}
+
+// array rewrites a:N:{key;value;...}.
+func (p *phpSerialRewriter) array() bool {
+	n, ok := p.header('a')
+	if !ok || !p.expect('{') {
+		return false
+	}
+	p.out.WriteString("a:" + strconv.Itoa(n) + ":{")
+	if !p.members(n) || !p.expect('}') {
+		return false
+	}
+	p.out.WriteByte('}')
+	return true
+}
+
+// object rewrites O:N:"Class":N:{prop;value;...}.
+func (p *phpSerialRewriter) object() bool {
+	class, ok := p.lengthPrefixed('O', '"', '"')
+	if !ok || !p.expect(':') {
+		return false
+	}
+	n, ok := p.number(':')
+	if !ok || !p.expect('{') {
+		return false
+	}
+	p.writeHeader('O', class)
+	p.out.WriteString(":" + strconv.Itoa(n) + ":{")
+	if !p.members(n) || !p.expect('}') {
+		return false
+	}
+	p.out.WriteByte('}')
+	return true
+}
+
+// custom rewrites C:N:"Class":N:{payload}, where the payload is produced by
+// Serializable::serialize and may itself be serialized data.
+func (p *phpSerialRewriter) custom() bool {
+	class, ok := p.lengthPrefixed('C', '"', '"')
+	if !ok || !p.expect(':') {
+		return false
+	}
+	payload, ok := p.counted('{', '}')
+	if !ok {
+		return false
+	}
+	payload = p.replace(payload)
+	p.writeHeader('C', class)
+	p.out.WriteString(":" + strconv.Itoa(len(payload)) + ":{" + payload + "}")
+	return true
+}
+
+func (p *phpSerialRewriter) members(n int) bool {
+	for i := 0; i < 2*n; i++ {
+		if !p.value() {
+			return false
+		}
+	}
+	return true
+}
+
+// header parses "<kind>:<n>:" and returns n.
+func (p *phpSerialRewriter) header(kind byte) (int, bool) {
+	if p.pos+2 > len(p.src) || p.src[p.pos] != kind || p.src[p.pos+1] != ':' {
+		return 0, false
+	}
+	p.pos += 2
+	return p.number(':')
+}
+
+// lengthPrefixed parses "<kind>:<n>:<open><n bytes><close>" and returns the
+// n bytes between the delimiters.
+func (p *phpSerialRewriter) lengthPrefixed(kind, open, close byte) (string, bool) {
+	n, ok := p.header(kind)
+	if !ok {
+		return "", false
+	}
+	return p.take(n, open, close)
+}
+
+// counted parses "<n>:<open><n bytes><close>" and returns the n bytes.
+func (p *phpSerialRewriter) counted(open, close byte) (string, bool) {
+	n, ok := p.number(':')
+	if !ok {
+		return "", false
+	}
+	return p.take(n, open, close)
+}
+
+func (p *phpSerialRewriter) take(n int, open, close byte) (string, bool) {
+	if !p.expect(open) || p.pos+n >= len(p.src) || p.src[p.pos+n] != close {
+		return "", false
+	}
+	s := p.src[p.pos : p.pos+n]
+	p.pos += n + 1
+	return s, true
+}
+
+// number parses a non-negative decimal terminated by term.
+func (p *phpSerialRewriter) number(term byte) (int, bool) {
+	end := strings.IndexByte(p.src[p.pos:], term)
+	if end <= 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(p.src[p.pos : p.pos+end])
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	p.pos += end + 1
+	return n, true
+}
+
+func (p *phpSerialRewriter) expect(c byte) bool {
+	if p.pos >= len(p.src) || p.src[p.pos] != c {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *phpSerialRewriter) copyLiteral(lit string) bool {
+	if !strings.HasPrefix(p.src[p.pos:], lit) {
+		return false
+	}
+	p.out.WriteString(lit)
+	p.pos += len(lit)
+	return true
+}
+
+func (p *phpSerialRewriter) writeString(s string) {
+	p.writeHeader('s', s)
+	p.out.WriteByte(';')
+}
+
+func (p *phpSerialRewriter) writeHeader(kind byte, s string) {
+	p.out.WriteByte(kind)
+	p.out.WriteString(":" + strconv.Itoa(len(s)) + ":\"" + s + "\"")
+}
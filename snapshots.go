@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultSnapshotsKeep is how many snapshots are kept per database when no
+// retention policy is configured.
+const defaultSnapshotsKeep = 10
+
+// SnapshotSettings configures the compressed snapshots taken of the local
+// database before a sync or restore overwrites it.
+type SnapshotSettings struct {
+	// Dir defaults to $XDG_DATA_HOME/dsync/snapshots.
+	Dir      string `json:"dir,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+
+	// Retention; the newest 10 snapshots are kept if neither is set.
+	BackupPolicy
+}
+
+func (s SnapshotSettings) dir() string {
+	if s.Dir != "" {
+		return expandHome(s.Dir)
+	}
+	if data := os.Getenv("XDG_DATA_HOME"); data != "" {
+		return filepath.Join(data, "dsync", "snapshots")
+	}
+	return expandHome("~/.local/share/dsync/snapshots")
+}
+
+func (s SnapshotSettings) policy() BackupPolicy {
+	if s.IsSet() {
+		return s.BackupPolicy
+	}
+	return BackupPolicy{KeepLast: defaultSnapshotsKeep}
+}
+
+func snapshotName(db string, t time.Time) string {
+	return fmt.Sprintf("%s_%s.sql.gz", db, t.Format(backupTimeFormat))
+}
+
+// takeSnapshot writes a gzip-compressed dump of db to the snapshot
+// directory and returns its path. The file only appears under its final
+// name once the dump is complete.
+func (s SnapshotSettings) takeSnapshot(ctx context.Context, db string, dump func(ctx context.Context, w io.Writer) error) (string, error) {
+	dir := s.dir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	path := filepath.Join(dir, snapshotName(db, time.Now()))
+	tmp, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw, err := compressWriter(tmp, codecGzip, 6)
+	if err != nil {
+		return "", err
+	}
+	if err := dump(ctx, zw); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	return path, nil
+}
+
+// listSnapshots returns the snapshots of db, newest first.
+func (s SnapshotSettings) listSnapshots(db string) ([]backupFile, error) {
+	entries, err := os.ReadDir(s.dir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+
+	var snapshots []backupFile
+	for _, entry := range entries {
+		t, ok := parseStampedName(entry.Name(), db+"_", ".sql.gz")
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		var size int64
+		if info, err := entry.Info(); err == nil {
+			size = info.Size()
+		}
+		snapshots = append(snapshots, backupFile{Name: entry.Name(), Time: t, Size: size})
+	}
+	return sortBackups(snapshots), nil
+}
+
+// pruneSnapshots removes the snapshots of db the retention policy does not
+// keep.
+func (s SnapshotSettings) pruneSnapshots(db string) error {
+	snapshots, err := s.listSnapshots(db)
+	if err != nil {
+		return err
+	}
+	_, remove := s.policy().Apply(snapshots, time.Now())
+	for _, b := range remove {
+		if err := os.Remove(filepath.Join(s.dir(), b.Name)); err != nil {
+			return fmt.Errorf("failed to remove snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// resolveSnapshot finds a snapshot given as a path or as a name in the
+// snapshot directory.
+func (s SnapshotSettings) resolveSnapshot(name string) (string, error) {
+	for _, path := range []string{expandHome(name), filepath.Join(s.dir(), name)} {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("snapshot '%s' not found (looked in %s)", name, s.dir())
+}
+
+// restoreSnapshot loads a snapshot into the database of the local
+// environment name, after taking a snapshot of its current state.
+func (c *Config) restoreSnapshot(ctx context.Context, name, snapshot string) error {
+	env, err := c.environment(name)
+	if err != nil {
+		return err
+	}
+	if !env.IsLocal() {
+		return fmt.Errorf("environment '%s' is remote; snapshots are restored into local environments", name)
+	}
+
+	path, err := c.Snapshots.resolveSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	dst := newLocalDB(env.DB, c.dbSettings())
+	return transferDB(ctx, dbTransfer{
+		source:   "snapshot",
+		target:   name,
+		driver:   env.DB.driverName(),
+		sourceDB: filepath.Base(path),
+		targetDB: env.DB.DB,
+		dump: func(ctx context.Context, w io.Writer) error {
+			return readSQLFile(path, w)
+		},
+		write: dst.Write,
+		// Not pruned, so the snapshot being restored cannot be removed
+		backup: func(ctx context.Context) error {
+			return dst.snapshot(ctx, false)
+		},
+		replacer: NewReplacer(nil),
+		dumpPath: "db.sql",
+	}, SyncOptions{})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	s := SnapshotSettings{Dir: t.TempDir()}
+	ctx := context.Background()
+	sql := "INSERT INTO `posts` VALUES ('hello');\n"
+
+	path, err := s.takeSnapshot(ctx, "shop", func(ctx context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, sql)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("takeSnapshot() error: %v", err)
+	}
+	if !strings.HasSuffix(path, ".sql.gz") || filepath.Dir(path) != s.Dir {
+		t.Errorf("unexpected snapshot path %s", path)
+	}
+
+	var got strings.Builder
+	if err := readSQLFile(path, &got); err != nil {
+		t.Fatalf("readSQLFile() error: %v", err)
+	}
+	if got.String() != sql {
+		t.Errorf("snapshot contains %q, want %q", got.String(), sql)
+	}
+
+	resolved, err := s.resolveSnapshot(filepath.Base(path))
+	if err != nil || resolved != path {
+		t.Errorf("resolveSnapshot() = %s, %v", resolved, err)
+	}
+}
+
+func TestSnapshotFailedDumpLeavesNothing(t *testing.T) {
+	s := SnapshotSettings{Dir: t.TempDir()}
+	dumpErr := errors.New("connection refused")
+
+	_, err := s.takeSnapshot(context.Background(), "shop", func(ctx context.Context, w io.Writer) error {
+		io.WriteString(w, "partial")
+		return dumpErr
+	})
+	if !errors.Is(err, dumpErr) {
+		t.Fatalf("takeSnapshot() error = %v, want %v", err, dumpErr)
+	}
+
+	entries, _ := os.ReadDir(s.Dir)
+	if len(entries) != 0 {
+		t.Errorf("failed snapshot left files behind: %v", entries)
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	s := SnapshotSettings{Dir: t.TempDir(), BackupPolicy: BackupPolicy{KeepLast: 2}}
+
+	now := time.Now()
+	var names []string
+	for i := 0; i < 4; i++ {
+		name := snapshotName("shop", now.Add(-time.Duration(i)*time.Hour))
+		names = append(names, name)
+		if err := os.WriteFile(filepath.Join(s.Dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := snapshotName("shop_old", now.Add(-48*time.Hour))
+	if err := os.WriteFile(filepath.Join(s.Dir, other), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.pruneSnapshots("shop"); err != nil {
+		t.Fatalf("pruneSnapshots() error: %v", err)
+	}
+
+	snapshots, err := s.listSnapshots("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Name != names[0] || snapshots[1].Name != names[1] {
+		t.Errorf("kept %+v, want the newest two", snapshots)
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, other)); err != nil {
+		t.Errorf("snapshot of another database was pruned: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// sqliteMagic starts every SQLite 3 database file.
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+// sqliteDriver runs the sqlite3 shell against a database file; DB is the
+// file's path, relative to the SSH user's home directory on a remote host
+// and to the working directory locally.
+type sqliteDriver struct {
+	h HostSettings
+}
+
+func (s sqliteDriver) dumpScript(filter TableFilter, listTables func() ([]string, error), wrap func(run string) string) (string, []byte, error) {
+	if !filter.IsZero() {
+		// The dump is loaded into a new file, so tables left out of it
+		// would be lost rather than left untouched
+		return "", nil, errors.New("table filters are not supported for SQLite databases")
+	}
+	// .dump reads the database in a single transaction
+	return sqliteScript(s.h,
+		sqliteRequireFile,
+		wrap(`sqlite3 -bail "$db" .dump`),
+	)
+}
+
+// fileDumpScript copies the database with the online backup API, which
+// gives a consistent file even while it is being written to.
+func (s sqliteDriver) fileDumpScript(wrap func(run string) string) (string, []byte, error) {
+	return sqliteScript(s.h,
+		sqliteRequireFile,
+		`f=$(mktemp) || exit 1`,
+		`trap 'rm -f "$f"' EXIT`,
+		`sqlite3 -bail "$db" ".backup '$f'" || exit $?`,
+		wrap(`cat "$f"`),
+	)
+}
+
+// loadScript builds a new database from the SQL read from stdin, then
+// puts it in place of the old one.
+func (s sqliteDriver) loadScript(wrap func(run string) string) (string, []byte, error) {
+	return sqliteScript(s.h, append(sqliteTempFile,
+		wrap(`sqlite3 -bail "$f" || exit $?`),
+		sqliteInstall,
+	)...)
+}
+
+// fileLoadScript checks the database file read from stdin, then puts it in
+// place of the old one.
+func (s sqliteDriver) fileLoadScript(wrap func(run string) string) (string, []byte, error) {
+	return sqliteScript(s.h, append(sqliteTempFile,
+		wrap(`cat > "$f" || exit $?`),
+		`[ "$(sqlite3 "$f" 'PRAGMA quick_check')" = ok ] || { echo "received database file is corrupt" >&2; exit 1; }`,
+		sqliteInstall,
+	)...)
+}
+
+func (s sqliteDriver) queryScript(query string) (string, []byte, error) {
+	return sqliteScript(s.h, "sqlite3 -bail -batch -noheader -separator "+shellQuote("\t")+` "$db" `+shellQuote(query))
+}
+
+func (s sqliteDriver) adminScript() (string, []byte, error) {
+	return sqliteScript(s.h, `sqlite3 -bail "$db"`)
+}
+
+func (s sqliteDriver) listTablesQuery() string {
+	return "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'"
+}
+
+func (s sqliteDriver) existsScript() (string, []byte, error) {
+	return sqliteScript(s.h, `[ -f "$db" ] && echo 1`, "exit 0")
+}
+
+// ensureUserAndDBSQL is empty: the database file is created by loading it,
+// and SQLite has no users.
+func (s sqliteDriver) ensureUserAndDBSQL() string {
+	return ""
+}
+
+func (s sqliteDriver) composeService() string {
+	return ""
+}
+
+// sqliteRequireFile stops a script when the database file does not exist,
+// which sqlite3 would otherwise create empty.
+const sqliteRequireFile = `[ -f "$db" ] || { echo "$db: no such database file" >&2; exit 1; }`
+
+// sqliteTempFile prepares "$f", the file a new database is written to next
+// to the old one, so it can be renamed into place.
+var sqliteTempFile = []string{
+	`mkdir -p "$(dirname "$db")" || exit 1`,
+	`f="$db.dsync-$$"`,
+	`trap 'rm -f "$f"' EXIT`,
+	`rm -f "$f"`,
+}
+
+// sqliteInstall replaces the database with "$f", keeping the file mode of
+// the old one. Journals left next to the old database would be applied to
+// the new one, so they are removed.
+const sqliteInstall = `mode=$(stat -c %a "$db" 2>/dev/null || stat -f %Lp "$db" 2>/dev/null) && chmod "$mode" "$f"
+rm -f "$db-wal" "$db-shm" "$db-journal"
+mv -f "$f" "$db"`
+
+// sqliteScript builds a POSIX shell script running lines with the path of
+// the database file in "$db". SQLite has no credentials, so there is no
+// preamble.
+func sqliteScript(h HostSettings, lines ...string) (script string, preamble []byte, err error) {
+	script = strings.Join(append([]string{
+		`command -v sqlite3 >/dev/null || { echo "sqlite3 not found" >&2; exit 127; }`,
+		"db=" + shellPath(h.DB),
+	}, lines...), "\n")
+	return script, nil, nil
+}
+
+// shellPath quotes a path for a POSIX shell, keeping a leading ~/
+// relative to the home directory.
+func shellPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		return `"$HOME"/` + shellQuote(rest)
+	}
+	return shellQuote(path)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSQLiteDriver(t *testing.T) {
+	h := HostSettings{Driver: "sqlite3", DB: "~/data/app.db"}
+	if h.driverName() != driverSQLite || h.name() != "app" {
+		t.Errorf("driverName() = %q, name() = %q", h.driverName(), h.name())
+	}
+
+	drv := h.driver()
+	script, preamble, err := drv.dumpScript(TableFilter{}, nil, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preamble != nil || !strings.Contains(script, `db="$HOME"/data/app.db`) || !strings.Contains(script, `sqlite3 -bail "$db" .dump`) {
+		t.Errorf("dump script:\n%s", script)
+	}
+	if _, _, err := drv.dumpScript(TableFilter{Exclude: []string{"logs"}}, nil, identity); err == nil {
+		t.Error("table filter accepted")
+	}
+
+	// Raw copies only when nothing rewrites the dump
+	script, _, _ = dumpScript(drv, true, TableFilter{}, nil, identity)
+	if !strings.Contains(script, ".backup") {
+		t.Errorf("raw dump script:\n%s", script)
+	}
+	script, _, _ = dumpScript(drv, false, TableFilter{}, nil, identity)
+	if strings.Contains(script, ".backup") {
+		t.Errorf("SQL dump script:\n%s", script)
+	}
+}
+
+func TestSyncDB_SQLite(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 not installed")
+	}
+
+	// ssh runs the remote command locally, in dir like in a home directory
+	dir, bin := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte("#!/bin/sh\nfor a; do cmd=$a; done\ncd "+shellQuote(dir)+" && eval \"$cmd\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	remote, local := filepath.Join(dir, "remote.db"), filepath.Join(dir, "local", "app.db")
+	sqlite(t, remote, "CREATE TABLE options (name TEXT, value TEXT); INSERT INTO options VALUES ('siteurl', 'http://host.com'), ('path', 'C:\\dir\\');")
+
+	cfg := &Config{
+		SSHHost:   "user@host",
+		Remote:    HostSettings{Driver: driverSQLite, DB: remote},
+		Local:     HostSettings{Driver: driverSQLite, DB: local},
+		Snapshots: SnapshotSettings{Disabled: true},
+		// The fake ssh above stands in for the host
+		SSH: SSHSettings{Client: sshClientSystem},
+	}
+
+	// Without rules the file itself is copied
+	if err := SyncDB(context.Background(), NewRealDBProvider(cfg), cfg, SyncOptions{}); err != nil {
+		t.Fatalf("SyncDB failed: %v", err)
+	}
+	if got := sqlite(t, local, "SELECT value FROM options ORDER BY name"); got != "C:\\dir\\\nhttp://host.com\n" {
+		t.Errorf("copied database holds %q", got)
+	}
+
+	// With rules the dump is rewritten and loaded into a new file
+	cfg.DBReplace = []DBReplace{{From: "http://host.com", To: "https://example.test"}}
+	if err := SyncDB(context.Background(), NewRealDBProvider(cfg), cfg, SyncOptions{}); err != nil {
+		t.Fatalf("SyncDB failed: %v", err)
+	}
+	if got := sqlite(t, local, "SELECT value FROM options ORDER BY name"); got != "C:\\dir\\\nhttps://example.test\n" {
+		t.Errorf("replaced database holds %q", got)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(local)); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+
+	// A push in raw mode hands over a valid database file
+	cfg.DBReplace = nil
+	sqlite(t, local, "UPDATE options SET value = 'pushed' WHERE name = 'siteurl';")
+	if err := SyncDB(context.Background(), NewRealDBProvider(cfg), cfg, SyncOptions{Reverse: true}); err != nil {
+		t.Fatalf("SyncDB failed: %v", err)
+	}
+	if got := sqlite(t, remote, "SELECT value FROM options WHERE name = 'siteurl'"); got != "pushed\n" {
+		t.Errorf("pushed database holds %q", got)
+	}
+	if backups, _ := filepath.Glob(filepath.Join(dir, "remote_backup_*.sql")); len(backups) != 1 {
+		t.Errorf("remote backups = %v, want one", backups)
+	}
+}
+
+func sqlite(t *testing.T, path, sql string) string {
+	t.Helper()
+	var stderr bytes.Buffer
+	cmd := exec.Command("sqlite3", path, sql)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("sqlite3 %s: %s: %v", path, stderr.String(), err)
+	}
+	return string(out)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SSH clients.
+const (
+	sshClientNative = "native"
+	sshClientSystem = "system"
+)
+
+// SSHSettings selects how dsync talks to SSH hosts. Apart from Client,
+// environments can override them.
+type SSHSettings struct {
+	// Client is native (the default), the built-in client, which runs the
+	// database commands of a run over one connection per host, or system,
+	// the ssh binary. File syncs always use the ssh binary, through rsync.
+	Client string `json:"client,omitempty"`
+
+	// IdentityFile is a private key to authenticate with, like ssh -i.
+	IdentityFile string `json:"identityFile,omitempty"`
+	// JumpHosts are the hosts to connect through, in order, like ssh -J.
+	JumpHosts []string `json:"jumpHosts,omitempty"`
+	// StrictHostKeyChecking is how host keys missing from known_hosts are
+	// treated: ask (ssh's default), yes, accept-new or no.
+	StrictHostKeyChecking string `json:"strictHostKeyChecking,omitempty"`
+	// Options are further ssh options, like ssh -o, e.g.
+	// "ServerAliveInterval=30".
+	Options []string `json:"options,omitempty"`
+}
+
+func (s SSHSettings) validate() error {
+	switch s.Client {
+	case "", sshClientNative, sshClientSystem:
+	default:
+		return fmt.Errorf("unknown client '%s' (use native or system)", s.Client)
+	}
+	switch s.StrictHostKeyChecking {
+	case "", "ask", "yes", "accept-new", "no":
+	default:
+		return fmt.Errorf("unknown strictHostKeyChecking '%s' (use ask, yes, accept-new or no)", s.StrictHostKeyChecking)
+	}
+	for _, o := range s.Options {
+		if _, _, ok := splitSSHOption(o); !ok {
+			return fmt.Errorf("option '%s' is not of the form Key=Value", o)
+		}
+	}
+	return nil
+}
+
+// merge returns s with the settings of env, an environment's, on top.
+func (s SSHSettings) merge(env SSHSettings) SSHSettings {
+	if env.IdentityFile != "" {
+		s.IdentityFile = env.IdentityFile
+	}
+	if len(env.JumpHosts) > 0 {
+		s.JumpHosts = env.JumpHosts
+	}
+	if env.StrictHostKeyChecking != "" {
+		s.StrictHostKeyChecking = env.StrictHostKeyChecking
+	}
+	// ssh uses the first value given for an option
+	s.Options = append(append([]string(nil), env.Options...), s.Options...)
+	return s
+}
+
+// splitSSHOption splits an option as ssh -o takes it, Key=Value or
+// Key Value.
+func splitSSHOption(o string) (key, value string, ok bool) {
+	key, value, ok = strings.Cut(strings.TrimSpace(o), "=")
+	if !ok {
+		key, value, ok = strings.Cut(strings.TrimSpace(o), " ")
+	}
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	return key, value, ok && key != "" && value != ""
+}
+
+// sshHost is how an SSH host is reached: Host is [user@]host or an
+// ssh_config alias, and an empty Port leaves the port to ssh_config.
+type sshHost struct {
+	Host string
+	Port string
+	SSH  SSHSettings
+}
+
+// args returns the ssh options reaching the host, without the host itself.
+func (h sshHost) args() []string {
+	var args []string
+	if h.Port != "" {
+		args = append(args, "-p", h.Port)
+	}
+	if h.SSH.IdentityFile != "" {
+		args = append(args, "-i", expandHome(h.SSH.IdentityFile))
+	}
+	if len(h.SSH.JumpHosts) > 0 {
+		args = append(args, "-J", strings.Join(h.SSH.JumpHosts, ","))
+	}
+	if h.SSH.StrictHostKeyChecking != "" {
+		args = append(args, "-o", "StrictHostKeyChecking="+h.SSH.StrictHostKeyChecking)
+	}
+	for _, o := range h.SSH.Options {
+		args = append(args, "-o", o)
+	}
+	return args
+}
+
+// rsyncShell returns the remote shell command rsync should use.
+func (h sshHost) rsyncShell() string {
+	shell := []string{"ssh"}
+	for _, a := range h.args() {
+		shell = append(shell, shellQuote(a))
+	}
+	return strings.Join(shell, " ")
+}
+
+// sshHost returns how to reach the SSH host of the single-host layout, or
+// of a pair resolved by ForPair.
+func (c *Config) sshHost() sshHost {
+	return sshHost{Host: c.SSHHost, Port: c.Port, SSH: c.SSH}
+}
+
+// sshHost returns how to reach the environment.
+func (e *Environment) sshHost() sshHost {
+	return sshHost{Host: e.SSHHost, Port: e.Port, SSH: e.SSH}
+}
+
+// validateSSH checks the SSH settings of the config and its environments.
+func (c *Config) validateSSH() error {
+	var e ConfigError
+	if err := c.SSH.validate(); err != nil {
+		e.add("ssh", "%v", err)
+	}
+	for _, name := range c.EnvironmentNames() {
+		env := c.Environments[name]
+		if env == nil {
+			continue
+		}
+		err := env.SSH.validate()
+		if err == nil && env.SSH.Client != "" {
+			err = errors.New("client can only be set at the top level")
+		}
+		if err != nil {
+			e.add("environments."+name+".ssh", "%v", err)
+		}
+	}
+	return e.err()
+}
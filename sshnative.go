@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kevinburke/ssh_config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+)
+
+// sshClients is the built-in SSH client. It keeps one connection per host
+// open for a whole run and runs every command in its own session over it.
+// Hosts are resolved from ~/.ssh/config and verified against known_hosts,
+// like ssh does.
+type sshClients struct {
+	// prompt asks the user for a password, a passphrase or whether to trust
+	// a host; nil when nobody can answer.
+	prompt func(question string, echo bool) (string, error)
+
+	mu      sync.Mutex
+	config  sshConfig
+	loaded  bool
+	agent   agent.ExtendedAgent
+	clients map[string]*ssh.Client // by sshHost
+	closers []io.Closer            // in the order they were opened
+}
+
+func newSSHClients() *sshClients {
+	return &sshClients{prompt: ttyPrompt}
+}
+
+// executor returns an Executor running commands on host.
+func (p *sshClients) executor(host sshHost) Executor {
+	return nativeExecutor{clients: p, host: host}
+}
+
+// Close closes every connection, jump hosts last.
+func (p *sshClients) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		if err := p.closers[i].Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	p.closers, p.clients, p.agent = nil, nil, nil
+	return errors.Join(errs...)
+}
+
+// client returns the connection to host, connecting on first use.
+func (p *sshClients) client(ctx context.Context, host sshHost) (*ssh.Client, error) {
+	// Connecting holds the lock, so that concurrent commands share the
+	// connection and prompts never interleave
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := fmt.Sprintf("%#v", host)
+	if c, ok := p.clients[key]; ok {
+		return c, nil
+	}
+
+	t, err := p.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var via *ssh.Client
+	for _, jump := range t.jumps {
+		j, err := p.resolve(splitJump(jump))
+		if err != nil {
+			return nil, err
+		}
+		if via, err = p.dial(ctx, via, j); err != nil {
+			return nil, fmt.Errorf("failed to connect to jump host %s: %w", jump, err)
+		}
+	}
+	c, err := p.dial(ctx, via, t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", host.Host, err)
+	}
+
+	if p.clients == nil {
+		p.clients = make(map[string]*ssh.Client)
+	}
+	p.clients[key] = c
+	return c, nil
+}
+
+// dial connects to t, through via unless it is nil.
+func (p *sshClients) dial(ctx context.Context, via *ssh.Client, t sshTarget) (*ssh.Client, error) {
+	config, err := p.clientConfig(t)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := t.addr()
+	var conn net.Conn
+	if via == nil {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = via.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	p.closers = append(p.closers, client)
+	return client, nil
+}
+
+func (p *sshClients) clientConfig(t sshTarget) (*ssh.ClientConfig, error) {
+	prompt := p.prompt
+	if t.batch {
+		prompt = nil
+	}
+
+	hostKeys, algorithms, err := t.hostKeyCallback(prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	var a agent.ExtendedAgent
+	if !t.identitiesOnly {
+		a = p.connectAgent()
+	}
+	// The publickey method is only tried once, so the agent's keys and the
+	// key files are offered by the same callback
+	auth := []ssh.AuthMethod{ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		if a != nil {
+			// Without its keys the key files can still be tried
+			signers, _ = a.Signers()
+		}
+		return appendIdentities(signers, t.identities, prompt), nil
+	})}
+	if prompt != nil {
+		auth = append(auth,
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i, q := range questions {
+					var err error
+					if answers[i], err = prompt(q, echos[i]); err != nil {
+						return nil, err
+					}
+				}
+				return answers, nil
+			}),
+			ssh.PasswordCallback(func() (string, error) {
+				return prompt(fmt.Sprintf("%s@%s's password: ", t.user, t.hostname), false)
+			}),
+		)
+	}
+
+	return &ssh.ClientConfig{
+		User:              t.user,
+		Auth:              auth,
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: algorithms,
+	}, nil
+}
+
+// connectAgent returns the ssh-agent of SSH_AUTH_SOCK, or nil without one.
+func (p *sshClients) connectAgent() agent.ExtendedAgent {
+	if p.agent != nil {
+		return p.agent
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil
+	}
+	p.closers = append(p.closers, conn)
+	p.agent = agent.NewClient(conn)
+	return p.agent
+}
+
+// appendIdentities appends the private keys that exist of files to
+// signers, skipping those already in it. Encrypted keys are decrypted with a
+// passphrase from prompt, or skipped without one; the passphrase is only
+// asked for once the server accepts the key.
+func appendIdentities(signers []ssh.Signer, files []string, prompt func(string, bool) (string, error)) []ssh.Signer {
+	offered := make(map[string]bool)
+	for _, s := range signers {
+		offered[string(s.PublicKey().Marshal())] = true
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && prompt != nil {
+			signer, err = newIdentitySigner(file, data, missing.PublicKey, prompt)
+		}
+		if err == nil && !offered[string(signer.PublicKey().Marshal())] {
+			offered[string(signer.PublicKey().Marshal())] = true
+			signers = append(signers, signer)
+		}
+	}
+	return signers
+}
+
+// identitySigner is an encrypted key file, decrypted on its first
+// signature.
+type identitySigner struct {
+	file   string
+	data   []byte
+	pub    ssh.PublicKey
+	prompt func(string, bool) (string, error)
+	signer ssh.Signer
+}
+
+// newIdentitySigner returns the signer of an encrypted key file. Its public
+// key is pub, or read from the .pub file next to it; without either, the
+// key is decrypted right away.
+func newIdentitySigner(file string, data []byte, pub ssh.PublicKey, prompt func(string, bool) (string, error)) (ssh.Signer, error) {
+	s := &identitySigner{file: file, data: data, pub: pub, prompt: prompt}
+	if s.pub == nil {
+		if line, err := os.ReadFile(file + ".pub"); err == nil {
+			s.pub, _, _, _, _ = ssh.ParseAuthorizedKey(line)
+		}
+	}
+	if s.pub == nil {
+		return s.decrypt()
+	}
+	return s, nil
+}
+
+func (s *identitySigner) decrypt() (ssh.Signer, error) {
+	if s.signer == nil {
+		passphrase, err := s.prompt(fmt.Sprintf("Enter passphrase for key '%s': ", s.file), false)
+		if err != nil {
+			return nil, err
+		}
+		if s.signer, err = ssh.ParsePrivateKeyWithPassphrase(s.data, []byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", s.file, err)
+		}
+	}
+	return s.signer, nil
+}
+
+func (s *identitySigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *identitySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+// SignWithAlgorithm lets RSA keys sign with SHA-2, which a plain Signer
+// cannot offer.
+func (s *identitySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	if as, ok := signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return signer.Sign(rand, data)
+}
+
+// sshTarget is a host as ssh connects to it, after applying ~/.ssh/config.
+type sshTarget struct {
+	alias, user, hostname, port string
+
+	identities     []string
+	identitiesOnly bool
+	jumps          []string // ProxyJump hosts, in the order they are passed
+	knownHosts     []string // new keys are added to the first one
+	strict         string   // StrictHostKeyChecking
+	batch          bool     // never prompt
+}
+
+func (t sshTarget) addr() string {
+	return net.JoinHostPort(t.hostname, t.port)
+}
+
+// resolve looks up host, which may be user@alias, in the ssh config. What
+// the host sets explicitly, its user, port and SSH settings, takes
+// precedence over the ssh config, as it does on the ssh command line.
+func (p *sshClients) resolve(host sshHost) (sshTarget, error) {
+	if !p.loaded {
+		config, err := loadSSHConfig()
+		if err != nil {
+			return sshTarget{}, err
+		}
+		p.config, p.loaded = config, true
+	}
+
+	t := sshTarget{alias: host.Host, port: host.Port}
+	if i := strings.LastIndex(host.Host, "@"); i >= 0 {
+		t.user, t.alias = host.Host[:i], host.Host[i+1:]
+	}
+
+	overrides := make(map[string]string)
+	for _, o := range host.SSH.Options {
+		if k, v, ok := splitSSHOption(o); ok {
+			if _, seen := overrides[strings.ToLower(k)]; !seen {
+				overrides[strings.ToLower(k)] = v
+			}
+		}
+	}
+	if host.SSH.StrictHostKeyChecking != "" {
+		overrides["stricthostkeychecking"] = host.SSH.StrictHostKeyChecking
+	}
+	if len(host.SSH.JumpHosts) > 0 {
+		overrides["proxyjump"] = strings.Join(host.SSH.JumpHosts, ",")
+	}
+
+	var err error
+	get := func(key string) string {
+		if v, ok := overrides[strings.ToLower(key)]; ok {
+			return v
+		}
+		v, e := p.config.get(t.alias, key)
+		if e != nil && err == nil {
+			err = fmt.Errorf("ssh config of %s: %w", t.alias, e)
+		}
+		return v
+	}
+
+	t.hostname = strings.ReplaceAll(get("HostName"), "%h", t.alias)
+	if t.hostname == "" {
+		t.hostname = t.alias
+	}
+	if t.port == "" {
+		t.port = get("Port")
+	}
+	if t.port == "" {
+		t.port = "22"
+	}
+	if t.user == "" {
+		t.user = get("User")
+	}
+	if t.user == "" {
+		t.user = localUser()
+	}
+
+	identities, e := p.config.getAll(t.alias, "IdentityFile")
+	if e != nil && err == nil {
+		err = e
+	}
+	if host.SSH.IdentityFile != "" {
+		identities = append([]string{host.SSH.IdentityFile}, identities...)
+	}
+	if len(identities) == 0 {
+		identities = []string{"~/.ssh/id_rsa", "~/.ssh/id_ecdsa", "~/.ssh/id_ed25519"}
+	}
+	for _, f := range identities {
+		t.identities = append(t.identities, t.expand(f))
+	}
+	t.identitiesOnly = strings.EqualFold(get("IdentitiesOnly"), "yes")
+
+	if jump := get("ProxyJump"); jump != "" && !strings.EqualFold(jump, "none") {
+		t.jumps = strings.Split(jump, ",")
+	}
+	if proxy := get("ProxyCommand"); proxy != "" && !strings.EqualFold(proxy, "none") && err == nil {
+		err = fmt.Errorf("ssh config of %s: ProxyCommand is not supported by the built-in client; use the system client (ssh.client: system)", t.alias)
+	}
+
+	userFiles := get("UserKnownHostsFile")
+	if userFiles == "" {
+		userFiles = "~/.ssh/known_hosts ~/.ssh/known_hosts2"
+	}
+	globalFiles := get("GlobalKnownHostsFile")
+	if globalFiles == "" {
+		globalFiles = "/etc/ssh/ssh_known_hosts /etc/ssh/ssh_known_hosts2"
+	}
+	for _, f := range strings.Fields(userFiles + " " + globalFiles) {
+		t.knownHosts = append(t.knownHosts, t.expand(f))
+	}
+
+	t.strict = strings.ToLower(get("StrictHostKeyChecking"))
+	t.batch = strings.EqualFold(get("BatchMode"), "yes")
+
+	return t, err
+}
+
+// expand replaces the ~ and the % tokens ssh allows in file names.
+func (t sshTarget) expand(s string) string {
+	home, _ := os.UserHomeDir()
+	return strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", t.hostname,
+		"%n", t.alias,
+		"%p", t.port,
+		"%r", t.user,
+		"%u", localUser(),
+	).Replace(expandHome(s))
+}
+
+// splitJump parses a jump host, [user@]host[:port]. Like ssh, it is
+// reached with its own ssh config only.
+func splitJump(spec string) sshHost {
+	var h sshHost
+	userPart, hostPort := "", strings.TrimSpace(spec)
+	if i := strings.LastIndex(hostPort, "@"); i >= 0 {
+		userPart, hostPort = hostPort[:i+1], hostPort[i+1:]
+	}
+	if host, port, err := net.SplitHostPort(hostPort); err == nil {
+		hostPort, h.Port = host, port
+	}
+	h.Host = userPart + strings.Trim(hostPort, "[]")
+	return h
+}
+
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// hostKeyCallback verifies host keys against the known_hosts files. How
+// unknown hosts are treated follows StrictHostKeyChecking: yes rejects
+// them, accept-new trusts them, no trusts any key, and ask (the default)
+// asks through prompt. The returned algorithms are those of the keys known
+// for the host, so that the server presents one that can be verified.
+func (t sshTarget) hostKeyCallback(prompt func(string, bool) (string, error)) (ssh.HostKeyCallback, []string, error) {
+	if t.strict == "no" || t.strict == "off" {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	var files []string
+	for _, f := range t.knownHosts {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	known := func(string, net.Addr, ssh.PublicKey) error { return &knownhosts.KeyError{} }
+	if len(files) > 0 {
+		var err error
+		if known, err = knownhosts.New(files...); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if err == nil || !errors.As(err, &keyErr) {
+			return err
+		}
+		fingerprint := key.Type() + " " + ssh.FingerprintSHA256(key)
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("the host key of %s has changed to %s, which could mean the connection is intercepted; if the change is expected, remove the old key from %s:%d",
+				hostname, fingerprint, keyErr.Want[0].Filename, keyErr.Want[0].Line)
+		}
+
+		switch t.strict {
+		case "accept-new":
+			return addKnownHost(t.knownHosts[0], hostname, key)
+		case "yes":
+		default:
+			if prompt == nil {
+				break
+			}
+			answer, err := prompt(fmt.Sprintf("The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ",
+				hostname, key.Type(), ssh.FingerprintSHA256(key)), true)
+			if err == nil && strings.EqualFold(strings.TrimSpace(answer), "yes") {
+				return addKnownHost(t.knownHosts[0], hostname, key)
+			}
+		}
+		return fmt.Errorf("the host key of %s (%s) is not known; connect once with ssh to verify it", hostname, fingerprint)
+	}
+
+	return callback, knownAlgorithms(known, t.addr()), nil
+}
+
+// knownAlgorithms returns the host key algorithms of the keys known for
+// addr, or nil to accept any.
+func knownAlgorithms(known ssh.HostKeyCallback, addr string) []string {
+	// Checking a key no host has lists the keys the host does have
+	var keyErr *knownhosts.KeyError
+	if !errors.As(known(addr, &net.TCPAddr{IP: net.IPv4zero}, probeKey{}), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, k := range keyErr.Want {
+		switch k.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, k.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+// probeKey is a public key no known_hosts file contains.
+type probeKey struct{}
+
+func (probeKey) Type() string                                 { return "dsync-probe" }
+func (probeKey) Marshal() []byte                              { return []byte("dsync-probe") }
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("probe key") }
+
+// addKnownHost trusts key for hostname from now on.
+func addKnownHost(file, hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sshConfig is the ssh client configuration: the user's file, then the
+// system's.
+type sshConfig []*ssh_config.Config
+
+func loadSSHConfig() (sshConfig, error) {
+	var config sshConfig
+	for _, path := range []string{expandHome("~/.ssh/config"), "/etc/ssh/ssh_config"} {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ssh config: %w", err)
+		}
+		c, err := ssh_config.DecodeBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		config = append(config, c)
+	}
+	return config, nil
+}
+
+// get returns the first value of key for alias.
+func (c sshConfig) get(alias, key string) (string, error) {
+	for _, f := range c {
+		var v string
+		err := catchSSHConfig(func() (err error) {
+			v, err = f.Get(alias, key)
+			return err
+		})
+		if err != nil || v != "" {
+			return v, err
+		}
+	}
+	return "", nil
+}
+
+// getAll returns every value of key for alias.
+func (c sshConfig) getAll(alias, key string) ([]string, error) {
+	var all []string
+	for _, f := range c {
+		var v []string
+		err := catchSSHConfig(func() (err error) {
+			v, err = f.GetAll(alias, key)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, v...)
+	}
+	return all, nil
+}
+
+// catchSSHConfig turns the panic the ssh_config package raises on Match
+// blocks into an error.
+func catchSSHConfig(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v; use the system client (ssh.client: system)", r)
+		}
+	}()
+	return f()
+}
+
+// ttyPrompt asks on the terminal, which works even when stdin is a pipe.
+func ttyPrompt(question string, echo bool) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, question)
+	if !echo {
+		answer, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(tty)
+		return string(answer), err
+	}
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	return strings.TrimRight(answer, "\r\n"), err
+}
+
+// nativeExecutor runs commands on an SSH host over the connection of
+// clients, each in a session of its own.
+type nativeExecutor struct {
+	clients *sshClients
+	host    sshHost
+}
+
+func (e nativeExecutor) Run(ctx context.Context, c Command) error {
+	client, err := e.clients.client(ctx, e.host)
+	if err != nil {
+		return err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open an ssh session on %s: %w", e.host.Host, err)
+	}
+	defer session.Close()
+
+	session.Stdin, session.Stdout, session.Stderr = c.Stdin, c.Stdout, c.Stderr
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	// Like ssh, the command line is handed to the login shell as one string
+	err = session.Run(c.String())
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return sshExitError{exitErr}
+	}
+	return err
+}
+
+// sshExitError is a remote command that exited with a status.
+type sshExitError struct{ *ssh.ExitError }
+
+func (e sshExitError) ExitCode() int { return e.ExitStatus() }
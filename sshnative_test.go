@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an in-process SSH server. It runs exec requests with sh
+// in dir and forwards direct-tcpip channels, so it can be a jump host too.
+type testSSHServer struct {
+	addr  string
+	port  string
+	dir   string
+	key   ssh.PublicKey // host key
+	conns atomic.Int32  // connections accepted
+}
+
+// startSSHServer serves SSH on 127.0.0.1 to the user deploy with key.
+func startSSHServer(t *testing.T, key ssh.PublicKey) *testSSHServer {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() != "deploy" || !bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil, errors.New("unauthorized")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &testSSHServer{addr: ln.Addr().String(), dir: t.TempDir(), key: signer.PublicKey()}
+	_, s.port, _ = net.SplitHostPort(s.addr)
+
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc, config)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(nc net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	defer conn.Close()
+	s.conns.Add(1)
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				return
+			}
+			go s.session(ch, reqs)
+		case "direct-tcpip":
+			var target struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			if err := ssh.Unmarshal(nc.ExtraData(), &target); err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			dst, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.FormatUint(uint64(target.Port), 10)))
+			if err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				dst.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				io.Copy(dst, ch)
+				dst.Close()
+			}()
+			go func() {
+				io.Copy(ch, dst)
+				ch.Close()
+			}()
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func (s *testSSHServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Dir = s.dir
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = ch, ch, ch.Stderr()
+		cmd.Run()
+		status := struct{ Status uint32 }{uint32(cmd.ProcessState.ExitCode())}
+		ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+		return
+	}
+}
+
+// sshTestHome makes a home directory with an ssh config, a client key and
+// known_hosts, and returns the client's public key. No agent is used.
+func sshTestHome(t *testing.T, config string) (home string, key ssh.PublicKey) {
+	t.Helper()
+
+	home = t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err = ssh.NewPublicKey(pub); err != nil {
+		t.Fatal(err)
+	}
+
+	writeSSHFile(t, home, "id_ed25519", string(pem.EncodeToMemory(block)))
+	writeSSHFile(t, home, "config", config)
+	return home, key
+}
+
+func writeSSHFile(t *testing.T, home, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", name), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func knownHostsLine(s *testSSHServer) string {
+	return knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, s.key) + "\n"
+}
+
+func TestNativeSSHExecutor(t *testing.T) {
+	home, key := sshTestHome(t, "")
+	srv := startSSHServer(t, key)
+	writeSSHFile(t, home, "config", "Host shop\n  HostName 127.0.0.1\n  Port "+srv.port+"\n  User deploy\n")
+	writeSSHFile(t, home, "known_hosts", knownHostsLine(srv))
+
+	clients := &sshClients{}
+	defer clients.Close()
+	x := clients.executor(sshHost{Host: "shop"})
+	ctx := context.Background()
+
+	out, _, err := output(ctx, x, Command{Args: []string{"printf", "%s", "it's $HOME"}})
+	if err != nil || string(out) != "it's $HOME" {
+		t.Errorf("printf = %q, %v", out, err)
+	}
+
+	out, _, err = output(ctx, x, Command{Args: []string{"cat"}, Stdin: strings.NewReader("piped")})
+	if err != nil || string(out) != "piped" {
+		t.Errorf("cat = %q, %v", out, err)
+	}
+
+	_, stderr, err := output(ctx, x, shellCommand("echo oops >&2; exit 3"))
+	var exitErr interface{ ExitCode() int }
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 || string(stderr) != "oops\n" {
+		t.Errorf("exit 3 = %v with stderr %q", err, stderr)
+	}
+
+	// The database commands run over the same connection
+	if err := os.WriteFile(filepath.Join(srv.dir, "shop_backup_20240102_030405.sql"), []byte("--"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db := newSSHDB(&Environment{SSHHost: "shop", DB: HostSettings{DB: "shop"}}, dbSettings{ssh: clients})
+	backups, err := db.ListBackups(ctx)
+	if err != nil || len(backups) != 1 || backups[0].Name != "shop_backup_20240102_030405.sql" {
+		t.Errorf("ListBackups() = %v, %v", backups, err)
+	}
+
+	if n := srv.conns.Load(); n != 1 {
+		t.Errorf("opened %d connections, want 1", n)
+	}
+}
+
+func TestNativeSSHConcurrentSessions(t *testing.T) {
+	home, key := sshTestHome(t, "")
+	srv := startSSHServer(t, key)
+	writeSSHFile(t, home, "known_hosts", knownHostsLine(srv))
+
+	clients := &sshClients{}
+	defer clients.Close()
+	x := clients.executor(sshHost{Host: "deploy@127.0.0.1", Port: srv.port})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = x.Run(context.Background(), shellCommand("sleep 0.1"))
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.conns.Load(); n != 1 {
+		t.Errorf("opened %d connections, want 1", n)
+	}
+}
+
+func TestNativeSSHHostKeys(t *testing.T) {
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewSignerFromKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		known   func(s *testSSHServer) string
+		wantErr string
+		trusted bool // known_hosts ends up with just the server's key
+	}{
+		{
+			name:    "known",
+			known:   knownHostsLine,
+			trusted: true,
+		},
+		{
+			name:    "unknown",
+			known:   func(*testSSHServer) string { return "" },
+			wantErr: "is not known",
+		},
+		{
+			name:    "unknown, accept-new",
+			config:  "StrictHostKeyChecking accept-new",
+			known:   func(*testSSHServer) string { return "" },
+			trusted: true,
+		},
+		{
+			name:   "changed",
+			config: "StrictHostKeyChecking accept-new",
+			known: func(s *testSSHServer) string {
+				return knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, otherKey.PublicKey()) + "\n"
+			},
+			wantErr: "has changed",
+		},
+		{
+			name:   "changed, checking off",
+			config: "StrictHostKeyChecking no",
+			known: func(s *testSSHServer) string {
+				return knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, otherKey.PublicKey()) + "\n"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, key := sshTestHome(t, "")
+			srv := startSSHServer(t, key)
+			writeSSHFile(t, home, "config", "Host *\n  "+tt.config+"\n")
+			writeSSHFile(t, home, "known_hosts", tt.known(srv))
+
+			clients := &sshClients{}
+			defer clients.Close()
+			err := clients.executor(sshHost{Host: "deploy@127.0.0.1", Port: srv.port}).Run(context.Background(), shellCommand("true"))
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Run() error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+			}
+
+			known, _ := os.ReadFile(filepath.Join(home, ".ssh", "known_hosts"))
+			if trusted := string(known) == knownHostsLine(srv); trusted != tt.trusted {
+				t.Errorf("known_hosts = %q", known)
+			}
+		})
+	}
+}
+
+func TestNativeSSHJumpHost(t *testing.T) {
+	home, key := sshTestHome(t, "")
+	jump := startSSHServer(t, key)
+	target := startSSHServer(t, key)
+	writeSSHFile(t, home, "config", strings.Join([]string{
+		"Host shop",
+		"  HostName 127.0.0.1",
+		"  Port " + target.port,
+		"  ProxyJump deploy@bastion",
+		"Host bastion",
+		"  HostName 127.0.0.1",
+		"  Port " + jump.port,
+	}, "\n"))
+	writeSSHFile(t, home, "known_hosts", knownHostsLine(jump)+knownHostsLine(target))
+
+	clients := &sshClients{}
+	defer clients.Close()
+	x := clients.executor(sshHost{Host: "deploy@shop"})
+
+	for range 2 {
+		if out, _, err := output(context.Background(), x, shellCommand("pwd")); err != nil || strings.TrimSpace(string(out)) != target.dir {
+			t.Fatalf("pwd = %q, %v; want %s", out, err, target.dir)
+		}
+	}
+	if j, s := jump.conns.Load(), target.conns.Load(); j != 1 || s != 1 {
+		t.Errorf("opened %d connections to the jump host and %d to the target, want 1 each", j, s)
+	}
+}
+
+func TestNativeSSHKeys(t *testing.T) {
+	_, wrong, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		agentKey    any    // the only key the agent holds, if any
+		passphrase  string // of ~/.ssh/id_ed25519
+		wantPrompts int
+	}{
+		{name: "agent key rejected", agentKey: wrong},
+		{name: "encrypted key file", passphrase: "secret", wantPrompts: 1},
+		{name: "encrypted key file after a rejected agent key", agentKey: wrong, passphrase: "secret", wantPrompts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home, key := sshTestHome(t, "")
+			if tt.passphrase != "" {
+				pub, priv, err := ed25519.GenerateKey(rand.Reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(tt.passphrase))
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeSSHFile(t, home, "id_ed25519", string(pem.EncodeToMemory(block)))
+				if key, err = ssh.NewPublicKey(pub); err != nil {
+					t.Fatal(err)
+				}
+			}
+			srv := startSSHServer(t, key)
+			writeSSHFile(t, home, "known_hosts", knownHostsLine(srv))
+
+			prompts := 0
+			clients := &sshClients{prompt: func(question string, echo bool) (string, error) {
+				prompts++
+				return tt.passphrase, nil
+			}}
+			if tt.agentKey != nil {
+				keyring := agent.NewKeyring()
+				if err := keyring.Add(agent.AddedKey{PrivateKey: tt.agentKey}); err != nil {
+					t.Fatal(err)
+				}
+				clients.agent = keyring.(agent.ExtendedAgent)
+			}
+			defer clients.Close()
+
+			x := clients.executor(sshHost{Host: "deploy@127.0.0.1", Port: srv.port})
+			if out, _, err := output(context.Background(), x, shellCommand("echo ok")); err != nil || string(out) != "ok\n" {
+				t.Fatalf("echo = %q, %v", out, err)
+			}
+			if prompts != tt.wantPrompts {
+				t.Errorf("asked for %d passphrases, want %d", prompts, tt.wantPrompts)
+			}
+		})
+	}
+}
+
+func TestSSHResolve(t *testing.T) {
+	home, _ := sshTestHome(t, strings.Join([]string{
+		"Host shop",
+		"  HostName %h.example.com",
+		"  Port 2200",
+		"  User deploy",
+		"  IdentityFile ~/.ssh/shop_%r",
+		"  ProxyJump admin@bastion:2222,gate",
+		"Host plain",
+		"  ProxyJump none",
+	}, "\n"))
+
+	tests := []struct {
+		host sshHost
+		want sshTarget
+	}{
+		{
+			host: sshHost{Host: "shop"},
+			want: sshTarget{user: "deploy", hostname: "shop.example.com", port: "2200",
+				identities: []string{home + "/.ssh/shop_deploy"}, jumps: []string{"admin@bastion:2222", "gate"}},
+		},
+		{
+			host: sshHost{Host: "root@shop", Port: "22"},
+			want: sshTarget{user: "root", hostname: "shop.example.com", port: "22",
+				identities: []string{home + "/.ssh/shop_root"}, jumps: []string{"admin@bastion:2222", "gate"}},
+		},
+		{
+			host: sshHost{Host: "me@plain"},
+			want: sshTarget{user: "me", hostname: "plain", port: "22",
+				identities: []string{home + "/.ssh/id_rsa", home + "/.ssh/id_ecdsa", home + "/.ssh/id_ed25519"}},
+		},
+		{
+			host: sshHost{Host: "shop", SSH: SSHSettings{
+				IdentityFile: "~/keys/shop",
+				JumpHosts:    []string{"vpn"},
+				Options:      []string{"Port=2300", "User=ops", "User=ignored"},
+			}},
+			want: sshTarget{user: "ops", hostname: "shop.example.com", port: "2300",
+				identities: []string{home + "/keys/shop", home + "/.ssh/shop_ops"}, jumps: []string{"vpn"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host.Host, func(t *testing.T) {
+			got, err := (&sshClients{}).resolve(tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.user != tt.want.user || got.hostname != tt.want.hostname || got.port != tt.want.port ||
+				!slices.Equal(got.identities, tt.want.identities) || !slices.Equal(got.jumps, tt.want.jumps) {
+				t.Errorf("resolve() = %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+
+	if got := splitJump("admin@[::1]:2222"); got.Host != "admin@::1" || got.Port != "2222" {
+		t.Errorf("splitJump() = %+v", got)
+	}
+}
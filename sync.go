@@ -2,16 +2,34 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os/exec"
 	"strings"
 
 	"github.com/pterm/pterm"
 )
 
-func SyncFiles(ctx context.Context, cfg *Config, reverse bool) error {
+// SyncOptions are the per-run switches shared by file and database syncs.
+type SyncOptions struct {
+	Reverse bool // local to remote
+	DumpDB  bool // save the replaced SQL to a file
+	DryRun  bool // report what would change without writing anything
+
+	// DumpPath overrides the file DumpDB writes; a .gz or .zst extension
+	// compresses it.
+	DumpPath string
+
+	// FailOnUnmatched turns a replacement rule that matched nothing into an
+	// error instead of a warning.
+	FailOnUnmatched bool
+	// ContinueOnError keeps going after a failed sync path or step and
+	// reports all failures at the end, instead of stopping at the first.
+	ContinueOnError bool
+}
+
+func SyncFiles(ctx context.Context, x Executor, cfg *Config, opts SyncOptions) error {
 	direction := "remote to local"
-	if reverse {
+	if opts.Reverse {
 		direction = "local to remote"
 	}
 	pterm.DefaultSection.Printf("Syncing Files (%s)\n", direction)
@@ -23,64 +41,306 @@ func SyncFiles(ctx context.Context, cfg *Config, reverse bool) error {
 		}
 	}
 
+	var errs []error
 	for _, item := range cfg.Sync {
 		remotePath := ensureTrailingSlash(item.Remote)
 		localPath := ensureTrailingSlash(item.Local)
 
 		var msg string
-		if reverse {
+		if opts.Reverse {
 			msg = fmt.Sprintf("%s -> %s", localPath, remotePath)
 		} else {
 			msg = fmt.Sprintf("%s -> %s", remotePath, localPath)
 		}
 
-		pterm.DefaultBulletList.WithItems([]pterm.BulletListItem{
-			{Level: 0, Text: msg, TextStyle: pterm.NewStyle(pterm.FgCyan)},
-		}).Render()
-
-		if len(item.Exclude) > 0 {
-			var excludes []pterm.BulletListItem
-			for _, v := range item.Exclude {
-				excludes = append(excludes, pterm.BulletListItem{Level: 1, Text: "Exclude: " + v, TextStyle: pterm.NewStyle(pterm.FgGray)})
+		err := syncFileItem(msg, item, "Running rsync", opts, func() (string, error) {
+			return runRsync(ctx, x, cfg, item, remotePath, localPath, opts)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", msg, err))
+			if !opts.ContinueOnError {
+				break
 			}
-			pterm.DefaultBulletList.WithItems(excludes).Render()
 		}
+	}
+	return fileSyncError(errs, len(cfg.Sync))
+}
 
-		spinner, _ := pterm.DefaultSpinner.Start("Running rsync...")
-		if err := runRsync(ctx, cfg, item, remotePath, localPath, reverse); err != nil {
-			spinner.Fail(fmt.Sprintf("Rsync failed: %v", err))
-		} else {
-			spinner.Success("Rsync completed")
+// fileSyncError combines the failures of individual sync paths into one
+// error, or returns nil if there were none.
+func fileSyncError(errs []error, total int) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d sync paths failed:\n%w", len(errs), total, errors.Join(errs...))
+}
+
+// syncFileItem prints one sync entry and runs rsync for it. In a dry run the
+// itemized rsync output is summarised instead.
+func syncFileItem(msg string, item SyncPath, action string, opts SyncOptions, run func() (string, error)) error {
+	pterm.DefaultBulletList.WithItems([]pterm.BulletListItem{
+		{Level: 0, Text: msg, TextStyle: pterm.NewStyle(pterm.FgCyan)},
+	}).Render()
+
+	if len(item.Exclude) > 0 {
+		var excludes []pterm.BulletListItem
+		for _, v := range item.Exclude {
+			excludes = append(excludes, pterm.BulletListItem{Level: 1, Text: "Exclude: " + v, TextStyle: pterm.NewStyle(pterm.FgGray)})
 		}
-		fmt.Println()
+		pterm.DefaultBulletList.WithItems(excludes).Render()
+	}
+
+	if opts.DryRun {
+		action += " (dry run)"
 	}
-	return nil
+
+	spinner, _ := pterm.DefaultSpinner.Start(action + "...")
+	output, err := run()
+	switch {
+	case err != nil:
+		spinner.Fail(fmt.Sprintf("Rsync failed: %v", err))
+	case opts.DryRun:
+		changes := parseItemizedChanges(output)
+		spinner.Success(fmt.Sprintf("Would add %d, change %d", len(changes.Added), len(changes.Changed)))
+		printFileChanges(changes)
+	default:
+		spinner.Success("Rsync completed")
+	}
+	fmt.Println()
+	return err
 }
 
-func runRsync(ctx context.Context, cfg *Config, item SyncPath, remotePath, localPath string, reverse bool) error {
+func runRsync(ctx context.Context, x Executor, cfg *Config, item SyncPath, remotePath, localPath string, opts SyncOptions) (string, error) {
 	args := []string{
-		"-azr",
-		"-e", "ssh -p " + cfg.Port,
-		"--info=progress2",
+		"rsync", "-azr",
+		"-e", cfg.sshHost().rsyncShell(),
 	}
+	args = append(args, rsyncModeArgs(opts)...)
 
 	for _, v := range item.Exclude {
 		args = append(args, "--exclude="+v)
 	}
 
-	if reverse {
+	if opts.Reverse {
 		args = append(args, localPath, cfg.SSHHost+":"+remotePath)
 	} else {
 		args = append(args, cfg.SSHHost+":"+remotePath, localPath)
 	}
 
-	cmd := exec.CommandContext(ctx, "rsync", args...)
-	output, err := cmd.CombinedOutput()
+	output, err := combinedOutput(ctx, x, Command{Args: args})
+	if err != nil {
+		return "", newRsyncError(err, output, false)
+	}
+
+	return string(output), nil
+}
+
+// SyncFilesBetween syncs files from one SSH environment to another without
+// routing them through this machine: rsync runs on the source host and
+// connects to the target itself. The ssh agent is forwarded so the source
+// host can authenticate to the target with the caller's keys.
+func SyncFilesBetween(ctx context.Context, x Executor, pair *RemotePair, opts SyncOptions) error {
+	pterm.DefaultSection.Printf("Syncing Files (%s to %s)\n", pair.FromName, pair.ToName)
+
+	var errs []error
+	for _, item := range pair.Sync {
+		srcPath := ensureTrailingSlash(item.Remote)
+		dstPath := ensureTrailingSlash(item.Local)
+
+		msg := fmt.Sprintf("%s:%s -> %s:%s", pair.FromName, srcPath, pair.ToName, dstPath)
+		err := syncFileItem(msg, item, fmt.Sprintf("Running rsync on %s", pair.FromName), opts, func() (string, error) {
+			return runRemoteRsync(ctx, x, pair, item, srcPath, dstPath, opts)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", msg, err))
+			if !opts.ContinueOnError {
+				break
+			}
+		}
+	}
+	return fileSyncError(errs, len(pair.Sync))
+}
+
+func runRemoteRsync(ctx context.Context, x Executor, pair *RemotePair, item SyncPath, srcPath, dstPath string, opts SyncOptions) (string, error) {
+	// The identity file is a path on this machine; from the source host the
+	// target is reached with the forwarded agent
+	to := pair.To.sshHost()
+	to.SSH.IdentityFile = ""
+
+	rsync := []string{"rsync", "-azr", "-e", to.rsyncShell()}
+	rsync = append(rsync, rsyncModeArgs(opts)...)
+	for _, v := range item.Exclude {
+		rsync = append(rsync, "--exclude="+v)
+	}
+	rsync = append(rsync, srcPath, pair.To.SSHHost+":"+dstPath)
+
+	src := sshExecutor{local: x, host: pair.From.sshHost(), forwardAgent: true}
+	output, err := combinedOutput(ctx, src, Command{Args: rsync})
 	if err != nil {
-		return fmt.Errorf("%w: %s", err, string(output))
+		return "", newRsyncError(err, output, true)
+	}
+
+	return string(output), nil
+}
+
+// RsyncError is a failed rsync run. Code is rsync's exit status, or -1 if
+// rsync could not be started.
+type RsyncError struct {
+	Code   int
+	Output string // the last lines rsync printed
+	viaSSH bool   // rsync was run through ssh, so 255 is ssh's own failure
+	err    error
+}
+
+func newRsyncError(err error, output []byte, viaSSH bool) *RsyncError {
+	e := &RsyncError{Code: -1, Output: lastLines(string(output), 5), viaSSH: viaSSH, err: err}
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		e.Code = exitErr.ExitCode()
+	}
+	return e
+}
+
+func (e *RsyncError) Error() string {
+	msg := e.err.Error()
+	if e.Code >= 0 {
+		msg = fmt.Sprintf("rsync exited with code %d", e.Code)
+		if meaning := rsyncExitMeaning(e.Code, e.viaSSH); meaning != "" {
+			msg += " (" + meaning + ")"
+		}
+	}
+	if e.Output != "" {
+		msg += ": " + e.Output
+	}
+	return msg
+}
+
+func (e *RsyncError) Unwrap() error {
+	return e.err
+}
+
+// rsyncExitMeaning explains an rsync exit code, as listed in rsync(1).
+func rsyncExitMeaning(code int, viaSSH bool) string {
+	switch code {
+	case 1:
+		return "syntax or usage error"
+	case 2:
+		return "protocol incompatibility"
+	case 3:
+		return "errors selecting input/output files or directories"
+	case 5:
+		return "error starting client-server protocol"
+	case 10:
+		return "error in socket I/O"
+	case 11:
+		return "error in file I/O"
+	case 12:
+		return "error in rsync protocol data stream"
+	case 20:
+		return "interrupted"
+	case 23:
+		return "partial transfer due to error"
+	case 24:
+		return "partial transfer, some source files vanished"
+	case 30:
+		return "timeout in data send/receive"
+	case 35:
+		return "timeout waiting for daemon connection"
+	case 127:
+		return "rsync not found"
+	case 255:
+		if viaSSH {
+			return "ssh connection failed"
+		}
+		return "remote shell failed"
+	}
+	return ""
+}
+
+// lastLines returns up to n trailing non-empty lines of output, joined with
+// "; ". Progress output separated by carriage returns is dropped.
+func lastLines(output string, n int) string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		if i := strings.LastIndexByte(line, '\r'); i >= 0 {
+			line = line[i+1:]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
 	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "; ")
+}
+
+// rsyncModeArgs returns the flags that differ between a real and a dry run.
+func rsyncModeArgs(opts SyncOptions) []string {
+	if opts.DryRun {
+		return []string{"--dry-run", "--itemize-changes"}
+	}
+	return []string{"--info=progress2"}
+}
+
+// fileChanges is what an itemized rsync run reported. Syncs never pass
+// --delete, so nothing is ever deleted.
+type fileChanges struct {
+	Added, Changed []string
+}
+
+// parseItemizedChanges reads the output of rsync --itemize-changes. Each
+// line is an 11 character change summary (e.g. ">f+++++++++") followed by
+// the path; entries that only touch directory attributes are ignored.
+func parseItemizedChanges(output string) fileChanges {
+	var changes fileChanges
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		flags, path, ok := strings.Cut(line, " ")
+		if !ok || len(flags) != 11 || !strings.ContainsRune("<>ch.", rune(flags[0])) {
+			continue
+		}
+		path = strings.TrimSpace(path)
 
-	return nil
+		switch {
+		case strings.Contains(flags[2:], "+++++++"):
+			changes.Added = append(changes.Added, path)
+		case flags[0] == '.' && flags[1] == 'd':
+			// Directory timestamp or permission update only
+		case strings.Trim(flags[2:], ".") == "":
+			// Unchanged
+		default:
+			changes.Changed = append(changes.Changed, path)
+		}
+	}
+	return changes
+}
+
+// printFileChanges lists the files a dry run would touch, a limited number
+// per category.
+func printFileChanges(changes fileChanges) {
+	const limit = 20
+
+	for _, group := range []struct {
+		label string
+		paths []string
+		color pterm.Color
+	}{
+		{"Add", changes.Added, pterm.FgGreen},
+		{"Change", changes.Changed, pterm.FgYellow},
+	} {
+		var items []pterm.BulletListItem
+		for i, path := range group.paths {
+			if i == limit {
+				items = append(items, pterm.BulletListItem{Level: 1, Text: fmt.Sprintf("... and %d more", len(group.paths)-limit), TextStyle: pterm.NewStyle(pterm.FgGray)})
+				break
+			}
+			items = append(items, pterm.BulletListItem{Level: 1, Text: group.label + ": " + path, TextStyle: pterm.NewStyle(group.color)})
+		}
+		if len(items) > 0 {
+			pterm.DefaultBulletList.WithItems(items).Render()
+		}
+	}
 }
 
 func ensureTrailingSlash(s string) string {
@@ -1,6 +1,14 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestEnsureTrailingSlash(t *testing.T) {
 	tests := []struct {
@@ -22,3 +30,103 @@ func TestEnsureTrailingSlash(t *testing.T) {
 		})
 	}
 }
+
+func TestParseItemizedChanges(t *testing.T) {
+	output := `sending incremental file list
+cd+++++++++ 2024/
+>f+++++++++ 2024/new.jpg
+>f.st...... changed.jpg
+<f..t...... pushed.txt
+.d..t...... ./
+.f...p..... perms.txt
+cL+++++++++ link -> target
+
+sent 1,234 bytes  received 56 bytes  2,580.00 bytes/sec
+total size is 9,999  speedup is 7.75 (DRY RUN)
+`
+
+	got := parseItemizedChanges(output)
+	want := fileChanges{
+		Added:   []string{"2024/", "2024/new.jpg", "link -> target"},
+		Changed: []string{"changed.jpg", "pushed.txt", "perms.txt"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseItemizedChanges()\nGot:  %+v\nWant: %+v", got, want)
+	}
+}
+
+// fakeRsync puts an rsync on PATH that fails with code 23 for sources
+// containing "broken" and succeeds otherwise, logging each source.
+func fakeRsync(t *testing.T) (logFile string) {
+	t.Helper()
+	bin := t.TempDir()
+	logFile = filepath.Join(bin, "calls")
+	script := `#!/bin/sh
+for a; do src=$prev; prev=$a; done
+echo "$src" >> "` + logFile + `"
+case "$src" in
+*broken*) echo "rsync: [sender] link_stat \"$src\" failed: No such file or directory (2)" >&2; exit 23 ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(bin, "rsync"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return logFile
+}
+
+func TestSyncFilesReportsRsyncFailures(t *testing.T) {
+	cfg := &Config{
+		SSHHost: "user@host",
+		Sync: []SyncPath{
+			{Remote: "/srv/broken", Local: "/tmp/a"},
+			{Remote: "/srv/uploads", Local: "/tmp/b"},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		opts      SyncOptions
+		wantCalls int
+	}{
+		{"stop at first failure", SyncOptions{}, 1},
+		{"continue on error", SyncOptions{ContinueOnError: true}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logFile := fakeRsync(t)
+
+			err := SyncFiles(context.Background(), systemExecutor{}, cfg, tt.opts)
+			if err == nil {
+				t.Fatal("SyncFiles() returned nil for a failed rsync")
+			}
+			for _, want := range []string{"1 of 2 sync paths failed", "code 23 (partial transfer due to error)", "link_stat"} {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+
+			var rsyncErr *RsyncError
+			if !errors.As(err, &rsyncErr) || rsyncErr.Code != 23 {
+				t.Errorf("expected an *RsyncError with code 23, got %v", err)
+			}
+
+			calls, _ := os.ReadFile(logFile)
+			if got := strings.Count(string(calls), "\n"); got != tt.wantCalls {
+				t.Errorf("rsync ran %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestLastLines(t *testing.T) {
+	output := "a\n\n  1%\r 50%\r100%\nb\nc\n"
+	if got := lastLines(output, 2); got != "b; c" {
+		t.Errorf("lastLines() = %q", got)
+	}
+	if got := lastLines(output, 5); got != "a; 100%; b; c" {
+		t.Errorf("lastLines() = %q", got)
+	}
+}
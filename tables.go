@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// TableFilter selects the tables a database dump contains. Entries are
+// table names or glob patterns (*, ? and [...]).
+type TableFilter struct {
+	// Include limits the dump to matching tables; empty means all tables.
+	Include []string `json:"include,omitempty"`
+	// Exclude leaves matching tables out entirely, so the target keeps its
+	// own copy of them.
+	Exclude []string `json:"exclude,omitempty"`
+	// StructureOnly dumps matching tables without their rows.
+	StructureOnly []string `json:"structureOnly,omitempty"`
+}
+
+func (f TableFilter) IsZero() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0 && len(f.StructureOnly) == 0
+}
+
+// merge layers o over f: o's Include replaces f's when set, Exclude and
+// StructureOnly are combined.
+func (f TableFilter) merge(o TableFilter) TableFilter {
+	merged := TableFilter{
+		Include:       f.Include,
+		Exclude:       append(append([]string(nil), f.Exclude...), o.Exclude...),
+		StructureOnly: append(append([]string(nil), f.StructureOnly...), o.StructureOnly...),
+	}
+	if len(o.Include) > 0 {
+		merged.Include = o.Include
+	}
+	return merged
+}
+
+// validate checks that every pattern is well formed.
+func (f TableFilter) validate() error {
+	for _, patterns := range [][]string{f.Include, f.Exclude, f.StructureOnly} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid table pattern '%s': %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// split sorts tables into those dumped with their data and those dumped
+// structure only. Excluded tables are in neither.
+func (f TableFilter) split(tables []string) (data, structure []string) {
+	for _, t := range tables {
+		switch {
+		case len(f.Include) > 0 && !matchTable(f.Include, t):
+		case matchTable(f.Exclude, t):
+		case matchTable(f.StructureOnly, t):
+			structure = append(structure, t)
+		default:
+			data = append(data, t)
+		}
+	}
+	return data, structure
+}
+
+// dumpArgs returns the arguments of the dump tool invocations needed for
+// db: one for the tables with data and, if any, a --no-data one for the
+// structure only tables.
+func (f TableFilter) dumpArgs(db string, tables []string) ([][]string, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	data, structure := f.split(tables)
+	if len(data) == 0 && len(structure) == 0 {
+		return nil, fmt.Errorf("the table filters leave no tables of '%s' to dump", db)
+	}
+
+	var sets [][]string
+	if len(data) > 0 {
+		sets = append(sets, append([]string{db}, data...))
+	}
+	if len(structure) > 0 {
+		sets = append(sets, append([]string{"--no-data", db}, structure...))
+	}
+	return sets, nil
+}
+
+func matchTable(patterns []string, table string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, table); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTableList reads the output of SHOW TABLES in batch mode, one table
+// per line.
+func parseTableList(output string) []string {
+	var tables []string
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			tables = append(tables, line)
+		}
+	}
+	return tables
+}
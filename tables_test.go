@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTableFilterDumpArgs(t *testing.T) {
+	tables := []string{"wp_options", "wp_posts", "wp_sessions", "wp_logs", "cache_items"}
+
+	tests := []struct {
+		name    string
+		filter  TableFilter
+		want    [][]string
+		wantErr bool
+	}{
+		{
+			name:   "include glob",
+			filter: TableFilter{Include: []string{"wp_*"}},
+			want:   [][]string{{"shop", "wp_options", "wp_posts", "wp_sessions", "wp_logs"}},
+		},
+		{
+			name:   "exclude",
+			filter: TableFilter{Exclude: []string{"wp_logs", "cache_*"}},
+			want:   [][]string{{"shop", "wp_options", "wp_posts", "wp_sessions"}},
+		},
+		{
+			name:   "structure only",
+			filter: TableFilter{Exclude: []string{"wp_logs"}, StructureOnly: []string{"wp_sessions", "cache_*"}},
+			want: [][]string{
+				{"shop", "wp_options", "wp_posts"},
+				{"--no-data", "shop", "wp_sessions", "cache_items"},
+			},
+		},
+		{
+			name:   "only structure",
+			filter: TableFilter{Include: []string{"cache_*"}, StructureOnly: []string{"*"}},
+			want:   [][]string{{"--no-data", "shop", "cache_items"}},
+		},
+		{
+			name:    "nothing left",
+			filter:  TableFilter{Include: []string{"missing_*"}},
+			wantErr: true,
+		},
+		{
+			name:    "bad pattern",
+			filter:  TableFilter{Exclude: []string{"wp_[logs"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.filter.dumpArgs("shop", tables)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dumpArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dumpArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTableFilterMerge(t *testing.T) {
+	base := TableFilter{Include: []string{"wp_*"}, Exclude: []string{"wp_logs"}}
+
+	got := base.merge(TableFilter{Exclude: []string{"wp_sessions"}, StructureOnly: []string{"wp_cache"}})
+	want := TableFilter{Include: []string{"wp_*"}, Exclude: []string{"wp_logs", "wp_sessions"}, StructureOnly: []string{"wp_cache"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merge() = %+v, want %+v", got, want)
+	}
+
+	got = base.merge(TableFilter{Include: []string{"shop_*"}})
+	if !reflect.DeepEqual(got.Include, []string{"shop_*"}) {
+		t.Errorf("merge() Include = %v, want the override", got.Include)
+	}
+	if len(base.Exclude) != 1 {
+		t.Errorf("merge() modified the receiver: %+v", base)
+	}
+}
+
+func TestMySQLDumpScriptListsTablesOnlyWhenFiltered(t *testing.T) {
+	listed := false
+	list := func() ([]string, error) {
+		listed = true
+		return []string{"a", "b"}, nil
+	}
+	drv := mysqlDriver{HostSettings{DB: "shop"}}
+
+	script, _, err := drv.dumpScript(TableFilter{}, list, identity)
+	if err != nil || listed || !strings.HasSuffix(script, `--defaults-extra-file="$f" shop`) {
+		t.Errorf("dumpScript() = %q, %v (listed %v)", script, err, listed)
+	}
+
+	script, _, err = drv.dumpScript(TableFilter{Exclude: []string{"b"}}, list, identity)
+	if err != nil || !strings.HasSuffix(script, `--defaults-extra-file="$f" shop a`) {
+		t.Errorf("dumpScript() = %q, %v", script, err)
+	}
+}
+
+func TestParseTableList(t *testing.T) {
+	got := parseTableList("wp_options\r\nwp_posts\n\n")
+	if !reflect.DeepEqual(got, []string{"wp_options", "wp_posts"}) {
+		t.Errorf("parseTableList() = %q", got)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configProblem is one thing wrong with a config. Path is the JSON path of
+// the value, e.g. environments.production.db.db or sync[0].local.
+type configProblem struct {
+	Path    string
+	Message string
+}
+
+func (p configProblem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// ConfigError lists every problem found in a config, so they can all be
+// fixed in one go.
+type ConfigError struct {
+	Problems []configProblem
+}
+
+func (e *ConfigError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].String()
+	}
+	lines := []string{fmt.Sprintf("%d problems:", len(e.Problems))}
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *ConfigError) add(path, format string, args ...any) {
+	e.Problems = append(e.Problems, configProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// merge adds the problems of err, the result of another check.
+func (e *ConfigError) merge(err error) {
+	var other *ConfigError
+	switch {
+	case err == nil:
+	case errors.As(err, &other):
+		e.Problems = append(e.Problems, other.Problems...)
+	default:
+		e.add("", "%v", err)
+	}
+}
+
+// err returns e, or nil without problems.
+func (e *ConfigError) err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validate checks everything LoadConfig can check without connecting
+// anywhere.
+func (c *Config) validate() error {
+	var e ConfigError
+	e.merge(c.validateLayout())
+	e.merge(c.validateDatabases())
+	e.merge(c.validateSSH())
+	e.merge(c.validateReplacements())
+	return e.err()
+}
+
+// validateLayout checks the required fields and sync paths of the single
+// host layout, or of the environments.
+func (c *Config) validateLayout() error {
+	var e ConfigError
+	if len(c.Environments) == 0 {
+		if c.SSHHost == "" {
+			e.add("sshHost", "is required")
+		}
+		if c.Remote.DB == "" {
+			e.add("remote.db", "is required")
+		}
+		if c.Local.DB == "" {
+			e.add("local.db", "is required")
+		}
+		for i, entry := range c.Sync {
+			at := fmt.Sprintf("sync[%d]", i)
+			if entry.Path != "" {
+				e.add(at+".path", "is only used with environments; set remote and local instead")
+			}
+			if msg := dangerousPath(entry.Remote, false); msg != "" {
+				e.add(at+".remote", "%s", msg)
+			}
+			if msg := dangerousPath(entry.Local, true); msg != "" {
+				e.add(at+".local", "%s", msg)
+			}
+		}
+		return e.err()
+	}
+
+	if len(c.DBReplace) > 0 {
+		e.add("dbReplace", "is ignored when environments are configured; use environments.<name>.replace")
+	}
+	paths := map[string]bool{}
+	for _, name := range c.EnvironmentNames() {
+		env := c.Environments[name]
+		at := "environments." + name
+		if env == nil {
+			e.add(at, "must be an object")
+			continue
+		}
+		if env.DB.DB == "" {
+			e.add(at+".db.db", "is required")
+		}
+		var names []string
+		for p := range env.Paths {
+			names = append(names, p)
+		}
+		sort.Strings(names)
+		for _, p := range names {
+			paths[p] = true
+			if msg := dangerousPath(env.Paths[p], env.IsLocal()); msg != "" {
+				e.add(at+".paths."+p, "%s", msg)
+			}
+		}
+	}
+	for i, entry := range c.Sync {
+		at := fmt.Sprintf("sync[%d]", i)
+		switch {
+		case entry.Path == "":
+			e.add(at+".path", "is required when environments are configured; name an entry of environments.<name>.paths")
+		case !paths[entry.Path]:
+			e.add(at+".path", "no environment defines path '%s'", entry.Path)
+		}
+	}
+	return e.err()
+}
+
+// dangerousPath returns why syncing into p could wipe unrelated files, or
+// "" if it looks safe. local is whether p is on this machine, where the
+// home directory is known.
+func dangerousPath(p string, local bool) string {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return "is empty, which rsync would take as the filesystem root"
+	}
+	switch path.Clean(p) {
+	case "/":
+		return "is the filesystem root"
+	case "~", "$HOME", "${HOME}":
+		return "is the home directory"
+	}
+	if local {
+		if home, err := os.UserHomeDir(); err == nil && filepath.Clean(expandHome(p)) == filepath.Clean(home) {
+			return "is the home directory"
+		}
+	}
+	return ""
+}
+
+// validateReplacements flags dbReplace rules that do nothing or that a
+// later rule rewrites again, since the rules apply one after another.
+func (c *Config) validateReplacements() error {
+	var e ConfigError
+	if len(c.Environments) > 0 {
+		// Unused; validateLayout reports them
+		return nil
+	}
+	for i, rule := range c.DBReplace {
+		at := fmt.Sprintf("dbReplace[%d]", i)
+		switch {
+		case rule.From == "":
+			e.add(at+".from", "is required")
+			continue
+		case rule.From == rule.To:
+			e.add(at, "from and to are the same ('%s')", rule.From)
+			continue
+		}
+		for j := i + 1; j < len(c.DBReplace); j++ {
+			later := c.DBReplace[j].From
+			if later != "" && strings.Contains(rule.To, later) {
+				e.add(at, "to '%s' is rewritten again by dbReplace[%d] (from '%s')", rule.To, j, later)
+			}
+		}
+	}
+	return e.err()
+}
+
+// unknownKeys reports the keys of raw, a decoded config document, that t
+// has no field for, with the closest known key as a suggestion.
+func unknownKeys(raw any, t reflect.Type, at string, e *ConfigError) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]any)
+		if !ok {
+			return
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedKeys(obj) {
+			field, ok := fields[key]
+			if !ok {
+				msg := "unknown key"
+				if s := suggestKey(key, fields); s != "" {
+					msg += fmt.Sprintf(" (did you mean '%s'?)", s)
+				}
+				e.add(joinPath(at, key), "%s", msg)
+				continue
+			}
+			unknownKeys(obj[key], field, joinPath(at, key), e)
+		}
+	case reflect.Map:
+		obj, ok := raw.(map[string]any)
+		if !ok {
+			return
+		}
+		for _, key := range sortedKeys(obj) {
+			unknownKeys(obj[key], t.Elem(), joinPath(at, key), e)
+		}
+	case reflect.Slice:
+		list, ok := raw.([]any)
+		if !ok {
+			return
+		}
+		for i, v := range list {
+			unknownKeys(v, t.Elem(), fmt.Sprintf("%s[%d]", at, i), e)
+		}
+	}
+}
+
+// jsonFields maps the JSON keys of struct type t to the types of their
+// fields, including those of embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key, ok := jsonKey(f)
+		switch {
+		case !ok:
+		case key == "":
+			for k, v := range jsonFields(f.Type) {
+				fields[k] = v
+			}
+		default:
+			fields[key] = f.Type
+		}
+	}
+	return fields
+}
+
+// jsonKey returns the key of struct field f in JSON, "" for an embedded
+// struct, whose fields are promoted into the outer object, and false for a
+// field that is never encoded.
+func jsonKey(f reflect.StructField) (string, bool) {
+	if !f.IsExported() {
+		return "", false
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	switch {
+	case name == "-":
+		return "", false
+	case name == "" && f.Anonymous && f.Type.Kind() == reflect.Struct:
+		return "", true
+	case name == "":
+		return f.Name, true
+	}
+	return name, true
+}
+
+// suggestKey returns the known key closest to key, if any is close enough
+// to be a likely typo.
+func suggestKey(key string, fields map[string]reflect.Type) string {
+	best, bestDist := "", 0
+	for name := range fields {
+		d := editDistance(strings.ToLower(key), strings.ToLower(name))
+		if d > 2 && d > len(name)/3 {
+			continue
+		}
+		if best == "" || d < bestDist || d == bestDist && name < best {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinPath(at, key string) string {
+	if at == "" {
+		return key
+	}
+	return at + "." + key
+}
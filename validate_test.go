@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want []string // problems, in order; none for a valid config
+	}{
+		{
+			name: "valid",
+			json: `{"sshHost": "user@host", "remote": {"db": "prod"}, "local": {"db": "dev"},
+				"sync": [{"remote": "/var/www/uploads", "local": "/srv/uploads"}],
+				"dbReplace": [{"from": "https://example.com", "to": "http://example.test"}],
+				"snapshots": {"keepLast": 3}}`,
+		},
+		{
+			name: "required fields",
+			json: `{"remote": {}, "local": {"db": "dev"}}`,
+			want: []string{"sshHost: is required", "remote.db: is required"},
+		},
+		{
+			name: "unknown keys",
+			json: `{"sshHost": "user@host", "remote": {"db": "prod", "pasword": "x"}, "local": {"db": "dev"},
+				"dbReplce": [], "sync": [{"remote": "/a", "local": "/b", "excludes": []}], "colour": true}`,
+			want: []string{
+				"colour: unknown key",
+				"dbReplce: unknown key (did you mean 'dbReplace'?)",
+				"remote.pasword: unknown key (did you mean 'password'?)",
+				"sync[0].excludes: unknown key (did you mean 'exclude'?)",
+			},
+		},
+		{
+			name: "dangerous paths",
+			json: `{"sshHost": "user@host", "remote": {"db": "prod"}, "local": {"db": "dev"},
+				"sync": [{"remote": "", "local": "/srv/a"}, {"remote": "~/", "local": "//"}]}`,
+			want: []string{
+				"sync[0].remote: is empty, which rsync would take as the filesystem root",
+				"sync[1].remote: is the home directory",
+				"sync[1].local: is the filesystem root",
+			},
+		},
+		{
+			name: "replacements",
+			json: `{"sshHost": "user@host", "remote": {"db": "prod"}, "local": {"db": "dev"},
+				"dbReplace": [{"from": "example.com", "to": "example.com"}, {"from": "", "to": "x"},
+					{"from": "example.com", "to": "example.test"}, {"from": "example.t", "to": "example.dev"}]}`,
+			want: []string{
+				"dbReplace[0]: from and to are the same ('example.com')",
+				"dbReplace[1].from: is required",
+				"dbReplace[2]: to 'example.test' is rewritten again by dbReplace[3] (from 'example.t')",
+			},
+		},
+		{
+			name: "environments",
+			json: `{"environments": {
+					"production": {"sshHost": "user@host", "db": {"db": "prod"}, "paths": {"uploads": "/"}},
+					"local": {"db": {}, "paths": {"uploads": "/srv/uploads"}, "ssh": {"client": "system"}}},
+				"sync": [{"path": "uploads"}, {"path": "themes"}, {"exclude": ["cache/"]}],
+				"dbReplace": [{"from": "example.com", "to": "example.com"}]}`,
+			want: []string{
+				"dbReplace: is ignored when environments are configured; use environments.<name>.replace",
+				"environments.local.db.db: is required",
+				"environments.production.paths.uploads: is the filesystem root",
+				"sync[1].path: no environment defines path 'themes'",
+				"sync[2].path: is required when environments are configured; name an entry of environments.<name>.paths",
+				"environments.local.ssh: client can only be set at the top level",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dsync-config.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConfig(path)
+
+			var got []string
+			var problems *ConfigError
+			if errors.As(err, &problems) {
+				for _, p := range problems.Problems {
+					got = append(got, p.String())
+				}
+			} else if err != nil {
+				t.Fatalf("LoadConfig() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("problems = %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDangerousPathHome(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	for _, p := range []string{home, home + "/", "~", "$HOME"} {
+		if dangerousPath(p, true) == "" {
+			t.Errorf("dangerousPath(%q) accepted the home directory", p)
+		}
+	}
+	// This machine's home directory says nothing about a remote one
+	if msg := dangerousPath(home, false); msg != "" {
+		t.Errorf("dangerousPath(%q, remote) = %q", home, msg)
+	}
+	if msg := dangerousPath(filepath.Join(home, "www"), true); msg != "" {
+		t.Errorf("dangerousPath() rejected a directory in home: %q", msg)
+	}
+}